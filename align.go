@@ -0,0 +1,125 @@
+// Alignment.  Moves finished lines along, to centre, right align or justify them
+package glim
+
+import (
+	"sort"
+)
+
+// How lines are placed between the edges of the text box
+type Alignment int
+
+const (
+	AlignStart   Alignment = iota // Left, or right for right-to-left paragraphs.  The top, for vertical text.  Lines keep the starting position given to LayoutTokenPara
+	AlignLeft                     // The top, for vertical text
+	AlignCentre                   // Centred
+	AlignRight                    // The bottom, for vertical text
+	AlignJustify                  // Spaces are stretched so wrapped lines fill the whole width (or between all the characters, if there are no spaces, as for Chinese and Japanese).  The last line of a paragraph is aligned to the start
+)
+
+// Move the glyphs of a finished line along it, so the line sits between start and end as align says.  last is set for the last line of a paragraph.  Trailing spaces don't count, and hang past the end
+func alignLine(line []lineGlyph, align Alignment, vert bool, start, end int, last bool) {
+	if align == AlignStart || (align == AlignJustify && last) {
+		return
+	}
+	along := func(g lineGlyph) int {
+		if vert {
+			return g.y
+		}
+		return g.x
+	}
+	move := func(k, by int) {
+		if vert {
+			line[k].y += by
+		} else {
+			line[k].x += by
+		}
+	}
+	// The glyphs that count are the ones before the trailing spaces, in logical order
+	content := len(line)
+	for content > 0 && (line[content-1].space || line[content-1].hold) {
+		content--
+	}
+	if content == 0 {
+		return
+	}
+	lo, hi := along(line[0]), along(line[0])+line[0].advance
+	for _, g := range line[:content] {
+		lo = MinI(lo, along(g))
+		hi = MaxI(hi, along(g)+g.advance)
+	}
+	shift := 0
+	switch align {
+	case AlignLeft, AlignJustify:
+		shift = start - lo
+	case AlignCentre:
+		shift = (start + end - lo - hi) / 2
+	case AlignRight:
+		shift = end - hi
+	}
+	for k := range line {
+		move(k, shift)
+	}
+	free := (end - start) - (hi - lo)
+	if align != AlignJustify || free <= 0 {
+		return
+	}
+	// Share the free space out between the spaces, or failing that between all the characters, in display order
+	order := make([]int, len(line))
+	for k := range order {
+		order[k] = k
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return along(line[order[a]]) < along(line[order[b]])
+	})
+	stretch := func(k int) bool {
+		return k < content && line[k].space && !line[k].hold && !line[k].tab
+	}
+	points := 0
+	for k := 0; k < content; k++ {
+		if stretch(k) {
+			points++
+		}
+	}
+	if points == 0 {
+		stretch = func(k int) bool {
+			return k < content && !line[k].hold
+		}
+		// The last character of the line has nothing after it to push away
+		points = -1
+		for k := 0; k < content; k++ {
+			if stretch(k) {
+				points++
+			}
+		}
+		lastVisible := -1
+		for _, k := range order {
+			if stretch(k) {
+				lastVisible = k
+			}
+		}
+		inner := stretch
+		stretch = func(k int) bool {
+			return inner(k) && k != lastVisible
+		}
+	}
+	if points <= 0 {
+		return
+	}
+	added, n := 0, 0
+	for _, k := range order {
+		move(k, added)
+		if stretch(k) {
+			share := free*(n+1)/points - free*n/points
+			n++
+			line[k].advance += share
+			if line[k].space {
+				if vert {
+					line[k].h += share
+				} else {
+					line[k].w += share
+				}
+			}
+			added += share
+		}
+	}
+}
@@ -0,0 +1,613 @@
+// ANSI escape sequences.  Turns captured terminal output into styled tokens, the way it looked in the terminal
+package glim
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rivo/uniseg"
+)
+
+// The 16 standard terminal colours: black, red, green, yellow, blue, magenta, cyan and white, then their bright versions.  These are xterm's
+var ANSIPalette = [16]RGBA{
+	{0, 0, 0, 255}, {205, 0, 0, 255}, {0, 205, 0, 255}, {205, 205, 0, 255},
+	{0, 0, 238, 255}, {205, 0, 205, 255}, {0, 205, 205, 255}, {229, 229, 229, 255},
+	{127, 127, 127, 255}, {255, 0, 0, 255}, {0, 255, 0, 255}, {255, 255, 0, 255},
+	{92, 92, 255, 255}, {255, 0, 255, 255}, {0, 255, 255, 255}, {255, 255, 255, 255},
+}
+
+// How far cursor movement can take the cursor, in lines and columns, unless the text is already longer.  Output is untrusted, and every line and column the cursor skips over is stored
+const (
+	termMaxLines   = 10000
+	termMaxColumns = 4096
+)
+
+// A character on the terminal's screen
+type termCell struct {
+	text  string // "" for the second column of a wide character
+	style Style
+}
+
+// The attributes set by SGR sequences
+type sgrState struct {
+	fg, bg, underlineColour                       *RGBA
+	bold, faint, italic, reverse, conceal, strike bool
+	underline                                     Underline
+}
+
+// A minimal terminal, for showing captured command output.  Write output to it, and it follows the SGR colours and attributes (16, 256 and 24 bit colour, bold, italic, underline, reverse and so on), carriage returns, backspaces, cursor movement and erasing, so progress bars and redrawn lines come out the way they looked.  Other escape sequences are dropped.
+//
+// There is no fixed width, so long lines don't wrap until they are laid out.  Moving the cursor only pads a line out to 4096 columns, and the text out to 10000 lines, so untrusted output can't use up memory with blank space
+type Terminal struct {
+	Style    Style    // The style of text with no attributes set.  Reverse video swaps its colours, which default to white on black
+	Palette  [16]RGBA // Colours 0 to 15, used by SGR 30-37, 40-47, 90-97 and 100-107, and the 256 colour sequences
+	TabWidth int      // Tab stops are every TabWidth columns
+	Height   int      // The screen's height in lines, for cursor positioning and erasing.  The cursor can't be moved below the screen.  0 makes all the output the screen
+
+	lines              [][]termCell
+	row, col           int
+	savedRow, savedCol int
+	attrs              sgrState
+	style              Style  // The style for new text, made from attrs
+	pending            string // An unfinished escape sequence or character at the end of the last Write
+}
+
+// Create a terminal whose plain text has style base
+func NewTerminal(base Style) *Terminal {
+	t := &Terminal{Style: base, Palette: ANSIPalette, TabWidth: 8}
+	t.Reset()
+	return t
+}
+
+// Turn terminal output into tokens, one per grapheme cluster, ready for RenderTokenPara
+func ParseANSI(text string, base Style) []Token {
+	t := NewTerminal(base)
+	t.Write(text)
+	return t.Tokens()
+}
+
+// Clear the screen, and go back to plain text at the top left
+func (t *Terminal) Reset() {
+	t.lines = nil
+	t.row, t.col = 0, 0
+	t.savedRow, t.savedCol = 0, 0
+	t.attrs = sgrState{}
+	t.style = t.Style
+	t.pending = ""
+}
+
+// Add output.  Escape sequences and characters can be split across calls
+func (t *Terminal) Write(text string) {
+	text = t.pending + text
+	t.pending = ""
+	for len(text) > 0 {
+		c := text[0]
+		switch {
+		case c == 0x1b:
+			n := escapeLength(text)
+			if n == 0 {
+				t.pending = text
+				return
+			}
+			t.escape(text[:n])
+			text = text[n:]
+			continue
+		case c == '\n', c == '\v', c == '\f':
+			// Captured output has "\n" for a new line, without the carriage return a terminal driver would add
+			t.row++
+			t.col = 0
+			t.line()
+		case c == '\r':
+			t.col = 0
+		case c == '\b':
+			if t.col > 0 {
+				t.col--
+			}
+		case c == '\t':
+			tab := t.TabWidth
+			if tab < 1 {
+				tab = 8
+			}
+			t.col = (t.col/tab + 1) * tab
+		case c < 0x20 || c == 0x7f:
+			// Other control characters, like the bell, don't print anything
+		default:
+			end := 0
+			for end < len(text) && text[end] >= 0x20 && text[end] != 0x7f {
+				end++
+			}
+			run := text[:end]
+			if end == len(text) {
+				// Keep a character that was cut off for the next Write
+				for k := 1; k <= utf8.UTFMax && k <= len(run); k++ {
+					if utf8.RuneStart(run[len(run)-k]) {
+						if !utf8.FullRuneInString(run[len(run)-k:]) {
+							t.pending = run[len(run)-k:]
+							run = run[:len(run)-k]
+						}
+						break
+					}
+				}
+			}
+			for _, g := range Graphemes(run) {
+				t.put(g)
+			}
+			text = text[len(run)+len(t.pending):]
+			continue
+		}
+		text = text[1:]
+	}
+}
+
+// The length of the escape sequence at the start of s, or 0 if it is unfinished
+func escapeLength(s string) int {
+	if len(s) < 2 {
+		return 0
+	}
+	switch s[1] {
+	case '[':
+		// Parameters, then intermediates, then a final byte
+		for i := 2; i < len(s); i++ {
+			c := s[i]
+			if c >= 0x40 && c <= 0x7e {
+				return i + 1
+			}
+			if c < 0x20 || c > 0x3f {
+				// Broken, drop what there is
+				return i
+			}
+		}
+		return 0
+	case ']', 'P', '_', '^', 'X':
+		// Strings like window titles and hyperlinks, ended by a bell or ESC \
+		for i := 2; i < len(s); i++ {
+			if s[i] == 0x07 {
+				return i + 1
+			}
+			if s[i] == 0x1b {
+				if i+1 == len(s) {
+					return 0
+				}
+				return i + 2
+			}
+		}
+		return 0
+	}
+	if s[1] >= 0x20 && s[1] <= 0x2f {
+		// Character set selection, like ESC ( B
+		if len(s) < 3 {
+			return 0
+		}
+		return 3
+	}
+	return 2
+}
+
+// The screen's first line
+func (t *Terminal) top() int {
+	if t.Height > 0 && len(t.lines) > t.Height {
+		return len(t.lines) - t.Height
+	}
+	return 0
+}
+
+// The cursor's line, which is created if it isn't there yet
+func (t *Terminal) line() []termCell {
+	for len(t.lines) <= t.row {
+		t.lines = append(t.lines, nil)
+	}
+	return t.lines[t.row]
+}
+
+// A blank, with the current background colour, as left by erasing
+func (t *Terminal) blank() termCell {
+	s := t.Style
+	if t.attrs.bg != nil {
+		s.BackgroundColour = t.attrs.bg
+	}
+	return termCell{" ", s}
+}
+
+// Write a grapheme cluster at the cursor, and move past it
+func (t *Terminal) put(g string) {
+	line := t.line()
+	w := uniseg.StringWidth(g)
+	if w == 0 {
+		// Something zero width that didn't join onto the character before it, like a lone combining mark after a cursor movement
+		if t.col > 0 && t.col <= len(line) {
+			line[t.col-1].text += g
+		}
+		return
+	}
+	if w > 2 {
+		w = 2
+	}
+	for len(line) < t.col+w {
+		line = append(line, termCell{" ", t.Style})
+	}
+	// Overwriting half of a wide character blanks the other half
+	if line[t.col].text == "" && t.col > 0 {
+		line[t.col-1].text = " "
+	}
+	if t.col+w < len(line) && line[t.col+w].text == "" {
+		line[t.col+w].text = " "
+	}
+	line[t.col] = termCell{g, t.style}
+	if w == 2 {
+		line[t.col+1] = termCell{"", t.style}
+	}
+	t.lines[t.row] = line
+	t.col += w
+}
+
+// Blank columns from up to to of the cursor's line
+func (t *Terminal) erase(from, to int) {
+	line := t.line()
+	to = MinI(to, len(line))
+	if from >= to {
+		return
+	}
+	for i := from; i < to; i++ {
+		line[i] = t.blank()
+	}
+	if to == len(line) && t.attrs.bg == nil {
+		// Nothing to show past the end of the line, so drop the blanks
+		t.lines[t.row] = line[:from]
+	}
+}
+
+func (t *Terminal) escape(seq string) {
+	switch seq[1] {
+	case '[':
+		if final := seq[len(seq)-1]; len(seq) > 2 && final >= 0x40 {
+			t.csi(seq[2:len(seq)-1], final)
+		}
+	case '7':
+		t.savedRow, t.savedCol = t.row, t.col
+	case '8':
+		t.row, t.col = t.savedRow, t.savedCol
+	case 'D':
+		t.row++
+	case 'E':
+		t.row++
+		t.col = 0
+	case 'M':
+		if t.row > t.top() {
+			t.row--
+		}
+	case 'c':
+		t.Reset()
+	}
+	t.clampCursor()
+}
+
+// Handle a control sequence, ESC [ params final
+func (t *Terminal) csi(params string, final byte) {
+	if params != "" && strings.ContainsRune("?<=>", rune(params[0])) {
+		// Private modes, like hiding the cursor, don't change the text
+		return
+	}
+	if final == 'm' {
+		t.sgr(params)
+		return
+	}
+	args := strings.Split(params, ";")
+	arg := func(i, def int) int {
+		if i >= len(args) {
+			return def
+		}
+		n, err := strconv.Atoi(args[i])
+		if err != nil || n < 1 {
+			return def
+		}
+		return n
+	}
+	n := arg(0, 1)
+	top := t.top()
+	switch final {
+	case 'A':
+		t.row = MaxI(t.row-n, top)
+	case 'B', 'e':
+		t.row += n
+	case 'C', 'a':
+		t.col += n
+	case 'D':
+		t.col = MaxI(t.col-n, 0)
+	case 'E':
+		t.row += n
+		t.col = 0
+	case 'F':
+		t.row = MaxI(t.row-n, top)
+		t.col = 0
+	case 'G', '`':
+		t.col = n - 1
+	case 'd':
+		t.row = top + n - 1
+	case 'H', 'f':
+		t.row = top + n - 1
+		t.col = arg(1, 1) - 1
+	case 'J':
+		t.line()
+		switch arg(0, 0) {
+		case 0:
+			t.erase(t.col, len(t.lines[t.row]))
+			t.lines = t.lines[:t.row+1]
+		case 1:
+			for i := top; i < t.row; i++ {
+				t.lines[i] = nil
+			}
+			t.erase(0, t.col+1)
+		case 2:
+			for i := top; i < len(t.lines); i++ {
+				t.lines[i] = nil
+			}
+		case 3:
+			// The scrollback too
+			t.lines = t.lines[top:]
+			t.row -= top
+			t.savedRow = MaxI(t.savedRow-top, 0)
+			for i := range t.lines {
+				t.lines[i] = nil
+			}
+		}
+	case 'K':
+		line := t.line()
+		switch arg(0, 0) {
+		case 0:
+			t.erase(t.col, len(line))
+		case 1:
+			t.erase(0, t.col+1)
+		case 2:
+			t.erase(0, len(line))
+		}
+	case 'X':
+		t.erase(t.col, t.col+n)
+	case 'P':
+		// Delete characters, pulling the rest of the line left
+		line := t.line()
+		if t.col < len(line) {
+			n = MinI(n, len(line)-t.col)
+			t.lines[t.row] = append(line[:t.col], line[t.col+n:]...)
+		}
+	case '@':
+		// Insert blanks, pushing the rest of the line right, but not past termMaxColumns
+		line := t.line()
+		n = MinI(n, termMaxColumns-len(line))
+		if t.col < len(line) && n > 0 {
+			blanks := make([]termCell, n)
+			for i := range blanks {
+				blanks[i] = t.blank()
+			}
+			t.lines[t.row] = append(line[:t.col], append(blanks, line[t.col:]...)...)
+		}
+	case 's':
+		t.savedRow, t.savedCol = t.row, t.col
+	case 'u':
+		t.row, t.col = t.savedRow, t.savedCol
+	}
+	t.clampCursor()
+}
+
+// Keep the cursor on the screen after it is moved, and stop it moving far past the text
+func (t *Terminal) clampCursor() {
+	if t.Height > 0 {
+		t.row = MinI(t.row, t.top()+t.Height-1)
+	}
+	t.row = MinI(t.row, MaxI(len(t.lines)-1, termMaxLines))
+	length := 0
+	if t.row < len(t.lines) {
+		length = len(t.lines[t.row])
+	}
+	t.col = MinI(t.col, MaxI(length, termMaxColumns))
+}
+
+// Set attributes from an SGR sequence, ESC [ params m
+func (t *Terminal) sgr(params string) {
+	groups := strings.Split(params, ";")
+	a := &t.attrs
+	for i := 0; i < len(groups); i++ {
+		sub := strings.Split(groups[i], ":")
+		n, _ := strconv.Atoi(sub[0])
+		switch {
+		case n == 0:
+			*a = sgrState{}
+		case n == 1:
+			a.bold = true
+		case n == 2:
+			a.faint = true
+		case n == 3:
+			a.italic = true
+		case n == 4:
+			a.underline = UnderlineStraight
+			if len(sub) > 1 {
+				switch sub[1] {
+				case "0":
+					a.underline = UnderlineNone
+				case "3":
+					a.underline = UnderlineWavy
+				}
+			}
+		case n == 7:
+			a.reverse = true
+		case n == 8:
+			a.conceal = true
+		case n == 9:
+			a.strike = true
+		case n == 21:
+			a.underline = UnderlineStraight
+		case n == 22:
+			a.bold, a.faint = false, false
+		case n == 23:
+			a.italic = false
+		case n == 24:
+			a.underline = UnderlineNone
+		case n == 27:
+			a.reverse = false
+		case n == 28:
+			a.conceal = false
+		case n == 29:
+			a.strike = false
+		case n >= 30 && n <= 37:
+			a.fg = t.colour256(n - 30)
+		case n >= 90 && n <= 97:
+			a.fg = t.colour256(n - 90 + 8)
+		case n >= 40 && n <= 47:
+			a.bg = t.colour256(n - 40)
+		case n >= 100 && n <= 107:
+			a.bg = t.colour256(n - 100 + 8)
+		case n == 39:
+			a.fg = nil
+		case n == 49:
+			a.bg = nil
+		case n == 59:
+			a.underlineColour = nil
+		case n == 38, n == 48, n == 58:
+			colour, used := t.extendedColour(sub[1:], groups[i+1:])
+			i += used
+			if colour == nil {
+				break
+			}
+			switch n {
+			case 38:
+				a.fg = colour
+			case 48:
+				a.bg = colour
+			default:
+				a.underlineColour = colour
+			}
+		}
+	}
+	t.style = t.attrStyle()
+}
+
+// Read a 256 colour (5;n) or 24 bit colour (2;r;g;b) from either the colon separated parts of one parameter, or the parameters after it.  Returns the colour, and how many of the parameters after it were used
+func (t *Terminal) extendedColour(sub, rest []string) (*RGBA, int) {
+	parts, colon := sub, true
+	if len(sub) == 0 {
+		parts, colon = rest, false
+	}
+	if len(parts) == 0 {
+		return nil, 0
+	}
+	num := func(i int) uint8 {
+		if i >= len(parts) {
+			return 0
+		}
+		n, _ := strconv.Atoi(parts[i])
+		return uint8(MinI(MaxI(n, 0), 255))
+	}
+	var colour *RGBA
+	used := 0
+	switch parts[0] {
+	case "5":
+		colour = t.colour256(int(num(1)))
+		used = 2
+	case "2":
+		// The colon form can have a colour space id before the components, 2:id:r:g:b
+		first := 1
+		if colon && len(parts) >= 5 {
+			first = len(parts) - 3
+		}
+		colour = &RGBA{num(first), num(first + 1), num(first + 2), 255}
+		used = 4
+	default:
+		return nil, 0
+	}
+	if colon {
+		return colour, 0
+	}
+	return colour, MinI(used, len(rest))
+}
+
+// A colour from the 256 colour palette: the 16 palette colours, a 6x6x6 colour cube and 24 greys
+func (t *Terminal) colour256(n int) *RGBA {
+	switch {
+	case n < 16:
+		c := append(RGBA{}, t.Palette[n]...)
+		return &c
+	case n < 232:
+		n -= 16
+		level := func(v int) uint8 {
+			if v == 0 {
+				return 0
+			}
+			return uint8(55 + v*40)
+		}
+		return &RGBA{level(n / 36), level(n / 6 % 6), level(n % 6), 255}
+	default:
+		grey := uint8(8 + (n-232)*10)
+		return &RGBA{grey, grey, grey, 255}
+	}
+}
+
+// The style for text written with the current attributes
+func (t *Terminal) attrStyle() Style {
+	a := t.attrs
+	s := t.Style
+	fg, bg := s.ForegroundColour, s.BackgroundColour
+	if a.fg != nil {
+		fg = a.fg
+	}
+	if a.bg != nil {
+		bg = a.bg
+	}
+	if a.reverse {
+		if fg == nil {
+			fg = &RGBA{255, 255, 255, 255}
+		}
+		if bg == nil {
+			bg = &RGBA{0, 0, 0, 255}
+		}
+		fg, bg = bg, fg
+	}
+	if (a.faint || a.conceal) && fg != nil {
+		dim := append(RGBA{}, (*fg)...)
+		if len(dim) > 3 {
+			if a.conceal {
+				dim[3] = 0
+			} else {
+				dim[3] = uint8(int(dim[3]) * 2 / 3)
+			}
+		}
+		fg = &dim
+	}
+	s.ForegroundColour, s.BackgroundColour = fg, bg
+	s.Bold = s.Bold || a.bold
+	s.Italic = s.Italic || a.italic
+	if a.underline != UnderlineNone {
+		s.Underline = a.underline
+		s.UnderlineColour = a.underlineColour
+	}
+	s.Strikethrough = s.Strikethrough || a.strike
+	return s
+}
+
+// The screen, and everything that scrolled off it, as tokens for RenderTokenPara.  Blanks at the ends of lines are left out
+func (t *Terminal) Tokens() []Token {
+	out := []Token{}
+	for i, line := range t.lines {
+		if i > 0 {
+			out = append(out, Token{"\n", t.Style})
+		}
+		end := len(line)
+		for end > 0 && line[end-1].text == " " && line[end-1].style.BackgroundColour == t.Style.BackgroundColour {
+			end--
+		}
+		for _, c := range line[:end] {
+			if c.text != "" {
+				out = append(out, Token{c.text, c.style})
+			}
+		}
+	}
+	return out
+}
+
+// The screen, and everything that scrolled off it, as plain text
+func (t *Terminal) String() string {
+	var out strings.Builder
+	for _, tok := range t.Tokens() {
+		out.WriteString(tok.Text)
+	}
+	return out.String()
+}
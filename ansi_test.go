@@ -0,0 +1,171 @@
+package glim
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTerminalText(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		height int
+		want   string
+	}{
+		{"plain", "plain\ntext\n", 0, "plain\ntext\n"},
+		{"carriage return", "progress 10%\rprogress 50%\rprogress 100%\n", 0, "progress 100%\n"},
+		{"backspace", "abc\bX", 0, "abX"},
+		{"tab", "a\tb", 0, "a       b"},
+		{"colours print nothing", "\x1b[31mred\x1b[0m normal", 0, "red normal"},
+		{"strings print nothing", "\x1b]0;title\x07shown\x1b]8;;http://x\x1b\\link\x1b]8;;\x1b\\", 0, "shownlink"},
+		{"private modes print nothing", "\x1b[?25lhidden\x1b[?25h", 0, "hidden"},
+		{"unfinished sequence", "abc\x1b[", 0, "abc"},
+		{"CSI D and K", "hello world\x1b[5D\x1b[K", 0, "hello"},
+		{"CSI A and 2K", "line1\nline2\x1b[1A\x1b[2K\rnew1", 0, "new1\nline2"},
+		{"CSI G and P", "12345\x1b[3G\x1b[P", 0, "1245"},
+		{"CSI @", "abc\x1b[2G\x1b[2@", 0, "a  bc"},
+		{"CSI X", "abcdef\x1b[2G\x1b[3X", 0, "a   ef"},
+		{"CSI C past the end", "ab\x1b[3Cc", 0, "ab   c"},
+		{"CSI H", "abc\ndef\x1b[1;2HX", 0, "aXc\ndef"},
+		{"CSI 1K", "abcdef\x1b[3G\x1b[1K", 0, "   def"},
+		{"CSI J", "abc\ndef\nghi\x1b[2;2H\x1b[J", 0, "abc\nd"},
+		{"CSI 2J", "abc\x1b[2J\x1b[Hclear", 0, "clear"},
+		{"save and restore", "ab\x1b[sxyz\x1b[uQ", 0, "abQyz"},
+		{"ESC 7 and 8", "ab\x1b7xyz\x1b8Q", 0, "abQyz"},
+		{"wide characters", "日本\x1b[4Dx", 0, "x 本"},
+		{"combining marks", "éé", 0, "éé"},
+		{"scrolled off lines stay", "a\nb\nc", 2, "a\nb\nc"},
+		{"CSI H is relative to the screen", "a\nb\nc\x1b[HX", 2, "a\nX\nc"},
+		{"CSI A stops at the top of the screen", "a\nb\nc\x1b[5A\rX", 2, "a\nX\nc"},
+		{"CSI A with no height goes to the top", "a\nb\nc\x1b[5A\rX", 0, "X\nb\nc"},
+		{"ESC M stops at the top of the screen", "a\nb\nc\x1bM\x1bM\x1bM\rX", 2, "a\nX\nc"},
+		{"CSI 2J leaves the scrollback", "a\nb\nc\x1b[2J", 2, "a\n\n"},
+		{"CSI 3J clears the scrollback", "a\nb\nc\x1b[3J\x1b[HX", 2, "X\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whole := NewTerminal(Style{})
+			whole.Height = tt.height
+			whole.Write(tt.in)
+			if got := whole.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			// Sequences and characters split across writes come out the same
+			split := NewTerminal(Style{})
+			split.Height = tt.height
+			for i := 0; i < len(tt.in); i++ {
+				split.Write(tt.in[i : i+1])
+			}
+			if got := split.String(); got != tt.want {
+				t.Errorf("a byte at a time got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTerminalSGR(t *testing.T) {
+	grey := RGBA{200, 200, 200, 255}
+	base := Style{ForegroundColour: &grey}
+	red := RGBA{205, 0, 0, 255}
+	tests := []struct {
+		name string
+		in   string
+		want func(s *Style) // Changes to base
+	}{
+		{"no attributes", "x", func(s *Style) {}},
+		{"red", "\x1b[31mx", func(s *Style) { s.ForegroundColour = &red }},
+		{"bright red", "\x1b[91mx", func(s *Style) { s.ForegroundColour = &RGBA{255, 0, 0, 255} }},
+		{"background", "\x1b[44mx", func(s *Style) { s.BackgroundColour = &RGBA{0, 0, 238, 255} }},
+		{"bright background", "\x1b[107mx", func(s *Style) { s.BackgroundColour = &RGBA{255, 255, 255, 255} }},
+		{"default colour", "\x1b[31;39mx", func(s *Style) {}},
+		{"reset", "\x1b[1;3;31mx\x1b[0mx", func(s *Style) {}},
+		{"empty reset", "\x1b[1mx\x1b[mx", func(s *Style) {}},
+		{"256 colour cube", "\x1b[38;5;196mx", func(s *Style) { s.ForegroundColour = &RGBA{255, 0, 0, 255} }},
+		{"256 colour grey", "\x1b[48;5;232mx", func(s *Style) { s.BackgroundColour = &RGBA{8, 8, 8, 255} }},
+		{"256 colour palette", "\x1b[38;5;1mx", func(s *Style) { s.ForegroundColour = &red }},
+		{"24 bit", "\x1b[38;2;10;20;30mx", func(s *Style) { s.ForegroundColour = &RGBA{10, 20, 30, 255} }},
+		{"24 bit with colons", "\x1b[38:2:10:20:30mx", func(s *Style) { s.ForegroundColour = &RGBA{10, 20, 30, 255} }},
+		{"24 bit with a colour space", "\x1b[38:2::10:20:30mx", func(s *Style) { s.ForegroundColour = &RGBA{10, 20, 30, 255} }},
+		{"attributes after a colour", "\x1b[38;2;10;20;30;1mx", func(s *Style) {
+			s.ForegroundColour = &RGBA{10, 20, 30, 255}
+			s.Bold = true
+		}},
+		{"bold and italic", "\x1b[1;3mx", func(s *Style) { s.Bold, s.Italic = true, true }},
+		{"bold off", "\x1b[1;22mx", func(s *Style) {}},
+		{"underline", "\x1b[4mx", func(s *Style) { s.Underline = UnderlineStraight }},
+		{"wavy underline", "\x1b[4:3mx", func(s *Style) { s.Underline = UnderlineWavy }},
+		{"underline colour", "\x1b[4;58;2;1;2;3mx", func(s *Style) {
+			s.Underline = UnderlineStraight
+			s.UnderlineColour = &RGBA{1, 2, 3, 255}
+		}},
+		{"underline off", "\x1b[4;24mx", func(s *Style) {}},
+		{"strikethrough", "\x1b[9mx", func(s *Style) { s.Strikethrough = true }},
+		{"reverse", "\x1b[7mx", func(s *Style) {
+			s.ForegroundColour = &RGBA{0, 0, 0, 255}
+			s.BackgroundColour = &grey
+		}},
+		{"reverse with colours", "\x1b[31;44;7mx", func(s *Style) {
+			s.ForegroundColour = &RGBA{0, 0, 238, 255}
+			s.BackgroundColour = &red
+		}},
+		{"faint", "\x1b[2mx", func(s *Style) { s.ForegroundColour = &RGBA{200, 200, 200, 170} }},
+		{"conceal", "\x1b[8mx", func(s *Style) { s.ForegroundColour = &RGBA{200, 200, 200, 0} }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := base
+			tt.want(&want)
+			tokens := ParseANSI(tt.in, base)
+			got := tokens[len(tokens)-1].Style
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+// Erasing with a background colour leaves coloured blanks, which are kept at the end of the line
+func TestTerminalEraseBackground(t *testing.T) {
+	tokens := ParseANSI("abcde\x1b[3G\x1b[44m\x1b[K", Style{})
+	if len(tokens) != 5 {
+		t.Fatalf("got %v tokens, want 5", len(tokens))
+	}
+	for _, tok := range tokens[2:] {
+		if tok.Text != " " || tok.Style.BackgroundColour == nil || !reflect.DeepEqual(*tok.Style.BackgroundColour, RGBA{0, 0, 238, 255}) {
+			t.Errorf("blank %q has background %v", tok.Text, tok.Style.BackgroundColour)
+		}
+	}
+}
+
+// Cursor movement in untrusted output can't make the terminal store huge amounts of blank space
+func TestTerminalCursorLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		in     string
+		height int
+		max    int // The most characters the text can have
+		suffix string
+	}{
+		{"far right then far down, on a screen", "\x1b[20000000Cx\x1b[5000000;1Hy", 24, termMaxColumns + 30, "\ny"},
+		{"far right then far down", "\x1b[20000000Cx\x1b[5000000;1Hy", 0, termMaxColumns + termMaxLines + 10, "\ny"},
+		{"down stops at the bottom of the screen", "a\x1b[100Bb\x1b[100Ec", 3, 10, "a\n\ncb"},
+		{"moving right again and again", strings.Repeat("\x1b[9999C.", 1000), 0, termMaxColumns + 1000, "."},
+		{"inserting again and again", "a" + strings.Repeat("\x1b[1G\x1b[9999@", 1000), 0, termMaxColumns, "a"},
+		{"moving down again and again", strings.Repeat("\x1b[9999B\x1bD.", 1000), 0, termMaxLines + 3000, "."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			term := NewTerminal(Style{})
+			term.Height = tt.height
+			term.Write(tt.in)
+			got := term.String()
+			if len(got) > tt.max {
+				t.Errorf("%v characters, want at most %v", len(got), tt.max)
+			}
+			if !strings.HasSuffix(got, tt.suffix) {
+				t.Errorf("ends with %q, want %q", got[MaxI(0, len(got)-10):], tt.suffix)
+			}
+		})
+	}
+}
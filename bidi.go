@@ -0,0 +1,507 @@
+// Bidirectional text.  The Unicode Bidirectional Algorithm (UAX #9), for mixing left-to-right and right-to-left scripts in one paragraph
+package glim
+
+import (
+	"golang.org/x/text/unicode/bidi"
+)
+
+const maxBidiDepth = 125
+
+type bidiStackEntry struct {
+	level    int
+	override bidi.Class // L or R for an override, ON for none
+	isolate  bool
+}
+
+// Resolve the embedding level of each character in a paragraph, following UAX #9 (rules P2 to I2, and the L1 resets for separators and trailing whitespace).
+//
+// Even levels are left-to-right, odd levels are right-to-left.  baseLevel is 0 for a left-to-right paragraph, 1 for right-to-left, or -1 to choose from the first strong character.  The chosen base level is returned along with the levels
+func BidiLevels(text []rune, baseLevel int) ([]int, int) {
+	n := len(text)
+	classes := make([]bidi.Class, n)
+	for i, r := range text {
+		p, _ := bidi.LookupRune(r)
+		classes[i] = p.Class()
+	}
+	orig := append([]bidi.Class{}, classes...)
+	matchingPDI, matchingInitiator := matchIsolates(classes)
+	if baseLevel < 0 {
+		baseLevel = firstStrongLevel(classes, matchingPDI, 0, n, 0)
+	}
+	levels := make([]int, n)
+
+	// X1 to X8, explicit embeddings, overrides and isolates
+	stack := []bidiStackEntry{{baseLevel, bidi.ON, false}}
+	overflowIsolates, overflowEmbeddings, validIsolates := 0, 0, 0
+	for i := 0; i < n; i++ {
+		top := stack[len(stack)-1]
+		switch c := classes[i]; c {
+		case bidi.RLE, bidi.LRE, bidi.RLO, bidi.LRO:
+			levels[i] = top.level
+			next := nextLevel(top.level, c == bidi.RLE || c == bidi.RLO)
+			if next <= maxBidiDepth && overflowIsolates == 0 && overflowEmbeddings == 0 {
+				override := bidi.ON
+				if c == bidi.RLO {
+					override = bidi.R
+				} else if c == bidi.LRO {
+					override = bidi.L
+				}
+				stack = append(stack, bidiStackEntry{next, override, false})
+			} else if overflowIsolates == 0 {
+				overflowEmbeddings++
+			}
+		case bidi.RLI, bidi.LRI, bidi.FSI:
+			levels[i] = top.level
+			if top.override != bidi.ON {
+				classes[i] = top.override
+			}
+			rtl := c == bidi.RLI
+			if c == bidi.FSI {
+				end := matchingPDI[i]
+				if end < 0 {
+					end = n
+				}
+				rtl = firstStrongLevel(classes, matchingPDI, i+1, end, 0) == 1
+			}
+			next := nextLevel(top.level, rtl)
+			if next <= maxBidiDepth && overflowIsolates == 0 && overflowEmbeddings == 0 {
+				validIsolates++
+				stack = append(stack, bidiStackEntry{next, bidi.ON, true})
+			} else {
+				overflowIsolates++
+			}
+		case bidi.PDI:
+			if overflowIsolates > 0 {
+				overflowIsolates--
+			} else if validIsolates > 0 {
+				overflowEmbeddings = 0
+				for !stack[len(stack)-1].isolate {
+					stack = stack[:len(stack)-1]
+				}
+				stack = stack[:len(stack)-1]
+				validIsolates--
+			}
+			top = stack[len(stack)-1]
+			levels[i] = top.level
+			if top.override != bidi.ON {
+				classes[i] = top.override
+			}
+		case bidi.PDF:
+			levels[i] = top.level
+			if overflowIsolates == 0 {
+				if overflowEmbeddings > 0 {
+					overflowEmbeddings--
+				} else if !top.isolate && len(stack) >= 2 {
+					stack = stack[:len(stack)-1]
+				}
+			}
+		case bidi.B:
+			levels[i] = baseLevel
+		case bidi.BN:
+			levels[i] = top.level
+		default:
+			levels[i] = top.level
+			if top.override != bidi.ON {
+				classes[i] = top.override
+			}
+		}
+	}
+
+	// X9, X10.  Removed characters are skipped when building the isolating run sequences
+	removed := func(i int) bool {
+		switch orig[i] {
+		case bidi.RLE, bidi.LRE, bidi.RLO, bidi.LRO, bidi.PDF, bidi.BN:
+			return true
+		}
+		return false
+	}
+	for _, seq := range isolatingRunSequences(levels, removed, orig, matchingPDI, matchingInitiator) {
+		level := levels[seq[0]]
+		sos := bidiDirection(MaxI(level, levelBefore(levels, removed, seq[0], baseLevel)))
+		eosLevel := baseLevel
+		last := seq[len(seq)-1]
+		if !(isIsolateInitiator(orig[last]) && matchingPDI[last] >= 0) {
+			eosLevel = levelAfter(levels, removed, last, baseLevel)
+		}
+		eos := bidiDirection(MaxI(level, eosLevel))
+		resolveWeak(classes, seq, sos, eos)
+		resolveBrackets(text, classes, orig, seq, sos, level)
+		resolveNeutral(classes, seq, sos, eos, level)
+		for _, i := range seq {
+			switch classes[i] {
+			case bidi.L:
+				if level%2 == 1 {
+					levels[i]++
+				}
+			case bidi.R:
+				if level%2 == 0 {
+					levels[i]++
+				}
+			case bidi.AN, bidi.EN:
+				if level%2 == 0 {
+					levels[i] += 2
+				} else {
+					levels[i]++
+				}
+			}
+		}
+	}
+	for i := 0; i < n; i++ {
+		if removed(i) {
+			if i > 0 {
+				levels[i] = levels[i-1]
+			} else {
+				levels[i] = baseLevel
+			}
+		}
+	}
+
+	// L1, separators and the whitespace before them go back to the paragraph level
+	trailing := true
+	for i := n - 1; i >= 0; i-- {
+		switch orig[i] {
+		case bidi.S, bidi.B:
+			levels[i] = baseLevel
+			trailing = true
+		case bidi.WS, bidi.FSI, bidi.LRI, bidi.RLI, bidi.PDI, bidi.BN, bidi.RLE, bidi.LRE, bidi.RLO, bidi.LRO, bidi.PDF:
+			if trailing {
+				levels[i] = baseLevel
+			}
+		default:
+			trailing = false
+		}
+	}
+	return levels, baseLevel
+}
+
+// Return the display order for a line, given the levels of its characters in logical order (rule L2).  out[k] is the logical index of the k-th character from the left
+func BidiVisualOrder(levels []int) []int {
+	out := make([]int, len(levels))
+	highest, lowestOdd := 0, maxBidiDepth+2
+	for i := range levels {
+		out[i] = i
+		highest = MaxI(highest, levels[i])
+		if levels[i]%2 == 1 && levels[i] < lowestOdd {
+			lowestOdd = levels[i]
+		}
+	}
+	for level := highest; level >= lowestOdd; level-- {
+		for i := 0; i < len(out); i++ {
+			if levels[out[i]] < level {
+				continue
+			}
+			j := i
+			for j < len(out) && levels[out[j]] >= level {
+				j++
+			}
+			for a, b := i, j-1; a < b; a, b = a+1, b-1 {
+				out[a], out[b] = out[b], out[a]
+			}
+			i = j
+		}
+	}
+	return out
+}
+
+// The smallest level above current with the requested direction
+func nextLevel(current int, rtl bool) int {
+	if rtl {
+		return (current + 1) | 1
+	}
+	return (current + 2) &^ 1
+}
+
+func bidiDirection(level int) bidi.Class {
+	if level%2 == 1 {
+		return bidi.R
+	}
+	return bidi.L
+}
+
+func isIsolateInitiator(c bidi.Class) bool {
+	return c == bidi.LRI || c == bidi.RLI || c == bidi.FSI
+}
+
+// P2, P3.  The level implied by the first strong character from start to end, skipping isolates
+func firstStrongLevel(classes []bidi.Class, matchingPDI []int, start, end, def int) int {
+	for i := start; i < end; i++ {
+		switch classes[i] {
+		case bidi.L:
+			return 0
+		case bidi.R, bidi.AL:
+			return 1
+		case bidi.LRI, bidi.RLI, bidi.FSI:
+			if matchingPDI[i] < 0 {
+				return def
+			}
+			i = matchingPDI[i]
+		}
+	}
+	return def
+}
+
+// BD9.  Pair each isolate initiator with its PDI.  Unmatched entries are -1
+func matchIsolates(classes []bidi.Class) ([]int, []int) {
+	matchingPDI := make([]int, len(classes))
+	matchingInitiator := make([]int, len(classes))
+	open := []int{}
+	for i, c := range classes {
+		matchingPDI[i] = -1
+		matchingInitiator[i] = -1
+		if isIsolateInitiator(c) {
+			open = append(open, i)
+		} else if c == bidi.PDI && len(open) > 0 {
+			start := open[len(open)-1]
+			open = open[:len(open)-1]
+			matchingPDI[start] = i
+			matchingInitiator[i] = start
+		} else if c == bidi.B {
+			open = open[:0]
+		}
+	}
+	return matchingPDI, matchingInitiator
+}
+
+// BD13.  Split the text into level runs, then chain runs that are joined across an isolate
+func isolatingRunSequences(levels []int, removed func(int) bool, orig []bidi.Class, matchingPDI, matchingInitiator []int) [][]int {
+	runs := [][]int{}
+	runOf := make([]int, len(levels))
+	for i := range levels {
+		if removed(i) {
+			continue
+		}
+		if len(runs) == 0 || levels[runs[len(runs)-1][0]] != levels[i] {
+			runs = append(runs, []int{})
+		}
+		runs[len(runs)-1] = append(runs[len(runs)-1], i)
+		runOf[i] = len(runs) - 1
+	}
+	out := [][]int{}
+	for _, run := range runs {
+		if first := run[0]; orig[first] == bidi.PDI && matchingInitiator[first] >= 0 {
+			continue // Already added to the sequence of its initiator
+		}
+		seq := append([]int{}, run...)
+		for {
+			last := seq[len(seq)-1]
+			if !isIsolateInitiator(orig[last]) || matchingPDI[last] < 0 {
+				break
+			}
+			seq = append(seq, runs[runOf[matchingPDI[last]]]...)
+		}
+		out = append(out, seq)
+	}
+	return out
+}
+
+func levelBefore(levels []int, removed func(int) bool, i, baseLevel int) int {
+	for i--; i >= 0; i-- {
+		if !removed(i) {
+			return levels[i]
+		}
+	}
+	return baseLevel
+}
+
+func levelAfter(levels []int, removed func(int) bool, i, baseLevel int) int {
+	for i++; i < len(levels); i++ {
+		if !removed(i) {
+			return levels[i]
+		}
+	}
+	return baseLevel
+}
+
+// W1 to W7
+func resolveWeak(classes []bidi.Class, seq []int, sos, eos bidi.Class) {
+	prev := sos
+	for _, i := range seq {
+		switch classes[i] {
+		case bidi.NSM:
+			if prev == bidi.LRI || prev == bidi.RLI || prev == bidi.FSI || prev == bidi.PDI {
+				classes[i] = bidi.ON
+			} else {
+				classes[i] = prev
+			}
+		}
+		prev = classes[i]
+	}
+	lastStrong := sos
+	for _, i := range seq {
+		switch classes[i] {
+		case bidi.L, bidi.R, bidi.AL:
+			lastStrong = classes[i]
+		case bidi.EN:
+			if lastStrong == bidi.AL {
+				classes[i] = bidi.AN
+			}
+		}
+	}
+	for _, i := range seq {
+		if classes[i] == bidi.AL {
+			classes[i] = bidi.R
+		}
+	}
+	for k := 1; k+1 < len(seq); k++ {
+		before, c, after := classes[seq[k-1]], classes[seq[k]], classes[seq[k+1]]
+		if c == bidi.ES && before == bidi.EN && after == bidi.EN {
+			classes[seq[k]] = bidi.EN
+		} else if c == bidi.CS && before == after && (before == bidi.EN || before == bidi.AN) {
+			classes[seq[k]] = before
+		}
+	}
+	for k := 0; k < len(seq); k++ {
+		if classes[seq[k]] != bidi.ET {
+			continue
+		}
+		end := k
+		for end < len(seq) && classes[seq[end]] == bidi.ET {
+			end++
+		}
+		if (k > 0 && classes[seq[k-1]] == bidi.EN) || (end < len(seq) && classes[seq[end]] == bidi.EN) {
+			for j := k; j < end; j++ {
+				classes[seq[j]] = bidi.EN
+			}
+		}
+		k = end - 1
+	}
+	for _, i := range seq {
+		switch classes[i] {
+		case bidi.ES, bidi.ET, bidi.CS:
+			classes[i] = bidi.ON
+		}
+	}
+	lastStrong = sos
+	for _, i := range seq {
+		switch classes[i] {
+		case bidi.L, bidi.R:
+			lastStrong = classes[i]
+		case bidi.EN:
+			if lastStrong == bidi.L {
+				classes[i] = bidi.L
+			}
+		}
+	}
+}
+
+// Strong direction for the neutral rules, where numbers count as right-to-left
+func strongForNeutral(c bidi.Class) bidi.Class {
+	switch c {
+	case bidi.L:
+		return bidi.L
+	case bidi.R, bidi.AN, bidi.EN:
+		return bidi.R
+	}
+	return bidi.ON
+}
+
+// N0, paired brackets take the direction of the text inside them, or of the text before them
+func resolveBrackets(text []rune, classes, orig []bidi.Class, seq []int, sos bidi.Class, level int) {
+	type pair struct{ open, close int } // Positions in seq
+	pairs := []pair{}
+	type opener struct {
+		pos   int
+		match rune
+	}
+	stack := []opener{}
+	for k, i := range seq {
+		if classes[i] != bidi.ON {
+			continue
+		}
+		p, _ := bidi.LookupRune(text[i])
+		if !p.IsBracket() {
+			continue
+		}
+		if p.IsOpeningBracket() {
+			if len(stack) == 63 {
+				break
+			}
+			stack = append(stack, opener{k, []rune(bidi.ReverseString(string(text[i])))[0]})
+			continue
+		}
+		for s := len(stack) - 1; s >= 0; s-- {
+			if stack[s].match == text[i] {
+				pairs = append(pairs, pair{stack[s].pos, k})
+				stack = stack[:s]
+				break
+			}
+		}
+	}
+	// Resolve in order of the opening brackets
+	for a := 1; a < len(pairs); a++ {
+		for b := a; b > 0 && pairs[b].open < pairs[b-1].open; b-- {
+			pairs[b], pairs[b-1] = pairs[b-1], pairs[b]
+		}
+	}
+	embedding := bidiDirection(level)
+	for _, pr := range pairs {
+		found := bidi.ON
+		for k := pr.open + 1; k < pr.close; k++ {
+			dir := strongForNeutral(classes[seq[k]])
+			if dir == embedding {
+				found = embedding
+				break
+			}
+			if dir != bidi.ON {
+				found = dir
+			}
+		}
+		if found == bidi.ON {
+			continue
+		}
+		if found != embedding {
+			context := sos
+			for k := pr.open - 1; k >= 0; k-- {
+				if dir := strongForNeutral(classes[seq[k]]); dir != bidi.ON {
+					context = dir
+					break
+				}
+			}
+			if context != found {
+				found = embedding
+			}
+		}
+		for _, k := range []int{pr.open, pr.close} {
+			classes[seq[k]] = found
+			for j := k + 1; j < len(seq) && orig[seq[j]] == bidi.NSM; j++ {
+				classes[seq[j]] = found
+			}
+		}
+	}
+}
+
+// N1, N2
+func resolveNeutral(classes []bidi.Class, seq []int, sos, eos bidi.Class, level int) {
+	isNeutral := func(c bidi.Class) bool {
+		switch c {
+		case bidi.B, bidi.S, bidi.WS, bidi.ON, bidi.LRI, bidi.RLI, bidi.FSI, bidi.PDI:
+			return true
+		}
+		return false
+	}
+	for k := 0; k < len(seq); k++ {
+		if !isNeutral(classes[seq[k]]) {
+			continue
+		}
+		end := k
+		for end < len(seq) && isNeutral(classes[seq[end]]) {
+			end++
+		}
+		before := sos
+		if k > 0 {
+			before = strongForNeutral(classes[seq[k-1]])
+		}
+		after := eos
+		if end < len(seq) {
+			after = strongForNeutral(classes[seq[end]])
+		}
+		dir := bidiDirection(level)
+		if before == after && before != bidi.ON {
+			dir = before
+		}
+		for j := k; j < end; j++ {
+			classes[seq[j]] = dir
+		}
+		k = end - 1
+	}
+}
@@ -0,0 +1,64 @@
+package glim
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Samples in the style of the UAX #9 BidiCharacterTest.txt: text, paragraph direction, resolved paragraph level and the level of each character
+func TestBidiLevels(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		base      int
+		wantBase  int
+		wantLevel []int
+	}{
+		{"plain left to right", "abc", -1, 0, []int{0, 0, 0}},
+		{"plain right to left", "אבג", -1, 1, []int{1, 1, 1}},
+		{"P2 picks the first strong character", "123 אבג", -1, 1, []int{2, 2, 2, 1, 1, 1, 1}},
+		{"Hebrew in English", "abc אבג", -1, 0, []int{0, 0, 0, 0, 1, 1, 1}},
+		{"I2 raises numbers in right to left text", "אבג 123", -1, 1, []int{1, 1, 1, 1, 2, 2, 2}},
+		{"W7 makes numbers after Latin left to right", "a 1", 1, 1, []int{2, 2, 2}},
+		{"N1 neutrals between Latin and Hebrew take the paragraph direction", "a אב", 1, 1, []int{2, 1, 1, 1}},
+		{"W4 and W5 join separators and terminators to numbers", "אבג 12.5%", -1, 1, []int{1, 1, 1, 1, 2, 2, 2, 2, 2}},
+		{"N0 brackets follow the context before them", "אבג (abc) דהו", 1, 1, []int{1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1}},
+		{"N0 brackets around Hebrew stay left to right after Latin", "abc (אבג) def", 0, 0, []int{0, 0, 0, 0, 0, 1, 1, 1, 0, 0, 0, 0, 0}},
+		{"isolates keep their own level", "a\u2067b\u2069c", 0, 0, []int{0, 0, 2, 0, 0}},
+		{"L1 resets trailing whitespace", "אבג abc  ", -1, 1, []int{1, 1, 1, 1, 2, 2, 2, 1, 1}},
+		{"L1 resets segment separators", "abc\tאבג", 1, 1, []int{2, 2, 2, 1, 1, 1, 1}},
+		{"empty", "", -1, 0, []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			levels, base := BidiLevels([]rune(tt.text), tt.base)
+			if base != tt.wantBase {
+				t.Errorf("base level %v, want %v", base, tt.wantBase)
+			}
+			if len(levels) == 0 && len(tt.wantLevel) == 0 {
+				return
+			}
+			if !reflect.DeepEqual(levels, tt.wantLevel) {
+				t.Errorf("levels %v, want %v", levels, tt.wantLevel)
+			}
+		})
+	}
+}
+
+func TestBidiVisualOrder(t *testing.T) {
+	tests := []struct {
+		levels []int
+		want   []int
+	}{
+		{[]int{0, 0, 0}, []int{0, 1, 2}},
+		{[]int{1, 1, 1}, []int{2, 1, 0}},
+		{[]int{0, 0, 1, 1, 0}, []int{0, 1, 3, 2, 4}},
+		{[]int{1, 1, 2, 2, 1}, []int{4, 2, 3, 1, 0}},
+		{[]int{0, 1, 2, 1, 0}, []int{0, 3, 2, 1, 4}},
+	}
+	for _, tt := range tests {
+		if got := BidiVisualOrder(tt.levels); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("BidiVisualOrder(%v) = %v, want %v", tt.levels, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,496 @@
+// Bitmap fonts.  BDF and PCF fonts, drawn at their own pixel size with no anti-aliasing
+package glim
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// A font made of fixed pixel glyphs, from a BDF or PCF file.  Character codes are taken to be Unicode, so the font should be ISO10646 (or ISO8859-1, which matches Unicode's first 256 characters).
+//
+// The glyphs are always drawn at the size they were drawn in the font, whatever size is asked for, so pick a font size that roughly matches, to leave room for the glyphs in the texture
+type BitmapFont struct {
+	Name            string
+	Ascent, Descent int // Pixels above and below the baseline
+	glyphs          []bitmapGlyph
+	codes           map[rune]int // Index into glyphs
+	missing         int          // The glyph drawn for characters the font doesn't have, or -1
+}
+
+type bitmapGlyph struct {
+	mask    *image.Alpha // 0 or 255
+	x, y    int          // The top left of mask, from the pen position on the baseline, with y going down
+	advance int
+}
+
+func newBitmapFont() *BitmapFont {
+	return &BitmapFont{codes: map[rune]int{}, missing: -1}
+}
+
+// The glyph index for a character, or 0 if the font doesn't have it, like truetype.Font.Index.  Indexes start at 1
+func (f *BitmapFont) Index(r rune) truetype.Index {
+	if i, ok := f.codes[r]; ok {
+		return truetype.Index(i + 1)
+	}
+	return 0
+}
+
+func (f *BitmapFont) glyph(r rune) (bitmapGlyph, bool) {
+	if i, ok := f.codes[r]; ok {
+		return f.glyphs[i], true
+	}
+	if f.missing >= 0 {
+		return f.glyphs[f.missing], true
+	}
+	return bitmapGlyph{}, false
+}
+
+// Is data a bitmap font?  PCF files start with "\1fcp", and BDF files with STARTFONT
+func isBitmapFont(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("\x01fcp")) || bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte("STARTFONT"))
+}
+
+// Parse a BDF or PCF font
+func ParseBitmapFont(data []byte) (*BitmapFont, error) {
+	if bytes.HasPrefix(data, []byte("\x01fcp")) {
+		return ParsePCF(data)
+	}
+	return ParseBDF(data)
+}
+
+// Parse a BDF (Glyph Bitmap Distribution Format) font
+func ParseBDF(data []byte) (*BitmapFont, error) {
+	f := newBitmapFont()
+	defaultChar := -1
+	fontAdvance := 0
+	var g *bitmapGlyph
+	code := -1
+	width, height := 0, 0
+	inBitmap := false
+	row := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		nums := func(n int) ([]int, error) {
+			if len(fields) < n+1 {
+				return nil, fmt.Errorf("bad BDF line %v: %v needs %v numbers", line, fields[0], n)
+			}
+			out := make([]int, n)
+			for i := range out {
+				v, err := strconv.Atoi(fields[i+1])
+				if err != nil {
+					return nil, fmt.Errorf("bad BDF line %v: %w", line, err)
+				}
+				out[i] = v
+			}
+			return out, nil
+		}
+		if inBitmap {
+			if fields[0] == "ENDCHAR" {
+				inBitmap = false
+				if code >= 0 {
+					f.codes[rune(code)] = len(f.glyphs)
+					if code == defaultChar {
+						f.missing = len(f.glyphs)
+					}
+					f.glyphs = append(f.glyphs, *g)
+				}
+				continue
+			}
+			if row >= height {
+				continue
+			}
+			if need := (width + 7) / 8 * 2; len(fields[0]) < need {
+				return nil, fmt.Errorf("bad BDF line %v: a row %v pixels wide needs %v hex digits, not %v", line, width, need, len(fields[0]))
+			}
+			bits, err := strconv.ParseUint(fields[0], 16, 64)
+			if err != nil && len(fields[0]) <= 16 {
+				return nil, fmt.Errorf("bad BDF line %v: %w", line, err)
+			}
+			// Rows are padded to whole bytes, and long rows are read a byte at a time
+			for x := 0; x < width; x++ {
+				var on bool
+				if len(fields[0]) <= 16 {
+					on = bits&(1<<uint(len(fields[0])*4-1-x)) != 0
+				} else {
+					b, err := strconv.ParseUint(fields[0][x/8*2:x/8*2+2], 16, 8)
+					if err != nil {
+						return nil, fmt.Errorf("bad BDF line %v: %w", line, err)
+					}
+					on = b&(0x80>>uint(x%8)) != 0
+				}
+				if on {
+					g.mask.Pix[row*g.mask.Stride+x] = 255
+				}
+			}
+			row++
+			continue
+		}
+		switch fields[0] {
+		case "FONT":
+			f.Name = strings.TrimSpace(strings.TrimPrefix(scanner.Text(), "FONT"))
+		case "FONT_ASCENT", "FONT_DESCENT", "DEFAULT_CHAR":
+			v, err := nums(1)
+			if err != nil {
+				return nil, err
+			}
+			switch fields[0] {
+			case "FONT_ASCENT":
+				f.Ascent = v[0]
+			case "FONT_DESCENT":
+				f.Descent = v[0]
+			default:
+				defaultChar = v[0]
+			}
+		case "STARTCHAR":
+			g = &bitmapGlyph{advance: fontAdvance, mask: image.NewAlpha(image.Rectangle{})}
+			code = -1
+			width, height = 0, 0
+		case "ENCODING":
+			v, err := nums(1)
+			if err != nil {
+				return nil, err
+			}
+			code = v[0]
+		case "DWIDTH":
+			v, err := nums(1)
+			if err != nil {
+				return nil, err
+			}
+			if g == nil {
+				fontAdvance = v[0]
+			} else {
+				g.advance = v[0]
+			}
+		case "BBX":
+			v, err := nums(4)
+			if err != nil {
+				return nil, err
+			}
+			// Every row of the bitmap is a line of at least a hex digit for every 4 pixels, so a box bigger than that can't be filled
+			if v[0] < 0 || v[1] < 0 || v[1] > len(data) || v[0] > 4*len(data) || v[0]*v[1] > 4*len(data) {
+				return nil, fmt.Errorf("bad BDF line %v: a %vx%v glyph is too big for the font", line, v[0], v[1])
+			}
+			if g != nil {
+				width, height = v[0], v[1]
+				g.mask = image.NewAlpha(image.Rect(0, 0, width, height))
+				g.x, g.y = v[2], -(v[3] + height)
+			}
+		case "BITMAP":
+			if g == nil {
+				return nil, fmt.Errorf("bad BDF line %v: BITMAP outside a character", line)
+			}
+			inBitmap, row = true, 0
+		case "ENDFONT":
+			if len(f.glyphs) == 0 {
+				return nil, fmt.Errorf("BDF font has no characters")
+			}
+			return f, nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("BDF font has no ENDFONT")
+}
+
+// PCF table types and format bits, from the X server's pcf.h
+const (
+	pcfProperties      = 1 << 0
+	pcfAccelerators    = 1 << 1
+	pcfMetrics         = 1 << 2
+	pcfBitmaps         = 1 << 3
+	pcfBDFEncodings    = 1 << 5
+	pcfBDFAccelerators = 1 << 8
+
+	pcfCompressedMetrics = 0x100
+	pcfByteMSB           = 1 << 2
+	pcfBitMSB            = 1 << 3
+)
+
+type pcfReader struct {
+	data  []byte
+	pos   int
+	order binary.ByteOrder
+	err   error
+}
+
+func (r *pcfReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || r.pos < 0 || r.pos+n > len(r.data) {
+		if r.err == nil {
+			r.err = fmt.Errorf("PCF font is cut short")
+		}
+		return make([]byte, MaxI(n, 0))
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+func (r *pcfReader) u8() int {
+	return int(r.bytes(1)[0])
+}
+
+func (r *pcfReader) i16() int {
+	return int(int16(r.order.Uint16(r.bytes(2))))
+}
+
+func (r *pcfReader) u16() int {
+	return int(r.order.Uint16(r.bytes(2)))
+}
+
+func (r *pcfReader) i32() int {
+	return int(int32(r.order.Uint32(r.bytes(4))))
+}
+
+// Check a count of things size bytes long that come next.  Returns 0, and sets the error, if there isn't room for them
+func (r *pcfReader) count(n, size int) int {
+	if r.err == nil && (n < 0 || n > (len(r.data)-r.pos)/size) {
+		r.err = fmt.Errorf("PCF font has %v entries, more than it has room for", n)
+	}
+	if r.err != nil {
+		return 0
+	}
+	return n
+}
+
+// Start reading a table.  Its format is always little endian, and says how the rest is stored
+func (r *pcfReader) table(offset int) int {
+	if r.err == nil && (offset < 0 || offset > len(r.data)) {
+		r.err = fmt.Errorf("PCF table at %v is outside the font", offset)
+	}
+	r.pos = offset
+	r.order = binary.LittleEndian
+	format := r.i32()
+	if format&pcfByteMSB != 0 {
+		r.order = binary.BigEndian
+	}
+	return format
+}
+
+type pcfMetric struct {
+	left, right, width, ascent, descent int
+}
+
+// Parse a PCF (Portable Compiled Format) font, as used by the X server.  gzipped files (.pcf.gz) must be uncompressed first
+func ParsePCF(data []byte) (*BitmapFont, error) {
+	if !bytes.HasPrefix(data, []byte("\x01fcp")) {
+		return nil, fmt.Errorf("not a PCF font")
+	}
+	r := &pcfReader{data: data, pos: 4, order: binary.LittleEndian}
+	tables := map[int]int{} // Type -> offset
+	for n := r.i32(); n > 0 && r.err == nil; n-- {
+		kind := r.i32()
+		r.i32() // format, repeated at the start of the table
+		r.i32() // size
+		tables[kind] = r.i32()
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	for _, need := range []int{pcfMetrics, pcfBitmaps, pcfBDFEncodings} {
+		if _, ok := tables[need]; !ok {
+			return nil, fmt.Errorf("PCF font has no table %v", need)
+		}
+	}
+	f := newBitmapFont()
+
+	// Metrics
+	format := r.table(tables[pcfMetrics])
+	var metrics []pcfMetric
+	if format&0xffffff00 == pcfCompressedMetrics {
+		metrics = make([]pcfMetric, r.count(r.i16(), 5))
+		for i := range metrics {
+			metrics[i] = pcfMetric{r.u8() - 0x80, r.u8() - 0x80, r.u8() - 0x80, r.u8() - 0x80, r.u8() - 0x80}
+		}
+	} else {
+		metrics = make([]pcfMetric, r.count(r.i32(), 12))
+		for i := range metrics {
+			metrics[i] = pcfMetric{r.i16(), r.i16(), r.i16(), r.i16(), r.i16()}
+			r.u16() // attributes
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// Bitmaps
+	format = r.table(tables[pcfBitmaps])
+	count := r.count(r.i32(), 4)
+	if r.err != nil {
+		return nil, r.err
+	}
+	if count != len(metrics) {
+		return nil, fmt.Errorf("PCF font has %v bitmaps for %v glyphs", count, len(metrics))
+	}
+	offsets := make([]int, count)
+	for i := range offsets {
+		offsets[i] = r.i32()
+	}
+	var sizes [4]int
+	for i := range sizes {
+		sizes[i] = r.i32()
+	}
+	bitmaps := r.bytes(sizes[format&3])
+	if r.err != nil {
+		return nil, r.err
+	}
+	pad := 1 << uint(format&3)
+	unit := 1 << uint((format>>4)&3)
+	for i, m := range metrics {
+		w, h := m.right-m.left, m.ascent+m.descent
+		stride := (MaxI(w, 0) + 8*pad - 1) / (8 * pad) * pad
+		if w > 0 && h > 0 && (offsets[i] < 0 || offsets[i] > len(bitmaps) || h > (len(bitmaps)-offsets[i])/stride+1) {
+			return nil, fmt.Errorf("PCF glyph %v runs past the bitmaps", i)
+		}
+		g := bitmapGlyph{mask: image.NewAlpha(image.Rect(0, 0, MaxI(w, 0), MaxI(h, 0))), x: m.left, y: -m.ascent, advance: m.width}
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				at := offsets[i] + y*stride + x/8
+				if (format&pcfByteMSB != 0) != (format&pcfBitMSB != 0) {
+					// The bytes of each scan unit are stored the other way round
+					at = at - at%unit + unit - 1 - at%unit
+				}
+				if at < 0 || at >= len(bitmaps) {
+					return nil, fmt.Errorf("PCF glyph %v runs past the bitmaps", i)
+				}
+				bit := byte(0x80 >> uint(x%8))
+				if format&pcfBitMSB == 0 {
+					bit = 1 << uint(x%8)
+				}
+				if bitmaps[at]&bit != 0 {
+					g.mask.Pix[y*g.mask.Stride+x] = 255
+				}
+			}
+		}
+		f.glyphs = append(f.glyphs, g)
+	}
+
+	// Encodings
+	r.table(tables[pcfBDFEncodings])
+	min2, max2, min1, max1, defaultChar := r.i16(), r.i16(), r.i16(), r.i16(), r.i16()
+	for b1 := min1; b1 <= max1 && r.err == nil; b1++ {
+		for b2 := min2; b2 <= max2; b2++ {
+			i := r.u16()
+			if i == 0xffff || i >= len(f.glyphs) {
+				continue
+			}
+			code := b1<<8 | b2
+			f.codes[rune(code)] = i
+			if code == defaultChar {
+				f.missing = i
+			}
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// The ascent and descent are in the accelerators, and there are properties with them and the font's name too
+	if offset, ok := tables[pcfBDFAccelerators]; ok {
+		tables[pcfAccelerators] = offset
+	}
+	if offset, ok := tables[pcfAccelerators]; ok {
+		r.table(offset)
+		r.bytes(8) // flags
+		f.Ascent, f.Descent = r.i32(), r.i32()
+	}
+	if offset, ok := tables[pcfProperties]; ok {
+		r.table(offset)
+		n := r.i32()
+		type prop struct{ name, value int }
+		props := []prop{}
+		for i := 0; i < n && r.err == nil; i++ {
+			name := r.i32()
+			isString := r.u8()
+			value := r.i32()
+			if isString != 0 {
+				props = append(props, prop{name, value})
+			}
+		}
+		if n&3 != 0 {
+			r.bytes(4 - n&3)
+		}
+		strs := r.bytes(r.i32())
+		str := func(at int) string {
+			if at < 0 || at >= len(strs) {
+				return ""
+			}
+			end := bytes.IndexByte(strs[at:], 0)
+			if end < 0 {
+				end = len(strs) - at
+			}
+			return string(strs[at : at+end])
+		}
+		for _, p := range props {
+			if str(p.name) == "FONT" {
+				f.Name = str(p.value)
+			}
+		}
+	}
+	if f.Ascent == 0 && f.Descent == 0 {
+		for _, m := range metrics {
+			f.Ascent, f.Descent = MaxI(f.Ascent, m.ascent), MaxI(f.Descent, m.descent)
+		}
+	}
+	return f, r.err
+}
+
+// A font.Face for a bitmap font.  It has no state, so it is safe to share
+type bitmapFace struct {
+	f *BitmapFont
+}
+
+func (b bitmapFace) Close() error {
+	return nil
+}
+
+func (b bitmapFace) Glyph(dot fixed.Point26_6, r rune) (image.Rectangle, image.Image, image.Point, fixed.Int26_6, bool) {
+	g, ok := b.f.glyph(r)
+	if !ok {
+		return image.Rectangle{}, nil, image.Point{}, 0, false
+	}
+	at := image.Pt(dot.X.Round()+g.x, dot.Y.Round()+g.y)
+	return g.mask.Bounds().Add(at), g.mask, image.Point{}, fixed.I(g.advance), true
+}
+
+func (b bitmapFace) GlyphBounds(r rune) (fixed.Rectangle26_6, fixed.Int26_6, bool) {
+	g, ok := b.f.glyph(r)
+	if !ok {
+		return fixed.Rectangle26_6{}, 0, false
+	}
+	size := g.mask.Bounds().Size()
+	return fixed.R(g.x, g.y, g.x+size.X, g.y+size.Y), fixed.I(g.advance), true
+}
+
+func (b bitmapFace) GlyphAdvance(r rune) (fixed.Int26_6, bool) {
+	g, ok := b.f.glyph(r)
+	return fixed.I(g.advance), ok
+}
+
+func (b bitmapFace) Kern(r0, r1 rune) fixed.Int26_6 {
+	return 0
+}
+
+func (b bitmapFace) Metrics() font.Metrics {
+	return font.Metrics{
+		Height:  fixed.I(b.f.Ascent + b.f.Descent),
+		Ascent:  fixed.I(b.f.Ascent),
+		Descent: fixed.I(b.f.Descent),
+	}
+}
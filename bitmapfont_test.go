@@ -0,0 +1,140 @@
+package glim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// A BDF font with one character, A, drawn from rows of hex
+func bdfFont(bbx string, rows ...string) []byte {
+	return []byte("STARTFONT 2.1\nFONT test\nFONT_ASCENT 2\nFONT_DESCENT 0\nSTARTCHAR A\nENCODING 65\nDWIDTH 3 0\nBBX " + bbx + "\nBITMAP\n" + strings.Join(rows, "\n") + "\nENDCHAR\nENDFONT\n")
+}
+
+func TestParseBDF(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want []uint8 // The glyph's mask, or nil for an error
+	}{
+		{"short rows", bdfFont("2 2 0 0", "80", "40"), []uint8{255, 0, 0, 255}},
+		{"long rows", bdfFont("72 1 0 0", "800000000000000001"), append(append([]uint8{255}, make([]uint8, 70)...), 255)},
+		{"row too short for the width", bdfFont("12 1 0 0", "FF"), nil},
+		{"long row too short for the width", bdfFont("72 1 0 0", "80000000000000000"), nil},
+		{"bad hex", bdfFont("8 1 0 0", "G0"), nil},
+		{"negative box", bdfFont("-2 2 0 0", "80", "40"), nil},
+		{"box too big for the file", bdfFont("100000 100000 0 0", "80"), nil},
+		{"no ENDFONT", []byte("STARTFONT 2.1\n"), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ParseBDF(tt.data)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			g, ok := f.glyph('A')
+			if !ok {
+				t.Fatal("no glyph for A")
+			}
+			if !bytes.Equal(g.mask.Pix, tt.want) {
+				t.Errorf("mask %v, want %v", g.mask.Pix, tt.want)
+			}
+		})
+	}
+}
+
+// A little endian PCF file holding tables, by type
+func pcfFile(tables map[int][]byte) []byte {
+	kinds := []int{}
+	for kind := range tables {
+		kinds = append(kinds, kind)
+	}
+	sort.Ints(kinds)
+	var out bytes.Buffer
+	out.WriteString("\x01fcp")
+	binary.Write(&out, binary.LittleEndian, int32(len(tables)))
+	offset := 8 + 16*len(tables)
+	for _, kind := range kinds {
+		binary.Write(&out, binary.LittleEndian, []int32{int32(kind), 0, int32(len(tables[kind])), int32(offset)})
+		offset += len(tables[kind])
+	}
+	for _, kind := range kinds {
+		out.Write(tables[kind])
+	}
+	return out.Bytes()
+}
+
+// Move the nth table in a file from pcfFile to offset
+func pcfMoveTable(data []byte, n, offset int) []byte {
+	out := append([]byte{}, data...)
+	binary.LittleEndian.PutUint32(out[8+16*n+12:], uint32(int32(offset)))
+	return out
+}
+
+func le(values ...interface{}) []byte {
+	var out bytes.Buffer
+	for _, v := range values {
+		binary.Write(&out, binary.LittleEndian, v)
+	}
+	return out.Bytes()
+}
+
+func TestParsePCF(t *testing.T) {
+	// A 2x2 glyph for A, drawn with one byte per row and the lowest bit first
+	metrics := le(int32(0), int32(1), []int16{0, 2, 3, 2, 0}, uint16(0))
+	bitmaps := le(int32(0), int32(1), int32(0), []int32{2, 0, 0, 0}, []uint8{0x01, 0x02})
+	encodings := le(int32(0), []int16{65, 65, 0, 0, 65}, uint16(0))
+	font := func(metrics, bitmaps []byte) []byte {
+		return pcfFile(map[int][]byte{pcfMetrics: metrics, pcfBitmaps: bitmaps, pcfBDFEncodings: encodings})
+	}
+	tests := []struct {
+		name string
+		data []byte
+		ok   bool
+	}{
+		{"good", font(metrics, bitmaps), true},
+		{"too many metrics", font(le(int32(0), int32(1<<30), []int16{0, 2, 3, 2, 0}, uint16(0)), bitmaps), false},
+		{"negative metrics", font(le(int32(0), int32(-1)), bitmaps), false},
+		{"negative compressed metrics", font(le(int32(pcfCompressedMetrics), int16(-5)), bitmaps), false},
+		{"too many bitmaps", font(metrics, le(int32(0), int32(1<<30))), false},
+		{"glyph bigger than the bitmaps", font(le(int32(0), int32(1), []int16{0, 30000, 3, 30000, 0}, uint16(0)), bitmaps), false},
+		{"glyph past the bitmaps", font(metrics, le(int32(0), int32(1), int32(5), []int32{2, 0, 0, 0}, []uint8{0x01, 0x02})), false},
+		{"cut short", font(metrics, bitmaps)[:60], false},
+		{"missing tables", pcfFile(map[int][]byte{pcfMetrics: metrics}), false},
+		{"table before the start", pcfMoveTable(font(metrics, bitmaps), 0, -4), false},
+		{"table past the end", pcfMoveTable(font(metrics, bitmaps), 2, 1<<20), false},
+		{"accelerators before the start", pcfMoveTable(pcfFile(map[int][]byte{pcfAccelerators: {}, pcfMetrics: metrics, pcfBitmaps: bitmaps, pcfBDFEncodings: encodings}), 0, -100), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ParsePCF(tt.data)
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			g, ok := f.glyph('A')
+			if !ok {
+				t.Fatal("no glyph for A")
+			}
+			if want := []uint8{255, 0, 0, 255}; !bytes.Equal(g.mask.Pix, want) {
+				t.Errorf("mask %v, want %v", g.mask.Pix, want)
+			}
+			if f.Ascent != 2 || g.advance != 3 {
+				t.Errorf("ascent %v and advance %v, want 2 and 3", f.Ascent, g.advance)
+			}
+		})
+	}
+}
@@ -0,0 +1,535 @@
+// Text buffer.  Editable text with undo, stored as ready-to-render tokens
+package glim
+
+import (
+	"strings"
+	"time"
+)
+
+// An editable piece of text, stored as one token per grapheme cluster in a gap buffer, so typing in one place stays cheap.
+//
+// Positions are cursor positions, the same as FormatParams.Cursor.  Every edit keeps Format's Cursor, SelectStart, SelectEnd and FirstDrawnCharPos pointing at the same text, and its LineIndex and IndexGeneration up to date
+type TextBuffer struct {
+	Format     *FormatParams
+	Style      Style         // The style given to inserted text.  A nil ForegroundColour draws in Format's Colour, so it follows theme changes
+	GroupDelay time.Duration // Typing or deleting one character at a time is undone in one go, unless there is a pause this long
+
+	buf      []Token
+	gapStart int // The gap is buf[gapStart:gapEnd]
+	gapEnd   int
+	tokens   []Token // Cached result of Tokens, nil after an edit
+	lines    *LineIndex
+	syntax   *Highlighter // Restyles the text as it is edited, if set
+
+	undo, redo []editGroup
+	groupDepth int // Open BeginGroup calls
+	lastKind   int // The kind of the last single character edit, for grouping
+	lastPos    int // Where the next edit has to be to join the last one
+	lastTime   time.Time
+}
+
+// One change: the tokens at start that were removed, and the ones put in their place
+type textEdit struct {
+	start    int
+	removed  []Token
+	inserted []Token
+}
+
+// Edits that are undone together
+type editGroup struct {
+	edits  []textEdit
+	before [3]int // Cursor, SelectStart and SelectEnd before the group
+	after  [3]int // and after it
+}
+
+const (
+	editOther = iota
+	editTyping
+	editDeleting
+)
+
+// Create a buffer holding text.  f gets its cursor and selection kept up to date, and can be nil
+func NewTextBuffer(f *FormatParams, text string) *TextBuffer {
+	b := &TextBuffer{Format: f, GroupDelay: time.Second}
+	b.buf = b.makeTokens(text)
+	b.gapStart = len(b.buf)
+	b.gapEnd = len(b.buf)
+	b.lines = NewLineIndex(b.buf)
+	b.shareLines()
+	return b
+}
+
+// Point Format at the line index, and say which version of the text it matches, so drawing b.Tokens() can use it
+func (b *TextBuffer) shareLines() {
+	if b.Format != nil {
+		b.Format.LineIndex = b.lines
+		b.Format.IndexGeneration = b.lines.Generation()
+	}
+}
+
+func (b *TextBuffer) makeTokens(text string) []Token {
+	out := []Token{}
+	for _, v := range Graphemes(text) {
+		out = append(out, Token{v, b.Style})
+	}
+	return out
+}
+
+// The number of tokens (grapheme clusters) in the buffer
+func (b *TextBuffer) Len() int {
+	return len(b.buf) - (b.gapEnd - b.gapStart)
+}
+
+func (b *TextBuffer) at(i int) Token {
+	if i < b.gapStart {
+		return b.buf[i]
+	}
+	return b.buf[i+b.gapEnd-b.gapStart]
+}
+
+// The text from start to end
+func (b *TextBuffer) Slice(start, end int) string {
+	start, end = b.clampRange(start, end)
+	var out strings.Builder
+	for i := start; i < end; i++ {
+		out.WriteString(b.at(i).Text)
+	}
+	return out.String()
+}
+
+// The whole text
+func (b *TextBuffer) String() string {
+	return b.Slice(0, b.Len())
+}
+
+// The buffer's tokens as one slice, e.g. for RenderTokenPara.  This closes the gap, which costs as much as copying the text, and the next edit somewhere else opens it again, so use Render, Layout and the buffer's scrolling methods to draw the buffer while it is being edited.  The slice is shared with the buffer, so it is only good until the next edit, and must not be changed
+func (b *TextBuffer) Tokens() []Token {
+	if b.tokens == nil {
+		b.moveGap(b.Len())
+		b.tokens = b.buf[:b.gapStart:b.gapStart]
+	}
+	return b.tokens
+}
+
+// The tokens either side of the gap, without moving it
+func (b *TextBuffer) view() tokenView {
+	return tokenView{head: b.buf[:b.gapStart], tail: b.buf[b.gapEnd:], generation: b.lines.Generation()}
+}
+
+// Draw the buffer like RenderTokenPara, using the buffer's FormatParams
+func (b *TextBuffer) Render(xpos, ypos, minX, minY, maxX, maxY, pixWidth, pixHeight, cursorX, cursorY int, u8Pix []uint8, transparent bool, doDraw bool, showCursor bool) (int, int, int) {
+	return renderTokens(b.Format, xpos, ypos, minX, minY, maxX, maxY, pixWidth, pixHeight, cursorX, cursorY, u8Pix, b.view(), transparent, doDraw, showCursor)
+}
+
+// Scroll the buffer's view so the cursor is on screen, like ScrollToCursor
+func (b *TextBuffer) ScrollToCursor(minX, minY, maxX, maxY int) {
+	scrollToIndex(b.Format, b.Format.Cursor, minX, minY, maxX, maxY, b.view())
+}
+
+// Scroll the buffer's view by a number of pixels, like ScrollBy
+func (b *TextBuffer) ScrollBy(pixels, minX, minY, maxX, maxY int) {
+	scrollBy(b.Format, pixels, minX, minY, maxX, maxY, b.view())
+}
+
+// The index of the buffer's hard lines, kept up to date as it is edited.  See LineIndex
+func (b *TextBuffer) Lines() *LineIndex {
+	return b.lines
+}
+
+// Highlight the buffer's text with h, and keep it highlighted as it is edited.  The highlighter's text is replaced with the buffer's.  nil turns highlighting off, and leaves the text's styles as they are
+func (b *TextBuffer) SetHighlighter(h *Highlighter) error {
+	if h != nil {
+		if err := h.Grammar.compile(); err != nil {
+			return err
+		}
+		h.SetText(b.String())
+	}
+	b.syntax = h
+	if h != nil {
+		b.restyle(0, h.Lines())
+	}
+	return nil
+}
+
+// The buffer's highlighter, or nil
+func (b *TextBuffer) Highlighter() *Highlighter {
+	return b.syntax
+}
+
+// Switch to another theme: its colours go into Format, and highlighted text is restyled with it.  Text that isn't highlighted follows the theme if its style has no colour of its own, like text typed with the default Style
+func (b *TextBuffer) SetTheme(theme *Theme) {
+	if b.Format != nil {
+		theme.Apply(b.Format)
+	}
+	if b.syntax != nil {
+		b.syntax.Theme = theme
+		b.restyle(0, b.syntax.Lines())
+	}
+}
+
+// Hand the hard lines first..last, which are now first..newLast, to the highlighter, and restyle the lines it re-lexed
+func (b *TextBuffer) rehighlight(first, last, newLast int) {
+	texts := make([]string, 0, newLast-first+1)
+	for line := first; line <= newLast; line++ {
+		start, end := b.lines.LineBounds(b.lines.LineStart(line))
+		texts = append(texts, b.Slice(start, end))
+	}
+	start, end := b.syntax.ReplaceLines(first, last-first+1, texts)
+	b.restyle(start, end)
+}
+
+// Give the tokens of hard lines first up to end the highlighter's styles
+func (b *TextBuffer) restyle(first, end int) {
+	h := b.syntax
+	if end > b.lines.Lines() {
+		end = b.lines.Lines()
+	}
+	for line := first; line < end; line++ {
+		start, newline := b.lines.LineBounds(b.lines.LineStart(line))
+		offset := 0
+		for i := start; i < newline; i++ {
+			t := b.token(i)
+			t.Style = h.styleAt(line, offset)
+			offset += len(t.Text)
+		}
+		if newline < b.Len() {
+			b.token(newline).Style = h.theme().Default
+		}
+	}
+}
+
+// The token at i, for changing in place
+func (b *TextBuffer) token(i int) *Token {
+	if i < b.gapStart {
+		return &b.buf[i]
+	}
+	return &b.buf[i+b.gapEnd-b.gapStart]
+}
+
+// Lay out the buffer with LayoutTokenPara, for hit testing and caret navigation
+func (b *TextBuffer) Layout(xpos, ypos, minX, minY, maxX, maxY int) *Layout {
+	return layoutTokens(b.Format, xpos, ypos, minX, minY, maxX, maxY, b.view())
+}
+
+func (b *TextBuffer) clampRange(start, end int) (int, int) {
+	if start > end {
+		start, end = end, start
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end > b.Len() {
+		end = b.Len()
+	}
+	if start > end {
+		start = end
+	}
+	return start, end
+}
+
+// Move the gap so it starts at pos
+func (b *TextBuffer) moveGap(pos int) {
+	gap := b.gapEnd - b.gapStart
+	if pos < b.gapStart {
+		copy(b.buf[pos+gap:b.gapEnd], b.buf[pos:b.gapStart])
+	} else if pos > b.gapStart {
+		copy(b.buf[b.gapStart:], b.buf[b.gapEnd:pos+gap])
+	}
+	b.gapStart = pos
+	b.gapEnd = pos + gap
+}
+
+// Make the gap at least n tokens wide
+func (b *TextBuffer) growGap(n int) {
+	if b.gapEnd-b.gapStart >= n {
+		return
+	}
+	tail := len(b.buf) - b.gapEnd
+	size := 2*len(b.buf) + n
+	grown := make([]Token, size)
+	copy(grown, b.buf[:b.gapStart])
+	copy(grown[size-tail:], b.buf[b.gapEnd:])
+	b.buf = grown
+	b.gapEnd = size - tail
+}
+
+// Swap the tokens from start to end for inserted, and return the ones removed.  This is the only thing that changes the text
+func (b *TextBuffer) splice(start, end int, inserted []Token) []Token {
+	removed := make([]Token, end-start)
+	for i := start; i < end; i++ {
+		removed[i-start] = b.at(i)
+	}
+	b.moveGap(start)
+	b.gapEnd += end - start
+	b.growGap(len(inserted))
+	copy(b.buf[b.gapStart:], inserted)
+	b.gapStart += len(inserted)
+	b.tokens = nil
+	first, last := b.lines.LineOf(start), b.lines.LineOf(end)
+	b.lines.Update(start, end, inserted)
+	b.shareLines()
+	if b.syntax != nil {
+		b.rehighlight(first, last, b.lines.LineOf(start+len(inserted)))
+	}
+	if b.Format != nil {
+		for _, pos := range []*int{&b.Format.Cursor, &b.Format.SelectStart, &b.Format.SelectEnd, &b.Format.FirstDrawnCharPos} {
+			*pos = shiftPos(*pos, start, end, len(inserted))
+		}
+	}
+	return removed
+}
+
+// Where a position ends up after start..end is replaced by n tokens.  Positions inside the replaced text move to the end of the new text
+func shiftPos(pos, start, end, n int) int {
+	switch {
+	case pos < 0 || pos <= start:
+		return pos
+	case pos >= end:
+		return pos + n - (end - start)
+	default:
+		return start + n
+	}
+}
+
+// Replace start..end with text, fixing up grapheme clusters at the edges (e.g. a combining accent typed after a letter joins it).  Returns the range the new text covers
+func (b *TextBuffer) replace(start, end int, text string, kind int) (int, int) {
+	start, end = b.clampRange(start, end)
+	// Take in the neighbouring clusters, in case the new text joins onto them
+	lo, hi := start, end
+	if lo > 0 {
+		lo--
+	}
+	if hi < b.Len() {
+		hi++
+	}
+	before := b.Slice(lo, start)
+	after := b.Slice(end, hi)
+	inserted := b.makeTokens(before + text + after)
+	if len(inserted) > 0 && before != "" && inserted[0].Text == before {
+		inserted = inserted[1:]
+		lo = start
+	}
+	if len(inserted) > 0 && after != "" && inserted[len(inserted)-1].Text == after {
+		inserted = inserted[:len(inserted)-1]
+		hi = end
+	}
+	// Keep the styles of the neighbours that the edit didn't touch
+	if lo < start && len(inserted) > 0 {
+		inserted[0].Style = b.at(lo).Style
+	}
+	if len(inserted) == 0 && lo == hi {
+		return lo, lo
+	}
+	state := b.positions()
+	edit := textEdit{start: lo, inserted: inserted}
+	edit.removed = b.splice(lo, hi, inserted)
+	b.record(edit, kind, state)
+	return lo, lo + len(inserted)
+}
+
+func (b *TextBuffer) positions() [3]int {
+	if b.Format == nil {
+		return [3]int{}
+	}
+	return [3]int{b.Format.Cursor, b.Format.SelectStart, b.Format.SelectEnd}
+}
+
+func (b *TextBuffer) setPositions(p [3]int) {
+	if b.Format == nil {
+		return
+	}
+	b.Format.Cursor, b.Format.SelectStart, b.Format.SelectEnd = p[0], p[1], p[2]
+}
+
+// Add an edit to the undo history, joining it onto the last group if it is part of the same typing run or an open BeginGroup
+func (b *TextBuffer) record(edit textEdit, kind int, before [3]int) {
+	b.redo = nil
+	now := time.Now()
+	join := b.groupDepth > 0 && len(b.undo) > 0
+	if !join && kind != editOther && kind == b.lastKind && len(b.undo) > 0 && now.Sub(b.lastTime) < b.GroupDelay {
+		switch kind {
+		case editTyping:
+			join = edit.start == b.lastPos && len(edit.removed) == 0
+		case editDeleting:
+			join = edit.start == b.lastPos || edit.start+len(edit.removed) == b.lastPos
+		}
+	}
+	if join {
+		last := &b.undo[len(b.undo)-1]
+		last.edits = append(last.edits, edit)
+	} else {
+		b.undo = append(b.undo, editGroup{edits: []textEdit{edit}, before: before})
+	}
+	b.lastKind = kind
+	b.lastTime = now
+	b.lastPos = edit.start
+	if kind == editTyping {
+		b.lastPos = edit.start + len(edit.inserted)
+		// Start a new group after each word
+		if len(edit.inserted) > 0 && strings.TrimSpace(edit.inserted[len(edit.inserted)-1].Text) == "" {
+			b.lastKind = editOther
+		}
+	}
+	if b.groupDepth == 0 {
+		b.closeGroup()
+	}
+}
+
+// Store the cursor and selection after the most recent group
+func (b *TextBuffer) closeGroup() {
+	if len(b.undo) > 0 {
+		b.undo[len(b.undo)-1].after = b.positions()
+	}
+}
+
+// Start a group of edits that are undone together, e.g. a search and replace.  Groups can nest, only the outermost EndGroup closes the group
+func (b *TextBuffer) BeginGroup() {
+	if b.groupDepth == 0 {
+		b.undo = append(b.undo, editGroup{before: b.positions()})
+		b.lastKind = editOther
+	}
+	b.groupDepth++
+}
+
+// Finish a group started with BeginGroup
+func (b *TextBuffer) EndGroup() {
+	if b.groupDepth == 0 {
+		return
+	}
+	b.groupDepth--
+	if b.groupDepth == 0 {
+		if len(b.undo) > 0 && len(b.undo[len(b.undo)-1].edits) == 0 {
+			b.undo = b.undo[:len(b.undo)-1]
+			return
+		}
+		b.closeGroup()
+	}
+}
+
+// Insert text at pos
+func (b *TextBuffer) Insert(pos int, text string) {
+	b.replace(pos, pos, text, editOther)
+}
+
+// Delete the text from start to end
+func (b *TextBuffer) Delete(start, end int) {
+	b.replace(start, end, "", editOther)
+}
+
+// Replace the text from start to end with text
+func (b *TextBuffer) Replace(start, end int, text string) {
+	b.replace(start, end, text, editOther)
+}
+
+// The selection, in order, and whether there is one
+func (b *TextBuffer) selection() (int, int, bool) {
+	if b.Format == nil {
+		return 0, 0, false
+	}
+	start, end := b.Format.SelectStart, b.Format.SelectEnd
+	if start < 0 || end < 0 || start == end {
+		return 0, 0, false
+	}
+	start, end = b.clampRange(start, end)
+	return start, end, true
+}
+
+func (b *TextBuffer) clearSelection() {
+	b.Format.SelectStart = -1
+	b.Format.SelectEnd = -1
+}
+
+// Type text at the cursor, replacing the selection if there is one, and leave the cursor after it
+func (b *TextBuffer) Type(text string) {
+	if b.Format == nil {
+		b.Insert(b.Len(), text)
+		return
+	}
+	kind := editTyping
+	start, end, ok := b.selection()
+	if !ok {
+		start, end = b.Format.Cursor, b.Format.Cursor
+	} else {
+		kind = editOther
+	}
+	_, newEnd := b.replace(start, end, text, kind)
+	b.Format.Cursor = newEnd
+	b.clearSelection()
+	b.closeGroup()
+}
+
+// Delete the selection, or the character before the cursor
+func (b *TextBuffer) Backspace() {
+	b.deleteKey(-1)
+}
+
+// Delete the selection, or the character after the cursor
+func (b *TextBuffer) DeleteForward() {
+	b.deleteKey(1)
+}
+
+func (b *TextBuffer) deleteKey(dir int) {
+	if b.Format == nil {
+		return
+	}
+	if start, end, ok := b.selection(); ok {
+		b.replace(start, end, "", editOther)
+		b.Format.Cursor = start
+		b.clearSelection()
+		b.closeGroup()
+		return
+	}
+	start, end := b.Format.Cursor, b.Format.Cursor+1
+	if dir < 0 {
+		start, end = b.Format.Cursor-1, b.Format.Cursor
+	}
+	if start < 0 || end > b.Len() {
+		return
+	}
+	b.replace(start, end, "", editDeleting)
+	b.Format.Cursor = start
+	b.closeGroup()
+}
+
+// Are there edits to undo?
+func (b *TextBuffer) CanUndo() bool {
+	return len(b.undo) > 0
+}
+
+// Are there undone edits to redo?
+func (b *TextBuffer) CanRedo() bool {
+	return len(b.redo) > 0
+}
+
+// Undo the last group of edits, and put the cursor and selection back.  Returns false if there was nothing to undo
+func (b *TextBuffer) Undo() bool {
+	if len(b.undo) == 0 || b.groupDepth > 0 {
+		return false
+	}
+	group := b.undo[len(b.undo)-1]
+	b.undo = b.undo[:len(b.undo)-1]
+	for i := len(group.edits) - 1; i >= 0; i-- {
+		e := group.edits[i]
+		b.splice(e.start, e.start+len(e.inserted), e.removed)
+	}
+	b.setPositions(group.before)
+	b.redo = append(b.redo, group)
+	b.lastKind = editOther
+	return true
+}
+
+// Redo the last undone group of edits.  Returns false if there was nothing to redo
+func (b *TextBuffer) Redo() bool {
+	if len(b.redo) == 0 || b.groupDepth > 0 {
+		return false
+	}
+	group := b.redo[len(b.redo)-1]
+	b.redo = b.redo[:len(b.redo)-1]
+	for _, e := range group.edits {
+		b.splice(e.start, e.start+len(e.removed), e.inserted)
+	}
+	b.setPositions(group.after)
+	b.undo = append(b.undo, group)
+	b.lastKind = editOther
+	return true
+}
@@ -0,0 +1,148 @@
+package glim
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func typeText(b *TextBuffer, text string) {
+	for _, r := range text {
+		b.Type(string(r))
+	}
+}
+
+func TestTextBufferUndoGrouping(t *testing.T) {
+	tests := []struct {
+		name  string
+		start string
+		edit  func(b *TextBuffer)
+		undos []string // The text after each Undo
+	}{
+		{"typing is undone a word at a time", "", func(b *TextBuffer) {
+			typeText(b, "hello world")
+		}, []string{"hello ", ""}},
+		{"a pause starts a new group", "", func(b *TextBuffer) {
+			b.GroupDelay = 0
+			typeText(b, "ab")
+		}, []string{"a", ""}},
+		{"backspacing is undone in one go", "abcd", func(b *TextBuffer) {
+			b.Format.Cursor = 4
+			b.Backspace()
+			b.Backspace()
+			b.Backspace()
+		}, []string{"abcd"}},
+		{"deleting forward is undone in one go", "abcd", func(b *TextBuffer) {
+			b.Format.Cursor = 1
+			b.DeleteForward()
+			b.DeleteForward()
+		}, []string{"abcd"}},
+		{"typing then deleting are separate", "", func(b *TextBuffer) {
+			typeText(b, "abc")
+			b.Backspace()
+		}, []string{"abc", ""}},
+		{"typing somewhere else is separate", "xy", func(b *TextBuffer) {
+			b.Format.Cursor = 0
+			typeText(b, "a")
+			b.Format.Cursor = 3
+			typeText(b, "b")
+		}, []string{"axy", "xy"}},
+		{"Insert, Delete and Replace are one group each", "abc", func(b *TextBuffer) {
+			b.Insert(0, "1")
+			b.Delete(0, 1)
+			b.Replace(1, 2, "B")
+		}, []string{"abc", "1abc", "abc"}},
+		{"BeginGroup joins edits, and nests", "one two", func(b *TextBuffer) {
+			b.BeginGroup()
+			b.Replace(4, 7, "2")
+			b.BeginGroup()
+			b.Replace(0, 3, "1")
+			b.EndGroup()
+			b.EndGroup()
+		}, []string{"one two"}},
+		{"an empty group leaves no history", "abc", func(b *TextBuffer) {
+			b.BeginGroup()
+			b.EndGroup()
+		}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFormatter()
+			f.SelectStart, f.SelectEnd = -1, -1
+			b := NewTextBuffer(f, tt.start)
+			b.GroupDelay = time.Hour
+			tt.edit(b)
+			after := b.String()
+			for i, want := range tt.undos {
+				if !b.Undo() {
+					t.Fatalf("undo %v: nothing to undo", i+1)
+				}
+				if got := b.String(); got != want {
+					t.Fatalf("undo %v: got %q, want %q", i+1, got, want)
+				}
+			}
+			if b.CanUndo() {
+				b.Undo()
+				t.Fatalf("more to undo, got %q", b.String())
+			}
+			for b.Redo() {
+			}
+			if got := b.String(); got != after {
+				t.Errorf("after redoing everything got %q, want %q", got, after)
+			}
+		})
+	}
+}
+
+func TestTextBufferUndoRestoresCursor(t *testing.T) {
+	f := NewFormatter()
+	f.SelectStart, f.SelectEnd = -1, -1
+	b := NewTextBuffer(f, "abc")
+	f.Cursor = 1
+	typeText(b, "xy")
+	if f.Cursor != 3 {
+		t.Fatalf("cursor %v after typing, want 3", f.Cursor)
+	}
+	b.Undo()
+	if f.Cursor != 1 {
+		t.Errorf("cursor %v after undo, want 1", f.Cursor)
+	}
+	b.Redo()
+	if f.Cursor != 3 {
+		t.Errorf("cursor %v after redo, want 3", f.Cursor)
+	}
+	b.Undo()
+	typeText(b, "z")
+	if b.CanRedo() {
+		t.Error("a new edit should clear the redo history")
+	}
+}
+
+// Drawing the buffer reads the text either side of the gap, without closing it, and draws the same as the flat tokens
+func TestTextBufferRenderKeepsGap(t *testing.T) {
+	f := NewFormatter()
+	f.FontName = "goregular"
+	f.SelectStart, f.SelectEnd = -1, -1
+	b := NewTextBuffer(f, "first line\nsecond line\nthird")
+	f.Cursor = 6
+	typeText(b, "big ")
+	gap := b.gapStart
+	w, h := 300, 120
+	viaBuffer := make([]uint8, w*h*4)
+	b.Render(0, 0, 0, 0, w, h, w, h, 0, 0, viaBuffer, false, true, false)
+	if b.gapStart != gap {
+		t.Fatalf("Render moved the gap from %v to %v", gap, b.gapStart)
+	}
+	if b.Layout(0, 0, 0, 0, w, h); b.gapStart != gap {
+		t.Fatalf("Layout moved the gap from %v to %v", gap, b.gapStart)
+	}
+	flat := make([]uint8, w*h*4)
+	g := CopyFormatter(f)
+	RenderTokenPara(g, 0, 0, 0, 0, w, h, w, h, 0, 0, flat, b.Tokens(), false, true, false)
+	if bytes.Count(viaBuffer, []byte{0}) == len(viaBuffer) {
+		t.Fatal("nothing drawn")
+	}
+	if !bytes.Equal(viaBuffer, flat) {
+		t.Error("Render and RenderTokenPara drew different pixels")
+	}
+}
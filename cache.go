@@ -0,0 +1,317 @@
+// Render caches.  Bounded, least-recently-used caches for rendered text and font faces, safe to use from many goroutines
+package glim
+
+import (
+	"container/list"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// Hit, miss and size counters for a cache
+type CacheStats struct {
+	Hits       uint64 // Lookups that found an entry
+	Misses     uint64 // Lookups that didn't
+	Evictions  uint64 // Entries thrown out to stay inside the limits
+	Entries    int    // Entries currently held
+	Bytes      int64  // Total size of the entries currently held
+	MaxEntries int    // Entry limit, 0 for no limit
+	MaxBytes   int64  // Size limit, 0 for no limit
+}
+
+// A least-recently-used cache, limited by number of entries and by total size
+type lruCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	order      *list.List // Front is the most recently used
+	items      map[interface{}]*list.Element
+	hits       uint64
+	misses     uint64
+	evictions  uint64
+}
+
+type lruEntry struct {
+	key   interface{}
+	value interface{}
+	size  int64
+}
+
+func newLRUCache(maxEntries int, maxBytes int64) *lruCache {
+	return &lruCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		order:      list.New(),
+		items:      map[interface{}]*list.Element{},
+	}
+}
+
+func (c *lruCache) Get(key interface{}) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry).value, true
+}
+
+// Add an entry, replacing any entry with the same key, then evict old entries until the cache is inside its limits.  The new entry is never evicted by its own Add
+func (c *lruCache) Add(key, value interface{}, size int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.bytes -= el.Value.(*lruEntry).size
+		c.order.Remove(el)
+	}
+	c.items[key] = c.order.PushFront(&lruEntry{key, value, size})
+	c.bytes += size
+	c.trim()
+}
+
+func (c *lruCache) trim() {
+	for c.order.Len() > 1 {
+		if (c.maxEntries <= 0 || c.order.Len() <= c.maxEntries) && (c.maxBytes <= 0 || c.bytes <= c.maxBytes) {
+			return
+		}
+		el := c.order.Back()
+		entry := el.Value.(*lruEntry)
+		c.order.Remove(el)
+		delete(c.items, entry.key)
+		c.bytes -= entry.size
+		c.evictions++
+	}
+}
+
+// Remove every entry whose key matches
+func (c *lruCache) RemoveIf(match func(key interface{}) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, el := range c.items {
+		if match(key) {
+			c.bytes -= el.Value.(*lruEntry).size
+			c.order.Remove(el)
+			delete(c.items, key)
+		}
+	}
+}
+
+func (c *lruCache) SetLimits(maxEntries int, maxBytes int64) {
+	c.mu.Lock()
+	c.maxEntries = maxEntries
+	c.maxBytes = maxBytes
+	c.trim()
+	c.mu.Unlock()
+}
+
+// Empty the cache.  The counters are kept
+func (c *lruCache) Clear() {
+	c.mu.Lock()
+	c.order.Init()
+	c.items = map[interface{}]*list.Element{}
+	c.bytes = 0
+	c.mu.Unlock()
+}
+
+func (c *lruCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return CacheStats{c.hits, c.misses, c.evictions, c.order.Len(), c.bytes, c.maxEntries, c.maxBytes}
+}
+
+// Everything that changes the pixels of a rendered string
+type renderKey struct {
+	Font   string
+	Size   float64
+	DPI    float64
+	Colour [4]uint8
+	Text   string
+}
+
+type renderedText struct {
+	img  *image.RGBA
+	face font.Face
+}
+
+type faceKey struct {
+	Font string
+	Size float64
+	DPI  float64
+}
+
+var (
+	renderCache = newLRUCache(4096, 64<<20)
+	faceCache   = newLRUCache(64, 0)
+	textDPI     = math.Float64bits(96)
+)
+
+// The DPI used to turn point sizes into pixels.  The default is 96
+func TextDPI() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&textDPI))
+}
+
+// Set the DPI used to turn point sizes into pixels.  Text already in the caches is kept, because the DPI is part of the cache key
+func SetTextDPI(dpi float64) {
+	atomic.StoreUint64(&textDPI, math.Float64bits(dpi))
+}
+
+// Counters for the cache of rendered strings and glyphs used by DrawStringRGBA and DrawGlyphRGBA
+func RenderCacheStats() CacheStats {
+	return renderCache.Stats()
+}
+
+// Counters for the cache of font faces
+func FaceCacheStats() CacheStats {
+	return faceCache.Stats()
+}
+
+// Limit the rendered text cache to maxEntries images, taking maxBytes of pixel data.  Use 0 for no limit
+func SetRenderCacheLimits(maxEntries int, maxBytes int64) {
+	renderCache.SetLimits(maxEntries, maxBytes)
+}
+
+// Limit the number of font faces (one per font, size and DPI) that are kept.  Use 0 for no limit
+func SetFaceCacheLimit(maxEntries int) {
+	faceCache.SetLimits(maxEntries, 0)
+}
+
+// Called by purgeFontCaches with the fonts being purged, for caches kept outside this file, like glyph atlases
+var fontPurgeHooks []func(purge map[string]bool)
+
+// Throw away cached text and faces for some fonts, because they have been replaced or their fallbacks have changed
+func purgeFontCaches(names ...string) {
+	purge := map[string]bool{}
+	for _, name := range names {
+		purge[name] = true
+	}
+	var stale func(key interface{}) bool
+	stale = func(key interface{}) bool {
+		switch k := key.(type) {
+		case renderKey:
+			return purge[k.Font]
+		case shapedKey:
+			return true // Shaped text can use any font in a fallback chain, so it all goes
+		case styledKey:
+			return purge[k.Font] || k.Font == ""
+		case distanceKey:
+			return purge[k.Font]
+		case effectKey:
+			return stale(k.Src)
+		}
+		return false
+	}
+	renderCache.RemoveIf(stale)
+	faceCache.RemoveIf(func(key interface{}) bool {
+		return purge[key.(faceKey).Font]
+	})
+	for _, name := range names {
+		purgeShapingFace(name)
+		missingFonts.Delete(name)
+	}
+	for _, hook := range fontPurgeHooks {
+		hook(purge)
+	}
+}
+
+func colourKey(c RGBA) [4]uint8 {
+	out := [4]uint8{}
+	copy(out[:], c)
+	return out
+}
+
+// A font.Face that can be shared between goroutines.
+//
+// truetype faces keep scratch buffers, and the mask returned by Glyph is only valid until the next call, so every call holds the lock, and Glyph returns a copy of the mask.  Code that draws a lot of glyphs can take the lock and use face directly instead, to save the copy, as long as it is finished with each mask before unlocking
+type syncFace struct {
+	mu   sync.Mutex
+	face font.Face
+}
+
+func (s *syncFace) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.face.Close()
+}
+
+// Like font.Face's Glyph, but the mask is copied before the lock is let go, so it stays valid
+func (s *syncFace) Glyph(dot fixed.Point26_6, r rune) (image.Rectangle, image.Image, image.Point, fixed.Int26_6, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dr, mask, maskp, advance, ok := s.face.Glyph(dot, r)
+	if mask == nil {
+		return dr, mask, maskp, advance, ok
+	}
+	return dr, copyMask(mask, image.Rectangle{maskp, maskp.Add(dr.Size())}), image.Point{}, advance, ok
+}
+
+// Copy the part of a mask in r to a new image, with r.Min at 0,0.  Alpha masks stay alpha, anything else (colour glyphs) becomes RGBA
+func copyMask(mask image.Image, r image.Rectangle) image.Image {
+	var out draw.Image
+	if _, ok := mask.(*image.Alpha); ok {
+		out = image.NewAlpha(image.Rectangle{Max: r.Size()})
+	} else {
+		out = image.NewRGBA(image.Rectangle{Max: r.Size()})
+	}
+	draw.Draw(out, out.Bounds(), mask, r.Min, draw.Src)
+	return out
+}
+
+func (s *syncFace) GlyphBounds(r rune) (fixed.Rectangle26_6, fixed.Int26_6, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.face.GlyphBounds(r)
+}
+
+func (s *syncFace) GlyphAdvance(r rune) (fixed.Int26_6, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.face.GlyphAdvance(r)
+}
+
+func (s *syncFace) Kern(r0, r1 rune) fixed.Int26_6 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.face.Kern(r0, r1)
+}
+
+func (s *syncFace) Metrics() font.Metrics {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.face.Metrics()
+}
+
+// Get the shared face for a font at a size, creating it if needed.  fontName is the name txtFont was loaded under.  Bitmap fonts ignore the size, and always give their own
+func cachedFace(fontName string, txtFont Font, txtSize, dpi float64) *syncFace {
+	key := faceKey{fontName, txtSize, dpi}
+	if face, ok := faceCache.Get(key); ok {
+		return face.(*syncFace)
+	}
+	var face *syncFace
+	switch f := txtFont.(type) {
+	case *truetype.Font:
+		face = &syncFace{face: truetype.NewFace(f, &truetype.Options{
+			Size:    txtSize,
+			DPI:     dpi,
+			Hinting: font.HintingFull,
+		})}
+	case *BitmapFont:
+		face = &syncFace{face: bitmapFace{f}}
+	case *ColourFont:
+		face = &syncFace{face: newColourFace(f, txtSize, dpi)}
+	default:
+		panic(fmt.Sprintf("can't draw with font %v, a %T", fontName, txtFont))
+	}
+	faceCache.Add(key, face, 0)
+	return face
+}
@@ -0,0 +1,155 @@
+package glim
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"reflect"
+	"sync"
+	"testing"
+
+	"golang.org/x/image/math/fixed"
+)
+
+// The keys in a cache, most recently used first
+func cacheKeys(c *lruCache) []interface{} {
+	keys := []interface{}{}
+	for el := c.order.Front(); el != nil; el = el.Next() {
+		keys = append(keys, el.Value.(*lruEntry).key)
+	}
+	return keys
+}
+
+func TestLRUCache(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxEntries int
+		maxBytes   int64
+		run        func(c *lruCache)
+		keys       []interface{}
+		stats      CacheStats
+	}{
+		{"oldest goes first", 2, 0, func(c *lruCache) {
+			c.Add("a", 1, 0)
+			c.Add("b", 2, 0)
+			c.Add("c", 3, 0)
+		}, []interface{}{"c", "b"}, CacheStats{Evictions: 1, Entries: 2, MaxEntries: 2}},
+		{"Get makes an entry recent", 2, 0, func(c *lruCache) {
+			c.Add("a", 1, 0)
+			c.Add("b", 2, 0)
+			c.Get("a")
+			c.Add("c", 3, 0)
+		}, []interface{}{"c", "a"}, CacheStats{Hits: 1, Evictions: 1, Entries: 2, MaxEntries: 2}},
+		{"replacing an entry", 2, 0, func(c *lruCache) {
+			c.Add("a", 1, 5)
+			c.Add("b", 2, 0)
+			c.Add("a", 3, 1)
+		}, []interface{}{"a", "b"}, CacheStats{Entries: 2, Bytes: 1, MaxEntries: 2}},
+		{"byte budget", 0, 10, func(c *lruCache) {
+			c.Add("a", 1, 4)
+			c.Add("b", 2, 4)
+			c.Add("c", 3, 4)
+		}, []interface{}{"c", "b"}, CacheStats{Evictions: 1, Entries: 2, Bytes: 8, MaxBytes: 10}},
+		{"an entry over the budget stays on its own", 0, 10, func(c *lruCache) {
+			c.Add("a", 1, 4)
+			c.Add("b", 2, 40)
+		}, []interface{}{"b"}, CacheStats{Evictions: 1, Entries: 1, Bytes: 40, MaxBytes: 10}},
+		{"hits and misses", 0, 0, func(c *lruCache) {
+			c.Add("a", 1, 0)
+			c.Get("a")
+			c.Get("a")
+			c.Get("b")
+		}, []interface{}{"a"}, CacheStats{Hits: 2, Misses: 1, Entries: 1}},
+		{"RemoveIf", 0, 0, func(c *lruCache) {
+			for i := 0; i < 6; i++ {
+				c.Add(i, i, int64(i))
+			}
+			c.RemoveIf(func(key interface{}) bool { return key.(int)%2 == 0 })
+		}, []interface{}{5, 3, 1}, CacheStats{Entries: 3, Bytes: 9}},
+		{"lowering the limits", 0, 0, func(c *lruCache) {
+			for i := 0; i < 6; i++ {
+				c.Add(i, i, 1)
+			}
+			c.SetLimits(3, 2)
+		}, []interface{}{5, 4}, CacheStats{Evictions: 4, Entries: 2, Bytes: 2, MaxEntries: 3, MaxBytes: 2}},
+		{"Clear keeps the counters", 1, 0, func(c *lruCache) {
+			c.Add("a", 1, 3)
+			c.Add("b", 2, 3)
+			c.Get("b")
+			c.Clear()
+		}, []interface{}{}, CacheStats{Hits: 1, Evictions: 1, MaxEntries: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newLRUCache(tt.maxEntries, tt.maxBytes)
+			tt.run(c)
+			if keys := cacheKeys(c); !reflect.DeepEqual(keys, tt.keys) {
+				t.Errorf("keys %v, want %v", keys, tt.keys)
+			}
+			if stats := c.Stats(); stats != tt.stats {
+				t.Errorf("stats %+v, want %+v", stats, tt.stats)
+			}
+		})
+	}
+}
+
+// Drawing from many goroutines, with a cache small enough to keep evicting, gives the same pixels as drawing one at a time.  Run with -race
+func TestCacheConcurrentDraw(t *testing.T) {
+	defer SetRenderCacheLimits(4096, 64<<20)
+	SetRenderCacheLimits(3, 0)
+	texts := []string{}
+	for i := 0; i < 8; i++ {
+		texts = append(texts, fmt.Sprintf("text %v", i))
+	}
+	want := map[string][]uint8{}
+	for _, text := range texts {
+		img, _ := DrawStringRGBA(14, RGBA{255, 255, 255, 255}, text, "gomono")
+		want[text] = append([]uint8{}, img.Pix...)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				text := texts[(g+i)%len(texts)]
+				img, _ := DrawStringRGBA(14, RGBA{255, 255, 255, 255}, text, "gomono")
+				if !bytes.Equal(img.Pix, want[text]) {
+					t.Errorf("%q drawn differently", text)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	if stats := RenderCacheStats(); stats.Entries > 3 {
+		t.Errorf("%v entries, over the limit of 3", stats.Entries)
+	}
+}
+
+// The mask from syncFace.Glyph stays the same while other goroutines use the face
+func TestSyncFaceGlyph(t *testing.T) {
+	face := cachedFace("gomono", mustLoadFont("gomono"), 30, TextDPI())
+	runes := []rune("abcdefgh")
+	want := map[rune][]uint8{}
+	for _, r := range runes {
+		_, mask, _, _, _ := face.Glyph(fixed.Point26_6{}, r)
+		want[r] = mask.(*image.Alpha).Pix
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				r := runes[(g+i)%len(runes)]
+				_, mask, maskp, _, _ := face.Glyph(fixed.Point26_6{}, r)
+				if maskp != (image.Point{}) || !bytes.Equal(mask.(*image.Alpha).Pix, want[r]) {
+					t.Errorf("mask for %q changed", r)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,272 @@
+// Caret navigation.  Cursor movement worked out from a paragraph layout, for editors built on RenderTokenPara
+package glim
+
+import (
+	"unicode"
+
+	"github.com/rivo/uniseg"
+)
+
+// The number of cursor positions, i.e. one more than the number of tokens
+func (l *Layout) positions() int {
+	return l.Count + 1
+}
+
+func (l *Layout) clamp(index int) int {
+	if index < 0 {
+		return 0
+	}
+	if index > l.positions()-1 {
+		return l.positions() - 1
+	}
+	return index
+}
+
+// Where the caret for index is along its line: x for horizontal text, y for vertical text.  -1 if index wasn't laid out
+func (l *Layout) CaretAlong(index int) int {
+	caret, ok := l.Caret(index)
+	if !ok {
+		return -1
+	}
+	if l.Vertical {
+		return caret.Min.Y
+	}
+	return caret.Min.X
+}
+
+// Move forward one grapheme cluster (one token, for RenderPara)
+func (l *Layout) NextGrapheme(index int) int {
+	return l.clamp(index + 1)
+}
+
+// Move back one grapheme cluster
+func (l *Layout) PrevGrapheme(index int) int {
+	return l.clamp(index - 1)
+}
+
+// The positions where words start in the hard line holding index, using the Unicode word boundary rules (UAX #29).  Runs of spaces and punctuation are not words.  Also returns the line's first token and the position of its newline
+func (l *Layout) wordStarts(index int) ([]int, int, int) {
+	start, end := lineBounds(l.index, l.tokens, index)
+	starts := []int{}
+	offsets := map[int]int{} // Byte offset -> token
+	text := ""
+	for i := start; i < end; i++ {
+		offsets[len(text)] = i
+		text += l.tokens.At(i).Text
+	}
+	offset := 0
+	state := -1
+	for len(text) > 0 {
+		var word string
+		word, text, state = uniseg.FirstWordInString(text, state)
+		if i, ok := offsets[offset]; ok {
+			for _, r := range word {
+				if unicode.IsLetter(r) || unicode.IsDigit(r) {
+					starts = append(starts, i)
+					break
+				}
+			}
+		}
+		offset += len(word)
+	}
+	return starts, start, end
+}
+
+// Move to the start of the next word, or the end of the text
+func (l *Layout) NextWord(index int) int {
+	index = l.clamp(index)
+	for pos := index; pos < l.DocEnd(); {
+		starts, _, end := l.wordStarts(pos)
+		for _, start := range starts {
+			if start > index {
+				return start
+			}
+		}
+		pos = end + 1
+	}
+	return l.DocEnd()
+}
+
+// Move to the start of this word, or the previous one if already at the start
+func (l *Layout) PrevWord(index int) int {
+	index = l.clamp(index)
+	for pos := index; pos >= 0; {
+		starts, start, _ := l.wordStarts(pos)
+		for k := len(starts) - 1; k >= 0; k-- {
+			if starts[k] < index {
+				return starts[k]
+			}
+		}
+		pos = start - 1
+	}
+	return 0
+}
+
+// The first cursor position
+func (l *Layout) DocStart() int {
+	return 0
+}
+
+// The last cursor position, after the last token
+func (l *Layout) DocEnd() int {
+	return l.positions() - 1
+}
+
+// Move to the start of the visual line (or column) holding index
+func (l *Layout) LineStart(index int) int {
+	line := l.LineOf(index)
+	if line < 0 {
+		return index
+	}
+	return l.Lines[line].Start
+}
+
+// Move to the end of the visual line holding index.  For a wrapped line that is just before the space it wrapped at, so the cursor stays on the line
+func (l *Layout) LineEnd(index int) int {
+	line := l.LineOf(index)
+	if line < 0 {
+		return index
+	}
+	return l.Lines[line].End - 1
+}
+
+// The position on a line whose caret is closest to along (see CaretAlong)
+func (l *Layout) closestOnLine(line, along int) int {
+	best := l.Lines[line].Start
+	bestDist := -1
+	for i := l.Lines[line].Start; i < l.Lines[line].End && i < l.positions(); i++ {
+		pos := l.CaretAlong(i)
+		if pos < 0 {
+			continue
+		}
+		dist := pos - along
+		if dist < 0 {
+			dist = -dist
+		}
+		if bestDist < 0 || dist < bestDist {
+			best = i
+			bestDist = dist
+		}
+	}
+	return best
+}
+
+// Move to another line, keeping as close as possible to the preferred position along the line
+func (l *Layout) moveLines(index, preferred, lines int) (int, int) {
+	line := l.LineOf(index)
+	if line < 0 {
+		return index, preferred
+	}
+	if preferred < 0 {
+		preferred = l.CaretAlong(index)
+	}
+	target := line + lines
+	if target < 0 {
+		if line == 0 && l.First > 0 {
+			// Step back into the text that wasn't laid out, so the caller can scroll
+			return l.First - 1, preferred
+		}
+		target = 0
+	}
+	if target > len(l.Lines)-1 {
+		last := l.Lines[len(l.Lines)-1]
+		if line == len(l.Lines)-1 && last.End < l.positions() {
+			return last.End, preferred
+		}
+		target = len(l.Lines) - 1
+	}
+	return l.closestOnLine(target, preferred), preferred
+}
+
+// Move up a line, or for vertical text, to the previous column (to the right).
+//
+// preferred is the position along the line (see CaretAlong) to stay close to.  Pass -1 to use the current caret's, then pass the returned one back in on the next move, so the cursor keeps its column across short lines.  Moves that aren't up or down return -1, to forget it
+func (l *Layout) LineUp(index, preferred int) (int, int) {
+	return l.moveLines(index, preferred, -1)
+}
+
+// Move down a line, or for vertical text, to the next column (to the left)
+func (l *Layout) LineDown(index, preferred int) (int, int) {
+	return l.moveLines(index, preferred, 1)
+}
+
+// The number of lines that fit between the top of the layout and maxY (or the right edge and minX, for vertical text)
+func (l *Layout) pageLines(limit int) int {
+	if len(l.Lines) == 0 {
+		return 1
+	}
+	count := 0
+	for _, line := range l.Lines {
+		if l.Vertical {
+			if line.Rect.Min.X < limit {
+				break
+			}
+		} else if line.Rect.Max.Y > limit {
+			break
+		}
+		count++
+	}
+	if count < 2 {
+		return 1
+	}
+	return count - 1
+}
+
+// Move up by a screenful of lines, where the screen ends at maxY.  For vertical text, pass the left edge (minX) instead.  See LineUp for preferred
+func (l *Layout) PageUp(index, preferred, maxY int) (int, int) {
+	return l.moveLines(index, preferred, -l.pageLines(maxY))
+}
+
+// Move down by a screenful of lines.  From the last line laid out, this moves to the first token that didn't fit
+func (l *Layout) PageDown(index, preferred, maxY int) (int, int) {
+	return l.moveLines(index, preferred, l.pageLines(maxY))
+}
+
+// The level of the character the caret at index sits against
+func (l *Layout) levelAt(index int) int {
+	if g, ok := l.GlyphOf(index); ok {
+		return g.Level
+	}
+	if g, ok := l.GlyphOf(index - 1); ok {
+		return g.Level
+	}
+	return 0
+}
+
+// The left arrow key.  In horizontal text this moves one grapheme to the left on screen, which is backwards in left-to-right text and forwards in right-to-left text.  In vertical text it moves to the next column
+func (l *Layout) Left(index, preferred int) (int, int) {
+	if l.Vertical {
+		return l.LineDown(index, preferred)
+	}
+	if l.levelAt(index)%2 == 1 {
+		return l.NextGrapheme(index), -1
+	}
+	return l.PrevGrapheme(index), -1
+}
+
+// The right arrow key.  See Left
+func (l *Layout) Right(index, preferred int) (int, int) {
+	if l.Vertical {
+		return l.LineUp(index, preferred)
+	}
+	if l.levelAt(index)%2 == 1 {
+		return l.PrevGrapheme(index), -1
+	}
+	return l.NextGrapheme(index), -1
+}
+
+// The up arrow key.  A line up in horizontal text, one grapheme back in vertical text
+func (l *Layout) Up(index, preferred int) (int, int) {
+	if l.Vertical {
+		return l.PrevGrapheme(index), -1
+	}
+	return l.LineUp(index, preferred)
+}
+
+// The down arrow key.  See Up
+func (l *Layout) Down(index, preferred int) (int, int) {
+	if l.Vertical {
+		return l.NextGrapheme(index), -1
+	}
+	return l.LineDown(index, preferred)
+}
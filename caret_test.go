@@ -0,0 +1,98 @@
+package glim
+
+import "testing"
+
+// Lay out text in gomono, so every character is the same width, in a box big enough for all of it
+func caretLayout(text string, vertical bool) *Layout {
+	f := NewFormatter()
+	f.FontName = "gomono"
+	f.FontSize = 12
+	f.Vertical = vertical
+	return LayoutTokenPara(f, 0, 0, 0, 0, 600, 600, lineTokens(text))
+}
+
+func TestCaretWords(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		from int
+		next int // Where NextWord goes
+		prev int // and PrevWord
+	}{
+		{"inside a word", "hello big world", 7, 10, 6},
+		{"at a word start", "hello big world", 6, 10, 0},
+		{"in the spaces", "one   two", 4, 6, 0},
+		{"punctuation isn't a word", "a, (b) c", 1, 4, 0},
+		{"last word", "hello world", 8, 11, 6},
+		{"at the ends", "hello world", 0, 6, 0},
+		{"across a newline", "one\ntwo", 1, 4, 0},
+		{"back across a newline", "one\ntwo", 4, 7, 0},
+		{"across a blank line", "one\n\n  two", 2, 7, 0},
+		{"numbers are words", "x = 42;", 2, 4, 0},
+		{"apostrophes stay in the word", "don't stop", 1, 6, 0},
+		{"other scripts", "привет мир", 3, 7, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := caretLayout(tt.text, false)
+			if got := l.NextWord(tt.from); got != tt.next {
+				t.Errorf("NextWord(%v) = %v, want %v", tt.from, got, tt.next)
+			}
+			if got := l.PrevWord(tt.from); got != tt.prev {
+				t.Errorf("PrevWord(%v) = %v, want %v", tt.from, got, tt.prev)
+			}
+		})
+	}
+}
+
+// Moving between lines keeps the caret near where it started along the line, even across a short line in between
+func TestCaretLines(t *testing.T) {
+	// Lines start at 0, 7 and 10
+	text := "abcdef\nab\nabcdef"
+	type move func(l *Layout, index, preferred int) (int, int)
+	tests := []struct {
+		name     string
+		vertical bool
+		forward  move // Towards the next line
+		back     move
+	}{
+		{"horizontal", false, (*Layout).Down, (*Layout).Up},
+		{"vertical", true, (*Layout).Left, (*Layout).Right},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := caretLayout(text, tt.vertical)
+			if len(l.Lines) != 3 {
+				t.Fatalf("%v lines, want 3", len(l.Lines))
+			}
+			index, preferred := 5, -1
+			for _, step := range []struct {
+				move move
+				want int
+			}{
+				{tt.forward, 9},  // The end of the short line
+				{tt.forward, 15}, // Back to where it started along the line
+				{tt.forward, 15}, // No further to go
+				{tt.back, 9},
+				{tt.back, 5},
+				{tt.back, 5},
+			} {
+				index, preferred = step.move(l, index, preferred)
+				if index != step.want {
+					t.Fatalf("moved to %v, want %v", index, step.want)
+				}
+			}
+			// Moving along the line forgets the remembered position
+			var along move = (*Layout).Right
+			if tt.vertical {
+				along = (*Layout).Down
+			}
+			if index, preferred = along(l, 5, preferred); index != 6 || preferred != -1 {
+				t.Errorf("moving along the line went to %v, remembering %v", index, preferred)
+			}
+			if index, _ = tt.forward(l, 1, -1); index != 8 {
+				t.Errorf("from 1, a line on is %v, want 8", index)
+			}
+		})
+	}
+}
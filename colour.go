@@ -0,0 +1,331 @@
+// Colour fonts.  Emoji and other colour glyphs, from CBDT/CBLC embedded PNGs and COLR/CPAL layered outlines
+package glim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"sync"
+
+	otfont "github.com/go-text/typesetting/font"
+	ot "github.com/go-text/typesetting/font/opentype"
+	"github.com/golang/freetype/truetype"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+)
+
+// The palette entry that means "the text colour" in a COLR layer
+const foregroundPaletteIndex = 0xffff
+
+// An OpenType font with colour glyphs, like an emoji font.  Glyphs with colour layers (COLR version 0, coloured from the first CPAL palette) or embedded PNGs (CBDT/CBLC) are drawn in their own colours at the size asked for, and other glyphs are drawn from their outlines in the text colour.
+//
+// Text in a colour font is always shaped, so emoji sequences joined with zero width joiners are drawn with the font's single glyph for the sequence
+type ColourFont struct {
+	font    *otfont.Font
+	layers  map[otfont.GID][]colourLayer
+	palette []color.NRGBA
+	bitmaps bool // The font has CBDT/CBLC strikes
+	mu      sync.Mutex
+	strikes map[uint16]*otfont.Face // Faces for drawing glyphs, one per strike size.  Only used with mu held
+}
+
+type colourLayer struct {
+	glyph  otfont.GID
+	colour int // Index into the palette, or foregroundPaletteIndex
+}
+
+// Does the font data have colour glyph tables?
+func hasColourTables(data []byte) bool {
+	ld, err := ot.NewLoader(bytes.NewReader(data))
+	if err != nil {
+		return false
+	}
+	return ld.HasTable(ot.MustNewTag("COLR")) || (ld.HasTable(ot.MustNewTag("CBDT")) && ld.HasTable(ot.MustNewTag("CBLC")))
+}
+
+// Parse an OpenType font with COLR/CPAL or CBDT/CBLC colour glyphs
+func ParseColourFont(data []byte) (*ColourFont, error) {
+	ld, err := ot.NewLoader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	ft, err := otfont.NewFont(ld)
+	if err != nil {
+		return nil, err
+	}
+	f := &ColourFont{font: ft, layers: map[otfont.GID][]colourLayer{}, strikes: map[uint16]*otfont.Face{}}
+	f.bitmaps = ld.HasTable(ot.MustNewTag("CBDT")) && ld.HasTable(ot.MustNewTag("CBLC"))
+	if colr, err := ld.RawTable(ot.MustNewTag("COLR")); err == nil {
+		if f.layers, err = parseCOLR(colr); err != nil {
+			return nil, err
+		}
+		cpal, err := ld.RawTable(ot.MustNewTag("CPAL"))
+		if err != nil {
+			return nil, fmt.Errorf("font has a COLR table but no CPAL palette")
+		}
+		if f.palette, err = parseCPAL(cpal); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// Read the version 0 part of a COLR table: the layers that make up each coloured glyph.  Version 1 tables start with the same records, and their extra paint graphs are ignored
+func parseCOLR(data []byte) (map[otfont.GID][]colourLayer, error) {
+	if len(data) < 14 {
+		return nil, fmt.Errorf("COLR table is too short")
+	}
+	be := binary.BigEndian
+	numBase := int(be.Uint16(data[2:]))
+	baseOffset := int(be.Uint32(data[4:]))
+	layerOffset := int(be.Uint32(data[8:]))
+	numLayers := int(be.Uint16(data[12:]))
+	if baseOffset+6*numBase > len(data) || layerOffset+4*numLayers > len(data) {
+		return nil, fmt.Errorf("COLR records run past the end of the table")
+	}
+	out := map[otfont.GID][]colourLayer{}
+	for i := 0; i < numBase; i++ {
+		rec := data[baseOffset+6*i:]
+		glyph, first, count := be.Uint16(rec), int(be.Uint16(rec[2:])), int(be.Uint16(rec[4:]))
+		if first+count > numLayers {
+			return nil, fmt.Errorf("COLR glyph %v has layers past the end of the table", glyph)
+		}
+		layers := make([]colourLayer, count)
+		for k := range layers {
+			l := data[layerOffset+4*(first+k):]
+			layers[k] = colourLayer{otfont.GID(be.Uint16(l)), int(be.Uint16(l[2:]))}
+		}
+		out[otfont.GID(glyph)] = layers
+	}
+	return out, nil
+}
+
+// Read the first palette of a CPAL table
+func parseCPAL(data []byte) ([]color.NRGBA, error) {
+	if len(data) < 14 {
+		return nil, fmt.Errorf("CPAL table is too short")
+	}
+	be := binary.BigEndian
+	entries := int(be.Uint16(data[2:]))
+	records := int(be.Uint32(data[8:]))
+	first := int(be.Uint16(data[12:]))
+	if records+4*(first+entries) > len(data) {
+		return nil, fmt.Errorf("CPAL colours run past the end of the table")
+	}
+	out := make([]color.NRGBA, entries)
+	for i := range out {
+		c := data[records+4*(first+i):]
+		out[i] = color.NRGBA{c[2], c[1], c[0], c[3]} // Stored as blue, green, red, alpha
+	}
+	return out, nil
+}
+
+// The glyph index for a character, or 0 if the font doesn't have it, like truetype.Font.Index
+func (f *ColourFont) Index(r rune) truetype.Index {
+	gid, ok := f.font.NominalGlyph(r)
+	if !ok || gid > math.MaxUint16 {
+		return 0
+	}
+	return truetype.Index(gid)
+}
+
+// The face for drawing at a strike size.  Its strike is set when it is made, and never changed, so faces used for shaping and measuring are left alone.  Call with f.mu held
+func (f *ColourFont) strikeFace(strike uint16) *otfont.Face {
+	face, ok := f.strikes[strike]
+	if !ok {
+		face = otfont.NewFace(f.font)
+		face.SetPpem(strike, strike)
+		f.strikes[strike] = face
+	}
+	return face
+}
+
+// Draw a glyph with its pen at x, y (on the baseline) in dst, at ppem pixels per em.  The text colour is used for layers that ask for it, and for glyphs with no colour
+func (f *ColourFont) drawGlyph(dst *image.RGBA, gid otfont.GID, ppem, x, y float32, textColour RGBA) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	strike := uint16(0)
+	if f.bitmaps {
+		strike = uint16(math.Ceil(float64(ppem)))
+	}
+	face := f.strikeFace(strike)
+	if layers, ok := f.layers[gid]; ok {
+		for _, l := range layers {
+			var c color.Color = RGBAtoColor(textColour)
+			if l.colour != foregroundPaletteIndex && l.colour < len(f.palette) {
+				c = f.palette[l.colour]
+			}
+			if outline, ok := face.GlyphData(l.glyph).(otfont.GlyphOutline); ok {
+				fillOutline(dst, outline, ppem/float32(face.Upem()), x, y, image.NewUniform(c))
+			}
+		}
+		return
+	}
+	if f.bitmaps {
+		if bitmap, ok := face.GlyphData(gid).(otfont.GlyphBitmap); ok && bitmap.Format == otfont.PNG {
+			if pic, err := png.Decode(bytes.NewReader(bitmap.Data)); err == nil {
+				if ext, ok := face.GlyphExtents(gid); ok {
+					// The extents are in font units, whichever strike the PNG came from.  Fonts with outlines as well give the outline's box
+					scale := ppem / float32(face.Upem())
+					r := image.Rect(
+						int(math.Round(float64(x+ext.XBearing*scale))), int(math.Round(float64(y-ext.YBearing*scale))),
+						int(math.Round(float64(x+(ext.XBearing+ext.Width)*scale))), int(math.Round(float64(y-(ext.YBearing+ext.Height)*scale))))
+					xdraw.CatmullRom.Scale(dst, r, pic, pic.Bounds(), draw.Over, nil)
+					return
+				}
+			}
+		}
+	}
+	if outline, ok := face.GlyphData(gid).(otfont.GlyphOutline); ok {
+		fillOutline(dst, outline, ppem/float32(face.Upem()), x, y, image.NewUniform(RGBAtoColor(textColour)))
+	}
+}
+
+// Fill a glyph outline (in font units, y up) onto dst, with its origin at x, y and scale pixels per font unit
+func fillOutline(dst *image.RGBA, outline otfont.GlyphOutline, scale, x, y float32, src image.Image) {
+	if len(outline.Segments) == 0 {
+		return
+	}
+	b := dst.Bounds()
+	raster := vector.NewRasterizer(b.Dx(), b.Dy())
+	raster.DrawOp = draw.Over
+	pt := func(p ot.SegmentPoint) (float32, float32) {
+		return x + p.X*scale - float32(b.Min.X), y - p.Y*scale - float32(b.Min.Y)
+	}
+	for _, seg := range outline.Segments {
+		x0, y0 := pt(seg.Args[0])
+		switch seg.Op {
+		case ot.SegmentOpMoveTo:
+			raster.ClosePath()
+			raster.MoveTo(x0, y0)
+		case ot.SegmentOpLineTo:
+			raster.LineTo(x0, y0)
+		case ot.SegmentOpQuadTo:
+			x1, y1 := pt(seg.Args[1])
+			raster.QuadTo(x0, y0, x1, y1)
+		case ot.SegmentOpCubeTo:
+			x1, y1 := pt(seg.Args[1])
+			x2, y2 := pt(seg.Args[2])
+			raster.CubeTo(x0, y0, x1, y1, x2, y2)
+		}
+	}
+	raster.ClosePath()
+	raster.Draw(dst, b, src, image.Point{})
+}
+
+// Draw a run of text in a colour font, shaped so joined emoji sequences become one glyph, with the pen starting at dot.  Returns how far the pen moved
+func drawColourRun(dst *image.RGBA, fontName string, txtSize float64, txt string, dot fixed.Point26_6, textColour RGBA) fixed.Int26_6 {
+	clusters, err := ShapeText(fontName, txtSize, txt, false)
+	if err != nil {
+		panic(err)
+	}
+	glyphs := []ShapedGlyph{}
+	for _, c := range clusters {
+		glyphs = append(glyphs, c.Glyphs...)
+	}
+	shapeLock.Lock()
+	defer shapeLock.Unlock()
+	return drawGlyphsAt(dst, glyphs, dot.X, float32(dot.Y)/64, shapePixels(txtSize), textColour) - dot.X
+}
+
+// The advance of a run of text in a colour font, shaped like drawColourRun
+func colourRunAdvance(fontName string, txtSize float64, txt string) fixed.Int26_6 {
+	clusters, err := ShapeText(fontName, txtSize, txt, false)
+	if err != nil {
+		panic(err)
+	}
+	adv := fixed.I(0)
+	for _, c := range clusters {
+		adv += c.Advance
+	}
+	return adv
+}
+
+// A font.Face for a colour font, for measuring, and for code that only wants the shape of a glyph.  Glyph returns the glyph in colour, which works as a mask.  Not safe for concurrent use, see syncFace
+type colourFace struct {
+	f     *ColourFont
+	face  *otfont.Face
+	ppem  float32
+	scale float32 // Pixels per font unit
+}
+
+func newColourFace(f *ColourFont, txtSize, dpi float64) *colourFace {
+	face := otfont.NewFace(f.font)
+	ppem := float32(txtSize * dpi / 72)
+	strike := uint16(math.Ceil(float64(ppem)))
+	face.SetPpem(strike, strike)
+	return &colourFace{f, face, ppem, ppem / float32(face.Upem())}
+}
+
+func (c *colourFace) Close() error {
+	return nil
+}
+
+func (c *colourFace) glyphID(r rune) (otfont.GID, bool) {
+	return c.f.font.NominalGlyph(r)
+}
+
+func (c *colourFace) GlyphBounds(r rune) (fixed.Rectangle26_6, fixed.Int26_6, bool) {
+	gid, ok := c.glyphID(r)
+	adv := c.advance(gid)
+	if !ok {
+		return fixed.Rectangle26_6{}, adv, false
+	}
+	ext, ok := c.face.GlyphExtents(gid)
+	if !ok {
+		return fixed.Rectangle26_6{}, adv, true
+	}
+	toFixed := func(v float32) fixed.Int26_6 {
+		return fixed.Int26_6(math.Round(float64(v * c.scale * 64)))
+	}
+	return fixed.Rectangle26_6{
+		Min: fixed.Point26_6{X: toFixed(ext.XBearing), Y: -toFixed(ext.YBearing)},
+		Max: fixed.Point26_6{X: toFixed(ext.XBearing + ext.Width), Y: -toFixed(ext.YBearing + ext.Height)},
+	}, adv, true
+}
+
+func (c *colourFace) advance(gid otfont.GID) fixed.Int26_6 {
+	return fixed.Int26_6(math.Round(float64(c.face.HorizontalAdvance(gid) * c.scale * 64)))
+}
+
+func (c *colourFace) GlyphAdvance(r rune) (fixed.Int26_6, bool) {
+	gid, ok := c.glyphID(r)
+	return c.advance(gid), ok
+}
+
+func (c *colourFace) Glyph(dot fixed.Point26_6, r rune) (image.Rectangle, image.Image, image.Point, fixed.Int26_6, bool) {
+	bounds, adv, ok := c.GlyphBounds(r)
+	if !ok {
+		return image.Rectangle{}, nil, image.Point{}, adv, false
+	}
+	dr := image.Rect(
+		(dot.X + bounds.Min.X).Floor(), (dot.Y + bounds.Min.Y).Floor(),
+		(dot.X + bounds.Max.X).Ceil(), (dot.Y + bounds.Max.Y).Ceil())
+	img := image.NewRGBA(dr)
+	gid, _ := c.glyphID(r)
+	c.f.drawGlyph(img, gid, c.ppem, float32(dot.X)/64, float32(dot.Y)/64, RGBA{255, 255, 255, 255})
+	return dr, img, dr.Min, adv, true
+}
+
+func (c *colourFace) Kern(r0, r1 rune) fixed.Int26_6 {
+	return 0
+}
+
+func (c *colourFace) Metrics() font.Metrics {
+	ext, _ := c.face.FontHExtents()
+	toFixed := func(v float32) fixed.Int26_6 {
+		return fixed.Int26_6(math.Round(float64(v * c.scale * 64)))
+	}
+	return font.Metrics{
+		Height:  toFixed(ext.Ascender - ext.Descender + ext.LineGap),
+		Ascent:  toFixed(ext.Ascender),
+		Descent: -toFixed(ext.Descender),
+	}
+}
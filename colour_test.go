@@ -0,0 +1,250 @@
+package glim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/png"
+	"reflect"
+	"sort"
+	"testing"
+
+	otfont "github.com/go-text/typesetting/font"
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// Append big endian 16 bit values
+func be16(b []byte, values ...int) []byte {
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint16(b, uint16(v))
+	}
+	return b
+}
+
+// Append big endian 32 bit values
+func be32(b []byte, values ...int) []byte {
+	for _, v := range values {
+		b = binary.BigEndian.AppendUint32(b, uint32(v))
+	}
+	return b
+}
+
+// Rebuild an sfnt font file with tables added or replaced
+func withTables(data []byte, extra map[string][]byte) []byte {
+	be := binary.BigEndian
+	tables := map[string][]byte{}
+	for i := 0; i < int(be.Uint16(data[4:])); i++ {
+		rec := data[12+16*i:]
+		offset, length := be.Uint32(rec[8:]), be.Uint32(rec[12:])
+		tables[string(rec[:4])] = data[offset : offset+length]
+	}
+	for tag, table := range extra {
+		tables[tag] = table
+	}
+	tags := []string{}
+	for tag := range tables {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	out := be16(be32(nil, 0x00010000), len(tags), 0, 0, 0)
+	body := []byte{}
+	for _, tag := range tags {
+		out = be32(append(out, tag...), 0, 12+16*len(tags)+len(body), len(tables[tag]))
+		body = append(body, tables[tag]...)
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+	}
+	return append(out, body...)
+}
+
+// A COLR table giving glyph base two layers: under, in palette colour 0, then over, in the text colour
+func colrTable(base, under, over int) []byte {
+	colr := be32(be16(nil, 0, 1), 14, 20)
+	colr = be16(colr, 2, base, 0, 2)
+	return be16(colr, under, 0, over, foregroundPaletteIndex)
+}
+
+// A CPAL table with one palette of colours
+func cpalTable(colours ...color.NRGBA) []byte {
+	cpal := be16(be32(be16(nil, 0, len(colours), 1, len(colours)), 14), 0)
+	for _, c := range colours {
+		cpal = append(cpal, c.B, c.G, c.R, c.A)
+	}
+	return cpal
+}
+
+// CBDT and CBLC tables giving glyph gid a 16 pixel strike, drawn from pngData
+func cbdtTables(gid int, pngData []byte) ([]byte, []byte) {
+	cbdt := be16(nil, 3, 0)
+	cbdt = append(cbdt, 16, 16, 0, 16, 16) // Small glyph metrics
+	cbdt = append(be32(cbdt, len(pngData)), pngData...)
+	cblc := be32(be16(nil, 3, 0), 1)
+	cblc = be32(cblc, 8+48, 8+16, 1, 0)
+	line := []byte{16, 0xfc, 16, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	cblc = append(append(cblc, line...), line...)
+	cblc = append(be16(cblc, gid, gid), 16, 16, 32, 1)
+	cblc = be32(be16(cblc, gid, gid), 8)
+	cblc = be32(be16(cblc, 1, 17), 0, 4, 4+5+4+len(pngData))
+	return cbdt, cblc
+}
+
+func TestParseCOLR(t *testing.T) {
+	good := colrTable(5, 6, 7)
+	tests := []struct {
+		name string
+		data []byte
+		want map[otfont.GID][]colourLayer // nil for an error
+	}{
+		{"good", good, map[otfont.GID][]colourLayer{5: {{6, 0}, {7, foregroundPaletteIndex}}}},
+		{"no glyphs", be16(be32(be16(nil, 0, 0), 14, 14), 0), map[otfont.GID][]colourLayer{}},
+		{"too short", good[:13], nil},
+		{"base records cut off", good[:18], nil},
+		{"layer records cut off", good[:len(good)-1], nil},
+		{"base records past the end", append(be32(be16(nil, 0, 1), 1<<30, 20), good[12:]...), nil},
+		{"layers past the count", append(be16(good[:12:12], 1), good[14:]...), nil}, // Glyph 5 has 2 layers
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCOLR(tt.data)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("no error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCPAL(t *testing.T) {
+	red, clear := color.NRGBA{255, 0, 0, 255}, color.NRGBA{1, 2, 3, 0}
+	good := cpalTable(red, clear)
+	tests := []struct {
+		name string
+		data []byte
+		want []color.NRGBA // nil for an error
+	}{
+		{"good", good, []color.NRGBA{red, clear}},
+		{"too short", good[:13], nil},
+		{"colours cut off", good[:len(good)-1], nil},
+		{"records past the end", append(be32(good[:8:8], 1<<30), good[12:]...), nil},
+		{"first colour past the end", append(good[:12:12], append(be16(nil, 1), good[14:]...)...), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCPAL(tt.data)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("no error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Count the pixels of an image that are mostly one colour
+func countColour(img *image.RGBA, want color.RGBA) int {
+	n := 0
+	for i := 0; i < len(img.Pix); i += 4 {
+		c := img.Pix[i : i+4]
+		if c[3] > 200 && AbsInt(int(c[0])-int(want.R)) < 50 && AbsInt(int(c[1])-int(want.G)) < 50 && AbsInt(int(c[2])-int(want.B)) < 50 {
+			n++
+		}
+	}
+	return n
+}
+
+// Broken colour tables give an error, or are drawn as plain outlines, but never crash
+func TestColourFontTables(t *testing.T) {
+	tf, _ := truetype.Parse(goregular.TTF)
+	a, o, b := int(tf.Index('A')), int(tf.Index('O')), int(tf.Index('B'))
+	pic := image.NewNRGBA(image.Rect(0, 0, 16, 16))
+	for i := 0; i < len(pic.Pix); i += 4 {
+		pic.Pix[i+1], pic.Pix[i+3] = 255, 255
+	}
+	var pngData bytes.Buffer
+	png.Encode(&pngData, pic)
+	cbdt, cblc := cbdtTables(b, pngData.Bytes())
+	badCBDT, _ := cbdtTables(b, []byte("not a png"))
+	colr, cpal := colrTable(a, o, a), cpalTable(color.NRGBA{255, 0, 0, 255})
+
+	green, blue := color.RGBA{0, 255, 0, 255}, color.RGBA{0, 0, 255, 255}
+	tests := []struct {
+		name   string
+		tables map[string][]byte
+		ok     bool
+		glyph  int
+		colour color.RGBA // A colour the glyph is drawn in
+	}{
+		{"png", map[string][]byte{"CBDT": cbdt, "CBLC": cblc}, true, b, green},
+		{"bad png", map[string][]byte{"CBDT": badCBDT, "CBLC": cblc}, true, b, blue},
+		{"CBDT cut short", map[string][]byte{"CBDT": cbdt[:20], "CBLC": cblc}, true, b, blue},
+		{"CBLC cut short", map[string][]byte{"CBDT": cbdt, "CBLC": cblc[:30]}, true, b, blue},
+		{"COLR cut short", map[string][]byte{"COLR": colr[:20], "CPAL": cpal}, false, 0, blue},
+		{"CPAL cut short", map[string][]byte{"COLR": colr, "CPAL": cpal[:12]}, false, 0, blue},
+		{"COLR with no CPAL", map[string][]byte{"COLR": colr}, false, 0, blue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := ParseColourFont(withTables(goregular.TTF, tt.tables))
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			img := image.NewRGBA(image.Rect(0, 0, 40, 40))
+			f.drawGlyph(img, otfont.GID(tt.glyph), 32, 4, 32, RGBA{0, 0, 255, 255})
+			if countColour(img, tt.colour) < 20 {
+				t.Errorf("glyph not drawn in %v", tt.colour)
+			}
+		})
+	}
+}
+
+// A layered glyph is drawn one layer over another, each in its own colour
+func TestColourFontLayers(t *testing.T) {
+	tf, _ := truetype.Parse(goregular.TTF)
+	a, o := int(tf.Index('A')), int(tf.Index('O'))
+	data := withTables(goregular.TTF, map[string][]byte{"COLR": colrTable(a, o, a), "CPAL": cpalTable(color.NRGBA{255, 0, 0, 255})})
+	f, err := ParseColourFont(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := image.NewRGBA(image.Rect(0, 0, 50, 50))
+	f.drawGlyph(img, otfont.GID(a), 40, 4, 40, RGBA{0, 0, 255, 255})
+	red, blue := countColour(img, color.RGBA{255, 0, 0, 255}), countColour(img, color.RGBA{0, 0, 255, 255})
+	if red < 50 || blue < 50 {
+		t.Errorf("%v red (O) and %v blue (A) pixels, want both", red, blue)
+	}
+	// The A is on top, so where both letters are, it's blue
+	f.mu.Lock()
+	outline := f.strikeFace(0).GlyphData(otfont.GID(a)).(otfont.GlyphOutline)
+	f.mu.Unlock()
+	plain := image.NewRGBA(img.Rect)
+	fillOutline(plain, outline, 40/float32(f.font.Upem()), 4, 40, image.NewUniform(color.White))
+	for i := 0; i < len(img.Pix); i += 4 {
+		if plain.Pix[i+3] == 255 && (img.Pix[i] > 10 || img.Pix[i+2] < 245) {
+			t.Fatalf("pixel %v inside the A is %v", i/4, img.Pix[i:i+4])
+		}
+	}
+}
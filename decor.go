@@ -0,0 +1,156 @@
+// Text decorations.  Backgrounds, underlines, strikethrough and boxes, painted around the glyphs of a Layout
+package glim
+
+import (
+	"image"
+)
+
+// How a token is underlined
+type Underline int
+
+const (
+	UnderlineNone     Underline = iota
+	UnderlineStraight           // A solid line
+	UnderlineWavy               // A squiggle, like a spelling or compiler error
+)
+
+// The box a character owns: its own extent along the line, and the whole line across it.  Backgrounds and selections fill this, so they join up into one block
+func (l *Layout) cell(g LayoutGlyph) image.Rectangle {
+	r := g.Rect
+	if g.Line < 0 || g.Line >= len(l.Lines) {
+		return r
+	}
+	line := l.Lines[g.Line].Rect
+	if l.Vertical {
+		r.Min.X, r.Max.X = line.Min.X, line.Max.X
+	} else {
+		r.Min.Y, r.Max.Y = line.Min.Y, line.Max.Y
+	}
+	return r
+}
+
+// Fill r, leaving out anything outside clip
+func fillClipped(r, clip image.Rectangle, pixWidth, pixHeight int, u8Pix []uint8, colour *RGBA) {
+	r = r.Intersect(clip)
+	if !r.Empty() {
+		FillRect(r.Min.X, r.Min.Y, r.Dx(), r.Dy(), pixWidth, pixHeight, u8Pix, colour)
+	}
+}
+
+// The thickness of decoration lines, and how far below the baseline an underline goes, for text of size points
+func decorationMetrics(size float64) (int, int) {
+	px := size * TextDPI() / 72
+	thickness := MaxI(1, int(px/14+0.5))
+	return thickness, int(px*0.1+0.5) + thickness
+}
+
+// Draw a line along the text from along0 to along1, at across.  For vertical text along is y and across is x
+func (l *Layout) decorationLine(along0, along1, across, thickness int, wavy bool, pixWidth, pixHeight int, u8Pix []uint8, colour *RGBA) {
+	box := func(along, across, length, thickness int) image.Rectangle {
+		if l.Vertical {
+			return image.Rect(across, along, across+thickness, along+length)
+		}
+		return image.Rect(along, across, along+length, across+thickness)
+	}
+	if !wavy {
+		fillClipped(box(along0, across, along1-along0, thickness), l.Clip, pixWidth, pixHeight, u8Pix, colour)
+		return
+	}
+	// A zigzag, with its phase taken from the absolute position, so neighbouring characters join up
+	amplitude := thickness + 1
+	period := 4 * amplitude
+	for a := along0; a < along1; a++ {
+		phase := ((a % period) + period) % period
+		offset := phase
+		if phase > period/2 {
+			offset = period - phase
+		}
+		offset = offset/2 - amplitude/2
+		fillClipped(box(a, across+offset, 1, thickness), l.Clip, pixWidth, pixHeight, u8Pix, colour)
+	}
+}
+
+// Fill the backgrounds of tokens that have one
+func (l *Layout) paintBackgrounds(pixWidth, pixHeight int, u8Pix []uint8) {
+	for _, g := range l.Glyphs {
+		if g.style.BackgroundColour != nil {
+			fillClipped(l.cell(g), l.Clip, pixWidth, pixHeight, u8Pix, g.style.BackgroundColour)
+		}
+	}
+}
+
+// Draw underlines, strikethrough and boxes over the glyphs
+func (l *Layout) paintDecorations(pixWidth, pixHeight int, u8Pix []uint8) {
+	for k, g := range l.Glyphs {
+		s := g.style
+		if s.Underline == UnderlineNone && !s.Strikethrough && s.BoxColour == nil {
+			continue
+		}
+		colour := g.colour
+		thickness, below := decorationMetrics(g.size)
+		along0, along1 := g.Rect.Min.X, g.Rect.Max.X
+		if l.Vertical {
+			along0, along1 = g.Rect.Min.Y, g.Rect.Max.Y
+		}
+		if s.Underline != UnderlineNone {
+			underline := &colour
+			if s.UnderlineColour != nil {
+				underline = s.UnderlineColour
+			}
+			// Vertical text is underlined down its right hand side, as in Japanese
+			// Tightly spaced lines leave no room below the descenders, so keep the underline inside the line
+			across := g.Baseline + below
+			if bottom := l.cell(g).Max.Y - thickness; across > bottom {
+				across = MaxI(bottom, g.Baseline+1)
+			}
+			if l.Vertical {
+				across = g.Rect.Max.X + thickness
+			}
+			l.decorationLine(along0, along1, across, thickness, s.Underline == UnderlineWavy, pixWidth, pixHeight, u8Pix, underline)
+		}
+		if s.Strikethrough {
+			across := g.Baseline - (g.Baseline-g.Rect.Min.Y)*3/10 - thickness/2
+			if l.Vertical {
+				across = (g.Rect.Min.X + g.Rect.Max.X - thickness) / 2
+			}
+			l.decorationLine(along0, along1, across, thickness, false, pixWidth, pixHeight, u8Pix, &colour)
+		}
+		if s.BoxColour != nil {
+			l.paintBox(k, thickness, pixWidth, pixHeight, u8Pix)
+		}
+	}
+}
+
+// Outline the glyph's cell.  Boxed neighbours on the same line with the same colour share one box, so the sides between them are left out
+func (l *Layout) paintBox(k, thickness, pixWidth, pixHeight int, u8Pix []uint8) {
+	g := l.Glyphs[k]
+	colour := g.style.BoxColour
+	joins := func(other int) bool {
+		if other < 0 || other >= len(l.Glyphs) {
+			return false
+		}
+		o := l.Glyphs[other]
+		return o.Line == g.Line && o.style.BoxColour != nil && colourKey(*o.style.BoxColour) == colourKey(*colour)
+	}
+	r := l.cell(g)
+	t := thickness
+	if l.Vertical {
+		fillClipped(image.Rect(r.Min.X, r.Min.Y, r.Min.X+t, r.Max.Y), l.Clip, pixWidth, pixHeight, u8Pix, colour)
+		fillClipped(image.Rect(r.Max.X-t, r.Min.Y, r.Max.X, r.Max.Y), l.Clip, pixWidth, pixHeight, u8Pix, colour)
+		if !joins(k - 1) {
+			fillClipped(image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+t), l.Clip, pixWidth, pixHeight, u8Pix, colour)
+		}
+		if !joins(k + 1) {
+			fillClipped(image.Rect(r.Min.X, r.Max.Y-t, r.Max.X, r.Max.Y), l.Clip, pixWidth, pixHeight, u8Pix, colour)
+		}
+		return
+	}
+	fillClipped(image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+t), l.Clip, pixWidth, pixHeight, u8Pix, colour)
+	fillClipped(image.Rect(r.Min.X, r.Max.Y-t, r.Max.X, r.Max.Y), l.Clip, pixWidth, pixHeight, u8Pix, colour)
+	if !joins(k - 1) {
+		fillClipped(image.Rect(r.Min.X, r.Min.Y, r.Min.X+t, r.Max.Y), l.Clip, pixWidth, pixHeight, u8Pix, colour)
+	}
+	if !joins(k + 1) {
+		fillClipped(image.Rect(r.Max.X-t, r.Min.Y, r.Max.X, r.Max.Y), l.Clip, pixWidth, pixHeight, u8Pix, colour)
+	}
+}
@@ -0,0 +1,247 @@
+// Text effects.  Outlines, drop shadows and outer glow, drawn under the text on a bigger canvas
+package glim
+
+import (
+	"image"
+	"image/draw"
+	"math"
+)
+
+// Effects drawn behind text.  Each one is only drawn if its colour is set.  See FormatParams.Effects and DrawStringEffectsRGBA
+type TextEffects struct {
+	OutlineWidth  float64 // Pixels of outline around each letter
+	OutlineColour *RGBA
+	ShadowX       int     // How far the shadow is moved right of the text, in pixels
+	ShadowY       int     // How far the shadow is moved down
+	ShadowBlur    float64 // How far the shadow's edge is blurred, in pixels.  0 for a hard shadow
+	ShadowColour  *RGBA
+	GlowRadius    float64 // How far the glow reaches out from the letters (and their outline), in pixels
+	GlowColour    *RGBA
+}
+
+// The effects part of a cache key.  Colours are turned into arrays, so the key can be compared
+type effectsKey struct {
+	Outline       float64
+	OutlineColour [4]uint8
+	ShadowX       int
+	ShadowY       int
+	ShadowBlur    float64
+	ShadowColour  [4]uint8
+	Glow          float64
+	GlowColour    [4]uint8
+}
+
+func (fx TextEffects) key() effectsKey {
+	k := effectsKey{Outline: fx.OutlineWidth, ShadowX: fx.ShadowX, ShadowY: fx.ShadowY, ShadowBlur: fx.ShadowBlur, Glow: fx.GlowRadius}
+	if fx.OutlineColour != nil {
+		k.OutlineColour = colourKey(*fx.OutlineColour)
+	}
+	if fx.ShadowColour != nil {
+		k.ShadowColour = colourKey(*fx.ShadowColour)
+	}
+	if fx.GlowColour != nil {
+		k.GlowColour = colourKey(*fx.GlowColour)
+	}
+	return k
+}
+
+func (fx TextEffects) outline() bool {
+	return fx.OutlineColour != nil && fx.OutlineWidth > 0
+}
+
+func (fx TextEffects) glow() bool {
+	return fx.GlowColour != nil && fx.GlowRadius > 0
+}
+
+func (fx TextEffects) shadow() bool {
+	return fx.ShadowColour != nil
+}
+
+// Are any of the effects drawn?
+func (fx *TextEffects) any() bool {
+	return fx != nil && (fx.outline() || fx.glow() || fx.shadow())
+}
+
+// How far each effect spreads past the letters, on each side.  Min is the spread up and to the left, as positive numbers
+func (fx TextEffects) margins() (image.Point, image.Point) {
+	grow := 0
+	if fx.outline() {
+		grow = int(math.Ceil(fx.OutlineWidth))
+	}
+	around := grow
+	if fx.glow() {
+		around += 3 * blurBox(fx.GlowRadius)
+	}
+	before, after := image.Pt(around, around), image.Pt(around, around)
+	if fx.shadow() {
+		spread := grow + 3*blurBox(fx.ShadowBlur)
+		before.X = MaxI(before.X, spread-fx.ShadowX)
+		before.Y = MaxI(before.Y, spread-fx.ShadowY)
+		after.X = MaxI(after.X, spread+fx.ShadowX)
+		after.Y = MaxI(after.Y, spread+fx.ShadowY)
+	}
+	return before, after
+}
+
+// The radius of each of the three box blurs that together make a blur about r pixels wide
+func blurBox(r float64) int {
+	if r <= 0 {
+		return 0
+	}
+	return MaxI(1, int(math.Round(r/3)))
+}
+
+// A cached drawing of the effects for a text image
+type effectKey struct {
+	Src      interface{} // The render cache key of the text image: a renderKey, shapedKey or styledKey
+	Effects  effectsKey
+	WithText bool // The text is drawn on top too
+}
+
+type effectImage struct {
+	img    *image.RGBA
+	offset image.Point
+}
+
+// Draw text, like DrawStringRGBA, with effects behind it.  The image is bigger than the one from DrawStringRGBA, so the effects aren't cut off, and offset is where DrawStringRGBA's image would sit in it.  So paste it at offset up and left of where the plain text would go.
+//
+// The returned image is shared with other callers, so don't draw on it
+func DrawStringEffectsRGBA(txtSize float64, fontColor RGBA, txt, fontfile string, fx TextEffects) (img *image.RGBA, offset image.Point) {
+	fontfile = drawableFont(fontfile)
+	src, _ := DrawStringRGBA(txtSize, fontColor, txt, fontfile)
+	return withEffects(src, renderKey{fontfile, txtSize, TextDPI(), colourKey(fontColor), txt}, fx, true)
+}
+
+// Draw the effects for an image of text, optionally with the text on top, and where the image goes in the result.  srcKey is the render cache key src is kept under
+func withEffects(src *image.RGBA, srcKey interface{}, fx TextEffects, withText bool) (*image.RGBA, image.Point) {
+	key := effectKey{srcKey, fx.key(), withText}
+	if v, ok := renderCache.Get(key); ok {
+		e := v.(effectImage)
+		return e.img, e.offset
+	}
+	before, after := fx.margins()
+	size := src.Bounds().Size()
+	out := image.NewRGBA(image.Rect(0, 0, size.X+before.X+after.X, size.Y+before.Y+after.Y))
+	at := image.Rectangle{before, before.Add(size)}
+
+	// The shape of the letters, and of the letters with their outline
+	letters := image.NewAlpha(out.Bounds())
+	draw.Draw(letters, at, src, src.Bounds().Min, draw.Src)
+	shape := letters
+	if fx.outline() {
+		shape = dilateAlpha(letters, fx.OutlineWidth)
+	}
+	if fx.shadow() {
+		shadow := blurAlpha(shape, blurBox(fx.ShadowBlur))
+		r := out.Bounds().Add(image.Pt(fx.ShadowX, fx.ShadowY))
+		draw.DrawMask(out, r, image.NewUniform(RGBAtoColor(*fx.ShadowColour)), image.Point{}, shadow, image.Point{}, draw.Over)
+	}
+	if fx.glow() {
+		glow := blurAlpha(shape, blurBox(fx.GlowRadius))
+		// A blurred edge is only half strength, so brighten it to make the glow start at full strength against the letters
+		for i, a := range glow.Pix {
+			glow.Pix[i] = uint8(MinI(255, 2*int(a)))
+		}
+		draw.DrawMask(out, out.Bounds(), image.NewUniform(RGBAtoColor(*fx.GlowColour)), image.Point{}, glow, image.Point{}, draw.Over)
+	}
+	if fx.outline() {
+		draw.DrawMask(out, out.Bounds(), image.NewUniform(RGBAtoColor(*fx.OutlineColour)), image.Point{}, shape, image.Point{}, draw.Over)
+	}
+	if withText {
+		draw.Draw(out, at, src, src.Bounds().Min, draw.Over)
+	}
+	renderCache.Add(key, effectImage{out, before}, int64(len(out.Pix)))
+	return out, before
+}
+
+// Grow a shape by width pixels in every direction.  The new edge is anti-aliased
+func dilateAlpha(src *image.Alpha, width float64) *image.Alpha {
+	b := src.Bounds()
+	out := image.NewAlpha(b)
+	reach := int(math.Ceil(width + 0.5))
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			a := src.Pix[src.PixOffset(x, y)]
+			if a == 0 {
+				continue
+			}
+			for dy := -reach; dy <= reach; dy++ {
+				for dx := -reach; dx <= reach; dx++ {
+					p := image.Pt(x+dx, y+dy)
+					if !p.In(b) {
+						continue
+					}
+					cover := width + 0.5 - math.Hypot(float64(dx), float64(dy))
+					if cover <= 0 {
+						continue
+					}
+					v := uint8(float64(a) * math.Min(1, cover))
+					if o := out.PixOffset(p.X, p.Y); v > out.Pix[o] {
+						out.Pix[o] = v
+					}
+				}
+			}
+		}
+	}
+	return out
+}
+
+// Blur a shape with three box blurs of radius r, which is close to a gaussian blur and quick
+func blurAlpha(src *image.Alpha, r int) *image.Alpha {
+	b := src.Bounds()
+	out := image.NewAlpha(b)
+	copy(out.Pix, src.Pix)
+	if r <= 0 {
+		return out
+	}
+	w, h := b.Dx(), b.Dy()
+	line := make([]int, MaxI(w, h))
+	// Blur the run of n pixels starting at offset start, step apart
+	blur := func(start, step, n int) {
+		for i := 0; i < n; i++ {
+			line[i] = int(out.Pix[start+i*step])
+		}
+		sum := 0
+		for i := -r; i <= r; i++ {
+			if i >= 0 && i < n {
+				sum += line[i]
+			}
+		}
+		for i := 0; i < n; i++ {
+			out.Pix[start+i*step] = uint8(sum / (2*r + 1))
+			if i-r >= 0 {
+				sum -= line[i-r]
+			}
+			if i+r+1 < n {
+				sum += line[i+r+1]
+			}
+		}
+	}
+	for pass := 0; pass < 3; pass++ {
+		for y := 0; y < h; y++ {
+			blur(y*out.Stride, 1, w)
+		}
+		for x := 0; x < w; x++ {
+			blur(x, out.Stride, h)
+		}
+	}
+	return out
+}
+
+// Draw the effects for every glyph, before any of the glyphs are drawn, so one letter's shadow or outline never covers its neighbour
+func (l *Layout) paintEffects(fx *TextEffects, colours func(LayoutGlyph) RGBA, pixWidth, pixHeight int, u8Pix []uint8) {
+	if !fx.any() {
+		return
+	}
+	for _, g := range l.Glyphs {
+		if g.tab {
+			continue
+		}
+		img, originX, key := g.image(colours(g))
+		if img == nil {
+			continue
+		}
+		under, offset := withEffects(img, key, *fx, false)
+		pasteClipped(under, g.Rect.Min.X-originX-offset.X, g.Baseline-textBaseline(g.size)-offset.Y, l.Clip, pixWidth, pixHeight, u8Pix)
+	}
+}
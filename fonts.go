@@ -0,0 +1,526 @@
+// Font registry.  Fonts are registered under a name, then looked up by that name whenever text is drawn
+package glim
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/golang/freetype/truetype"
+	"github.com/kardianos/osext"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gobolditalic"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// ErrFontNotFound is returned when a font name is not registered, and no font file with that name could be found
+var ErrFontNotFound = errors.New("font not found")
+
+// DefaultFontName is the font used by routines that don't take a font argument, like PasteText and String2Tex.  It is also the default font for NewFormatter.
+//
+// There is no f1.ttf built in.  If there isn't one next to the program or in the font folders, text is drawn with gomono, the same as older versions did.  Set this to "goregular" for a proportional font
+var DefaultFontName = "f1.ttf"
+
+// The font drawn with when a font can't be loaded, by the drawing routines that can't return errors
+const fallbackFontName = "gomono"
+
+// Fonts is the registry used by LoadFont and all the drawing routines.
+//
+// It always contains the Go fonts as "gomono" and "goregular", with "gobold", "goitalic" and "gobolditalic" set as goregular's styles
+var Fonts = NewFontRegistry()
+
+// A font that text can be drawn with: a *truetype.Font, or a *BitmapFont loaded from a BDF or PCF file
+type Font interface {
+	Index(r rune) truetype.Index // The font's glyph for r, or 0 if it doesn't have one
+}
+
+// A FontRegistry maps names to parsed fonts.  It is safe to use from multiple goroutines.
+type FontRegistry struct {
+	mu        sync.RWMutex
+	fonts     map[string]*registeredFont
+	fallbacks map[string][]string  // Fonts to try, in order, when a font has no glyph for a character
+	styles    map[string][3]string // The bold, italic and bold italic faces of a font
+}
+
+type registeredFont struct {
+	font   Font
+	data   []byte // The raw font file, kept for the tables that truetype doesn't parse
+	source string // Where the font came from, for error messages
+	loaded bool   // True if LoadFont found the file, rather than it being registered by hand
+}
+
+// Create a font registry containing only the built in Go fonts
+func NewFontRegistry() *FontRegistry {
+	r := &FontRegistry{fonts: map[string]*registeredFont{}, fallbacks: map[string][]string{}, styles: map[string][3]string{}}
+	builtin := []struct {
+		name string
+		data []byte
+	}{
+		{"gomono", gomono.TTF},
+		{"goregular", goregular.TTF},
+		{"gobold", gobold.TTF},
+		{"goitalic", goitalic.TTF},
+		{"gobolditalic", gobolditalic.TTF},
+	}
+	for _, b := range builtin {
+		if err := r.RegisterFontBytes(b.name, b.data); err != nil {
+			panic(err)
+		}
+	}
+	r.SetStyles("goregular", "gobold", "goitalic", "gobolditalic")
+	return r
+}
+
+func (r *FontRegistry) register(name string, data []byte, source string, loaded bool) error {
+	if name == "" {
+		return fmt.Errorf("cannot register font from %v: empty name", source)
+	}
+	data, err := gunzipFont(data)
+	if err != nil {
+		return fmt.Errorf("could not uncompress font %v from %v: %w", name, source, err)
+	}
+	var txtFont Font
+	if isBitmapFont(data) {
+		txtFont, err = ParseBitmapFont(data)
+	} else if hasColourTables(data) {
+		txtFont, err = ParseColourFont(data)
+	} else {
+		txtFont, err = truetype.Parse(data)
+	}
+	if err != nil {
+		return fmt.Errorf("could not parse font %v from %v: %w", name, source, err)
+	}
+	r.mu.Lock()
+	r.fonts[name] = &registeredFont{font: txtFont, data: data, source: source, loaded: loaded}
+	r.mu.Unlock()
+	purgeFontCaches(r.usersOf(name)...)
+	return nil
+}
+
+// Register a font, from the contents of a font file, under name.  Any font already registered under name is replaced.
+//
+// TrueType fonts, colour fonts with CBDT or COLR tables, and BDF and PCF bitmap fonts, are recognised by their contents.  Gzipped files, like the .pcf.gz fonts that come with X, are uncompressed first
+func (r *FontRegistry) RegisterFontBytes(name string, data []byte) error {
+	return r.register(name, data, "memory", false)
+}
+
+// Register the font file at path under name
+func (r *FontRegistry) RegisterFontFile(name, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("could not read font %v: %w", name, err)
+	}
+	return r.register(name, data, path, false)
+}
+
+// Register the font file at path inside fsys (e.g. an embed.FS) under name
+func (r *FontRegistry) RegisterFontFS(name string, fsys fs.FS, path string) error {
+	data, err := fs.ReadFile(fsys, path)
+	if err != nil {
+		return fmt.Errorf("could not read font %v: %w", name, err)
+	}
+	return r.register(name, data, path, false)
+}
+
+// Remove a font from the registry
+func (r *FontRegistry) Unregister(name string) {
+	r.mu.Lock()
+	delete(r.fonts, name)
+	r.mu.Unlock()
+	purgeFontCaches(r.usersOf(name)...)
+}
+
+// Return the font registered under name.  Lookup never loads files, use Load for that
+func (r *FontRegistry) Lookup(name string) (Font, error) {
+	rf, err := r.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return rf.font, nil
+}
+
+// Return the raw font file for a registered font
+func (r *FontRegistry) FontData(name string) ([]byte, error) {
+	rf, err := r.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return rf.data, nil
+}
+
+func (r *FontRegistry) lookup(name string) (*registeredFont, error) {
+	r.mu.RLock()
+	rf, ok := r.fonts[name]
+	r.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrFontNotFound, name)
+	}
+	return rf, nil
+}
+
+// The names of all registered fonts, sorted
+func (r *FontRegistry) Names() []string {
+	r.mu.RLock()
+	out := make([]string, 0, len(r.fonts))
+	for name := range r.fonts {
+		out = append(out, name)
+	}
+	r.mu.RUnlock()
+	sort.Strings(out)
+	return out
+}
+
+// Return the font registered under name.  If there isn't one, treat name as a file name and search for it (see fontSearchPaths).  A font file that is found is registered under name, so it is only loaded once.
+func (r *FontRegistry) Load(name string) (Font, error) {
+	if txtFont, err := r.Lookup(name); err == nil {
+		return txtFont, nil
+	}
+	paths, fontDirs := fontSearchPaths(name)
+	txtFont, found, err := r.loadFirst(name, paths)
+	if !found && !filepath.IsAbs(name) && filepath.Base(name) == name {
+		// Look anywhere under the font folders, since system fonts are usually kept in folders like /usr/share/fonts/truetype/dejavu
+		indexed := fontFiles(fontDirs)[name]
+		paths = append(paths, indexed...)
+		txtFont, found, err = r.loadFirst(name, indexed)
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %v (searched %v)", ErrFontNotFound, name, strings.Join(paths, ", "))
+	}
+	return txtFont, err
+}
+
+// Register the first of paths that can be read under name.  found is false if none of them could be read
+func (r *FontRegistry) loadFirst(name string, paths []string) (txtFont Font, found bool, err error) {
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		if err := r.register(name, data, path, true); err != nil {
+			return nil, true, err
+		}
+		txtFont, err := r.Lookup(name)
+		return txtFont, true, err
+	}
+	return nil, false, nil
+}
+
+// Check that a font, and every font in its fallback chain, can be loaded.  The drawing routines that can't return errors draw with gomono instead of a font that fails this, so this is how to find out what went wrong
+func (r *FontRegistry) Check(name string) error {
+	if _, err := r.Load(name); err != nil {
+		return err
+	}
+	for _, fallback := range r.Fallbacks(name) {
+		if _, err := r.Load(fallback); err != nil {
+			return fmt.Errorf("fallback for %v: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// Set the fonts to try, in order, for characters that the font called name has no glyph for.  Call with no fallbacks to clear the list.
+//
+// The fallback fonts are loaded with Load, so they can be registered names or file names
+func (r *FontRegistry) SetFallbacks(name string, fallbacks ...string) {
+	r.mu.Lock()
+	if len(fallbacks) == 0 {
+		delete(r.fallbacks, name)
+	} else {
+		r.fallbacks[name] = append([]string{}, fallbacks...)
+	}
+	r.mu.Unlock()
+	purgeFontCaches(name)
+}
+
+// The fallback list for name, not including name itself
+func (r *FontRegistry) Fallbacks(name string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string{}, r.fallbacks[name]...)
+}
+
+// The font called name, and every font that falls back to it, since text drawn in those may have come from name
+func (r *FontRegistry) usersOf(name string) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	out := []string{name}
+	for primary, fallbacks := range r.fallbacks {
+		for _, fallback := range fallbacks {
+			if fallback == name && primary != name {
+				out = append(out, primary)
+				break
+			}
+		}
+	}
+	return out
+}
+
+// Set the fonts used for bold, italic and bold italic text in the font called name.  Use "" for a style the font doesn't have, and it will be faked by smearing or slanting the regular glyphs.  Call with all three empty to clear them
+func (r *FontRegistry) SetStyles(name, bold, italic, boldItalic string) {
+	r.mu.Lock()
+	if bold == "" && italic == "" && boldItalic == "" {
+		delete(r.styles, name)
+	} else {
+		r.styles[name] = [3]string{bold, italic, boldItalic}
+	}
+	r.mu.Unlock()
+}
+
+// The font to draw name's bold and/or italic text with, and whether bold and italic still have to be faked because there is no font for them
+func (r *FontRegistry) StyleFont(name string, bold, italic bool) (string, bool, bool) {
+	r.mu.RLock()
+	styles := r.styles[name]
+	r.mu.RUnlock()
+	switch {
+	case bold && italic && styles[2] != "":
+		return styles[2], false, false
+	case bold && styles[0] != "":
+		return styles[0], false, italic
+	case italic && styles[1] != "":
+		return styles[1], bold, false
+	}
+	return name, bold, italic
+}
+
+// Return the first font in name's fallback chain whose character map covers ch, along with its name.
+//
+// If none of them cover ch, the primary font is returned, and will draw its missing glyph box
+func (r *FontRegistry) FontForRune(name string, ch rune) (string, Font, error) {
+	primary, err := r.Load(name)
+	if err != nil {
+		return "", nil, err
+	}
+	if primary.Index(ch) != 0 {
+		return name, primary, nil
+	}
+	for _, fallback := range r.Fallbacks(name) {
+		txtFont, err := r.Load(fallback)
+		if err != nil {
+			return "", nil, fmt.Errorf("fallback for %v: %w", name, err)
+		}
+		if txtFont.Index(ch) != 0 {
+			return fallback, txtFont, nil
+		}
+	}
+	return name, primary, nil
+}
+
+// A piece of text that is drawn with a single font
+type FontRun struct {
+	FontName string
+	Font     Font
+	Text     string
+}
+
+// Split txt into runs, where every character in a run comes from the same font in name's fallback chain.
+//
+// Joiners, variation selectors, skin tone modifiers and tag characters stay in the run before them, so emoji sequences aren't split between fonts.
+//
+// There is always at least one run, so an empty string gives one empty run in the primary font
+func (r *FontRegistry) SplitRuns(name, txt string) ([]FontRun, error) {
+	if txt == "" {
+		primary, err := r.Load(name)
+		if err != nil {
+			return nil, err
+		}
+		return []FontRun{{name, primary, ""}}, nil
+	}
+	runs := []FontRun{}
+	start := 0
+	for i, ch := range txt {
+		if len(runs) > 0 && joinsPrevious(ch) {
+			continue
+		}
+		runName, runFont, err := r.FontForRune(name, ch)
+		if err != nil {
+			return nil, err
+		}
+		if len(runs) > 0 && runs[len(runs)-1].FontName == runName {
+			continue
+		}
+		if len(runs) > 0 {
+			runs[len(runs)-1].Text = txt[start:i]
+		}
+		runs = append(runs, FontRun{runName, runFont, ""})
+		start = i
+	}
+	runs[len(runs)-1].Text = txt[start:]
+	return runs, nil
+}
+
+// Characters that only make sense with the one before them, in emoji sequences
+func joinsPrevious(ch rune) bool {
+	return ch == 0x200d || (ch >= 0xfe00 && ch <= 0xfe0f) || (ch >= 0x1f3fb && ch <= 0x1f3ff) || (ch >= 0xe0020 && ch <= 0xe007f)
+}
+
+// Forget the fonts that were loaded from disk by Load.  Fonts registered by hand stay
+func (r *FontRegistry) forgetLoaded() {
+	r.mu.Lock()
+	for name, rf := range r.fonts {
+		if rf.loaded {
+			delete(r.fonts, name)
+		}
+	}
+	r.mu.Unlock()
+}
+
+// Uncompress gzipped font data.  Anything else is returned as it is
+func gunzipFont(data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		return data, nil
+	}
+	z, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	return io.ReadAll(z)
+}
+
+// Register a font file in the default registry
+func RegisterFontFile(name, path string) error {
+	return Fonts.RegisterFontFile(name, path)
+}
+
+// Register a font, from the contents of a font file, in the default registry
+func RegisterFontBytes(name string, data []byte) error {
+	return Fonts.RegisterFontBytes(name, data)
+}
+
+// Register a font file from inside fsys in the default registry
+func RegisterFontFS(name string, fsys fs.FS, path string) error {
+	return Fonts.RegisterFontFS(name, fsys, path)
+}
+
+// Set the fallback fonts for name in the default registry.  See FontRegistry.SetFallbacks
+func SetFontFallbacks(name string, fallbacks ...string) {
+	Fonts.SetFallbacks(name, fallbacks...)
+}
+
+// Set the bold, italic and bold italic fonts for name in the default registry.  See FontRegistry.SetStyles
+func SetFontStyles(name, bold, italic, boldItalic string) {
+	Fonts.SetStyles(name, bold, italic, boldItalic)
+}
+
+// Check that a font, and its fallbacks, can be loaded from the default registry.  See FontRegistry.Check
+func CheckFont(name string) error {
+	return Fonts.Check(name)
+}
+
+// Look up a font in the default registry, without loading anything from disk
+func LookupFont(name string) (Font, error) {
+	return Fonts.Lookup(name)
+}
+
+// Load a font by name, from the default registry or from disk.  See FontRegistry.Load
+//
+// This works the same way on every OS, only the search directories change
+func LoadFont(fileName string) (Font, error) {
+	return Fonts.Load(fileName)
+}
+
+// Fonts that couldn't be loaded, and the error, so drawableFont doesn't search for them on every draw.  Names are forgotten when their fonts, or their fallbacks, change
+var missingFonts sync.Map
+
+// The font to draw with for name.  That is name, unless it or one of its fallbacks can't be loaded, in which case it is gomono, like older versions drew every font.  The error is logged the first time.  Use CheckFont, or the drawing routines that return errors, to find out about missing fonts
+func drawableFont(name string) string {
+	if _, ok := missingFonts.Load(name); ok {
+		return fallbackFontName
+	}
+	if err := Fonts.Check(name); err != nil {
+		if _, seen := missingFonts.LoadOrStore(name, err); !seen {
+			log.Printf("Drawing with %v instead: %v", fallbackFontName, err)
+		}
+		return fallbackFontName
+	}
+	return name
+}
+
+// Load a font for drawing.  Fonts that go through drawableFont first can be loaded, so this only fails if a font is replaced while it is being drawn
+func mustLoadFont(fileName string) Font {
+	txtFont, err := LoadFont(fileName)
+	if err != nil {
+		panic(err)
+	}
+	return txtFont
+}
+
+// The folder containing the running program, or "" if it can't be found
+func execFolder() string {
+	folderPath, err := osext.ExecutableFolder()
+	if err != nil {
+		return ""
+	}
+	return folderPath
+}
+
+// Build the list of candidate files for fileName, and the font folders.  Absolute paths are only tried as given.  Relative paths are tried in each of dirs, then in each of fontDirs.  Load looks under fontDirs too, if none of them exist
+func searchPaths(fileName string, dirs []string, fontDirs ...string) ([]string, []string) {
+	if filepath.IsAbs(fileName) {
+		return []string{fileName}, fontDirs
+	}
+	out := []string{}
+	for _, dir := range append(dirs, fontDirs...) {
+		if dir == "" {
+			continue
+		}
+		out = append(out, filepath.Join(dir, fileName))
+	}
+	return out, fontDirs
+}
+
+var fontIndex struct {
+	mu    sync.Mutex
+	files map[string][]string // nil until the font folders have been walked
+}
+
+// Every file under the font folders, by file name.  The folders are walked the first time a font can't be found directly, and again after forgetFontFiles
+func fontFiles(fontDirs []string) map[string][]string {
+	fontIndex.mu.Lock()
+	defer fontIndex.mu.Unlock()
+	if fontIndex.files != nil {
+		return fontIndex.files
+	}
+	fontIndex.files = map[string][]string{}
+	for _, dir := range fontDirs {
+		if dir == "" {
+			continue
+		}
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil // Skip folders we can't read
+			}
+			if !d.IsDir() {
+				fontIndex.files[d.Name()] = append(fontIndex.files[d.Name()], path)
+			}
+			return nil
+		})
+	}
+	return fontIndex.files
+}
+
+// Forget the files found under the font folders, so fonts installed since are found
+func forgetFontFiles() {
+	fontIndex.mu.Lock()
+	fontIndex.files = nil
+	fontIndex.mu.Unlock()
+}
+
+// Join parts onto root, or return "" if root is ""
+func underDir(root string, parts ...string) string {
+	if root == "" {
+		return ""
+	}
+	return filepath.Join(append([]string{root}, parts...)...)
+}
@@ -2,25 +2,15 @@
 package glim
 
 import (
-	"golang.org/x/image/font/gofont/gomono"
-
-	"github.com/golang/freetype/truetype"
+	"os"
 )
 
-//Attempts to load a font using golang's built in truetype font library
-func LoadFont(fileName string) *truetype.Font {
-
-	if fontCache == nil {
-		fontCache = map[string]*truetype.Font{}
-	}
-	im, ok := fontCache[fileName]
-	if ok {
-		return im
-	}
-
-	//fontBytes := sysFont.Default()
-
-	txtFont, _ := truetype.Parse(gomono.TTF)
-	fontCache[fileName] = txtFont
-	return txtFont
+// The files LoadFont tries, in order, when asked for a font that isn't registered, and the font folders it looks under if none of them exist
+func fontSearchPaths(fileName string) ([]string, []string) {
+	home, _ := os.UserHomeDir()
+	return searchPaths(fileName, []string{execFolder(), "."},
+		underDir(home, "Library", "Fonts"),
+		"/Library/Fonts",
+		"/System/Library/Fonts",
+	)
 }
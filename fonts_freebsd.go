@@ -2,61 +2,14 @@
 package glim
 
 import (
-	"bytes"
-	"fmt"
-	"golang.org/x/image/font/gofont/gomono"
-	"io"
-	"io/ioutil"
-	"log"
 	"os"
-
-	"github.com/golang/freetype/truetype"
-	"github.com/kardianos/osext"
 )
 
-//Attempts to load a font using goMobile's truetype font library
-func LoadFont(fileName string) *truetype.Font {
-
-	if fontCache == nil {
-		fontCache = map[string]*truetype.Font{}
-	}
-	im, ok := fontCache[fileName]
-	if ok {
-		return im
-	}
-
-	//fontBytes := sysFont.Default()
-
-	var f io.Reader
-	folderPath, err := osext.ExecutableFolder()
-	if err != nil {
-		log.Printf("Could not get exec path, falling back to system font\n")
-		f = bytes.NewReader(gomono.TTF)
-	} else {
-		//log.Println(fileName)
-		file, err := os.Open(fmt.Sprintf("%v%v%v", folderPath, string(os.PathSeparator), fileName))
-		if err != nil {
-			//log.Fatal(err)
-			log.Printf("Could not open %v, falling back to system font\n", fmt.Sprintf("%v%v%v", folderPath, string(os.PathSeparator), fileName))
-			f = bytes.NewReader(gomono.TTF)
-
-		} else {
-			defer file.Close()
-			f = file
-		}
-	}
-	fontBytes, err := ioutil.ReadAll(f)
-	if err != nil {
-		log.Println(err)
-		panic(err)
-	}
-
-	txtFont, err1 := truetype.Parse(fontBytes)
-	if err1 != nil {
-		log.Println(err1)
-		panic(err1)
-	}
-
-	fontCache[fileName] = txtFont
-	return txtFont
+// The files LoadFont tries, in order, when asked for a font that isn't registered, and the font folders it looks under if none of them exist
+func fontSearchPaths(fileName string) ([]string, []string) {
+	home, _ := os.UserHomeDir()
+	return searchPaths(fileName, []string{execFolder(), "."},
+		underDir(home, ".fonts"),
+		"/usr/local/share/fonts",
+	)
 }
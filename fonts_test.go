@@ -0,0 +1,78 @@
+package glim
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// Fonts that can't be loaded are drawn with gomono by the routines that can't return errors, and are errors for the ones that can
+func TestMissingFont(t *testing.T) {
+	white := RGBA{255, 255, 255, 255}
+	want, _ := DrawStringRGBA(12, white, "hi", "gomono")
+	tests := []struct {
+		name      string
+		font      string
+		fallbacks []string
+	}{
+		{"missing font", "no-such-font.ttf", nil},
+		{"missing fallback", "missing-fallback-test", []string{"no-such-fallback.ttf"}},
+	}
+	if err := RegisterFontBytes("missing-fallback-test", goregular.TTF); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetFontFallbacks(tt.font, tt.fallbacks...)
+			defer SetFontFallbacks(tt.font)
+			if err := CheckFont(tt.font); !errors.Is(err, ErrFontNotFound) {
+				t.Errorf("CheckFont: %v", err)
+			}
+			if _, _, err := DrawStringRGBAErr(12, white, "hi", tt.font); !errors.Is(err, ErrFontNotFound) {
+				t.Errorf("DrawStringRGBAErr: %v", err)
+			}
+			if _, _, err := DrawGlyphRGBAErr(12, white, 'h', tt.font); !errors.Is(err, ErrFontNotFound) {
+				t.Errorf("DrawGlyphRGBAErr: %v", err)
+			}
+			got, _ := DrawStringRGBA(12, white, "hi", tt.font)
+			if !bytes.Equal(got.Pix, want.Pix) {
+				t.Error("DrawStringRGBA didn't draw with gomono")
+			}
+			if TextAdvance(12, "hi", tt.font) != TextAdvance(12, "hi", "gomono") {
+				t.Error("TextAdvance didn't measure with gomono")
+			}
+			f := NewFormatter()
+			f.FontName = tt.font
+			RenderPara(f, 0, 0, 0, 0, 100, 100, 100, 100, 0, 0, make([]uint8, 100*100*4), "hi", false, true, false)
+		})
+	}
+}
+
+func TestFontFiles(t *testing.T) {
+	dir := t.TempDir()
+	sub := filepath.Join(dir, "truetype", "dejavu")
+	if err := os.MkdirAll(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	defer forgetFontFiles()
+	forgetFontFiles()
+	if got := fontFiles([]string{dir})["DejaVuSans.ttf"]; len(got) != 0 {
+		t.Fatalf("found %v before it was there", got)
+	}
+	if err := os.WriteFile(filepath.Join(sub, "DejaVuSans.ttf"), goregular.TTF, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The folders are only walked again once the index is forgotten
+	if got := fontFiles([]string{dir})["DejaVuSans.ttf"]; len(got) != 0 {
+		t.Fatalf("index was walked again, found %v", got)
+	}
+	forgetFontFiles()
+	want := []string{filepath.Join(sub, "DejaVuSans.ttf")}
+	if got := fontFiles([]string{dir})["DejaVuSans.ttf"]; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("found %v, want %v", got, want)
+	}
+}
@@ -2,60 +2,17 @@
 package glim
 
 import (
-	"bytes"
-	"fmt"
-	"io"
-	"io/ioutil"
-	"log"
-
-	"golang.org/x/image/font/gofont/gomono"
-
-	//_ "golang.org/x/image/font/gofont/goregular"
-
-	"github.com/golang/freetype/truetype"
-	"github.com/kardianos/osext"
+	"os"
 )
 
-func LoadFileFromExecFolder(fileName string) *truetype.Font {
-	var f io.Reader
-	var fontBytes []byte
-	folderPath, err := osext.ExecutableFolder()
-	fullPath := fmt.Sprintf("%v/%v", folderPath, fileName)
-	fontBytes, err = ioutil.ReadFile(fullPath)
-
-	if err != nil {
-		log.Printf("Could not get exec path, falling back to system font\n")
-		f = bytes.NewReader(gomono.TTF)
-		fontBytes, err = ioutil.ReadAll(f)
-
-		if err != nil {
-			log.Println(err)
-			panic(err)
-		}
-	}
-
-	txtFont, err1 := truetype.Parse(fontBytes)
-	if err1 != nil {
-		log.Println(err1)
-		panic(err1)
+// The files LoadFont tries, in order, when asked for a font that isn't registered, and the font folders it looks under if none of them exist
+func fontSearchPaths(fileName string) ([]string, []string) {
+	winDir := os.Getenv("WINDIR")
+	if winDir == "" {
+		winDir = `C:\Windows`
 	}
-
-	return txtFont
-}
-
-func LoadFont(fileName string) *truetype.Font {
-
-	if fontCache == nil {
-		fontCache = map[string]*truetype.Font{}
-	}
-	im, ok := fontCache[fileName]
-	if ok {
-		return im
-	}
-
-	//fontBytes := sysFont.Default()
-
-	txtFont := LoadFileFromExecFolder(fileName)
-	fontCache[fileName] = txtFont
-	return txtFont
+	return searchPaths(fileName, []string{execFolder(), "."},
+		underDir(os.Getenv("LOCALAPPDATA"), "Microsoft", "Windows", "Fonts"),
+		underDir(winDir, "Fonts"),
+	)
 }
@@ -17,7 +17,6 @@ import (
 
 	_ "image/png"
 
-	"github.com/golang/freetype/truetype"
 	"golang.org/x/image/font"
 	"golang.org/x/image/math/fixed"
 )
@@ -26,12 +25,6 @@ type Thunk func()
 
 type RGBA []uint8
 
-var (
-	renderCache map[string]*image.RGBA
-	faceCache   map[string]*font.Face
-	fontCache   map[string]*truetype.Font
-)
-
 // Make a random picture to display.  Handy for debugging
 func RandPic(width, height int) []uint8 {
 	pic := make([]uint8, width*height*4)
@@ -41,11 +34,16 @@ func RandPic(width, height int) []uint8 {
 	return pic
 }
 
-// Dump the rendercache, facecache and fontcache
+// Dump the rendercache and facecache, and forget any fonts that LoadFont found on disk.  Fonts registered by hand are kept
 func ClearAllCaches() {
-	renderCache = map[string]*image.RGBA{}
-	faceCache = map[string]*font.Face{}
-	fontCache = map[string]*truetype.Font{}
+	renderCache.Clear()
+	faceCache.Clear()
+	Fonts.forgetLoaded()
+	forgetFontFiles()
+	missingFonts.Range(func(name, _ interface{}) bool {
+		missingFonts.Delete(name)
+		return true
+	})
 }
 
 func ToChar(i int) rune {
@@ -375,121 +373,168 @@ func RGBAtoColor(in RGBA) color.RGBA {
 
 // Creates a texture and draws a string to it
 //
+// fontfile is a font name, looked up with LoadFont.  If the font, or one of its fallbacks, can't be loaded, the text is drawn with gomono instead, and the error is logged.  Use DrawStringRGBAErr to get the error.  Characters that the font doesn't have are drawn from its fallback fonts (see SetFontFallbacks), on the same baseline.  The returned face belongs to the font that drew the first character
+//
 // FIXME some fonts might not compeletely fit in the texture (usually the decorative ones which extend into another letter)
 func DrawStringRGBA(txtSize float64, fontColor RGBA, txt, fontfile string) (*image.RGBA, *font.Face) {
 	// log.Printf("Drawing text (%v), colour (%v), size(%v)\n", txt, fontColor, txtSize)
-	cacheKey := fmt.Sprintf("%v,%v,%v", txtSize, fontColor, txt)
-	if renderCache == nil {
-		renderCache = map[string]*image.RGBA{}
-	}
-	if faceCache == nil {
-		faceCache = map[string]*font.Face{}
-	}
-	im, ok := renderCache[cacheKey]
-	face, ok1 := faceCache[cacheKey]
-	if ok && ok1 {
-		return im, face
+	return cachedText(txtSize, fontColor, txt, drawableFont(fontfile))
+}
+
+// Like DrawStringRGBA, but returns an error instead of drawing with gomono if the font, or one of its fallbacks, can't be loaded
+func DrawStringRGBAErr(txtSize float64, fontColor RGBA, txt, fontfile string) (*image.RGBA, *font.Face, error) {
+	if err := Fonts.Check(fontfile); err != nil {
+		return nil, nil, err
 	}
+	img, face := cachedText(txtSize, fontColor, txt, fontfile)
+	return img, face, nil
+}
 
-	txtFont := LoadFont(fontfile)
-	d := &font.Drawer{
-		Src: image.NewUniform(RGBAtoColor(fontColor)), // 字体颜色
-		Face: truetype.NewFace(txtFont, &truetype.Options{
-			Size:    txtSize,
-			DPI:     96,
-			Hinting: font.HintingFull,
-		}),
+// Creates a texture and draws a single character to it.  Fonts, and fallback fonts, are chosen the same way as DrawStringRGBA
+func DrawGlyphRGBA(txtSize float64, fontColor RGBA, glyph rune, fontfile string) (*image.RGBA, *font.Face) {
+	// log.Printf("Drawing text (%v), colour (%v), size(%v)\n", glyph, fontColor, txtSize)
+	return cachedText(txtSize, fontColor, string(glyph), drawableFont(fontfile))
+}
+
+// Like DrawGlyphRGBA, but returns an error instead of drawing with gomono if the font, or one of its fallbacks, can't be loaded
+func DrawGlyphRGBAErr(txtSize float64, fontColor RGBA, glyph rune, fontfile string) (*image.RGBA, *font.Face, error) {
+	return DrawStringRGBAErr(txtSize, fontColor, string(glyph), fontfile)
+}
+
+// Look up rendered text in the render cache, drawing it if it isn't there
+//
+// The returned image and face are shared with other callers, so don't draw on the image
+func cachedText(txtSize float64, fontColor RGBA, txt, fontfile string) (*image.RGBA, *font.Face) {
+	dpi := TextDPI()
+	key := renderKey{fontfile, txtSize, dpi, colourKey(fontColor), txt}
+	if cached, ok := renderCache.Get(key); ok {
+		r := cached.(*renderedText)
+		return r.img, &r.face
 	}
-	fface := d.Face
+	rgba, fface := drawText(txtSize, dpi, fontColor, txt, fontfile)
+	r := &renderedText{rgba, fface}
+	renderCache.Add(key, r, int64(len(rgba.Pix)))
+	return r.img, &r.face
+}
+
+// The baseline of the texture made by drawText, measured down from the top.  It only depends on the size, so text from different fonts lines up
+func textBaseline(txtSize float64) int {
+	return int(float32(textCanvasHeight(txtSize)) * float32(1) / float32(2.5)) // fixed.I(rect.Max.Y/3), //rect.Max.Y*2/3), //FIXME
+}
+
+func textCanvasHeight(txtSize float64) int {
+	return int(txtSize) * 3
+}
+
+// How far from the left edge of a DrawStringRGBA texture the pen starts, i.e. where the text's origin is.  Paste the texture at x - textOriginX to put the origin at x
+func textOriginX(face font.Face, txt string) int {
 	glyph, _ := utf8.DecodeRuneInString(txt)
-	fuckedRect, _, _ := fface.GlyphBounds(glyph)
-	// letterWidth := fixed2int(fuckedRect.Max.X)
+	fuckedRect, _, _ := face.GlyphBounds(glyph)
 	Xadj := Fixed2int(fuckedRect.Min.X)
 	if Xadj < 0 {
 		Xadj = Xadj * -1
 	}
-	// fuckedRect, _, _ = fface.GlyphBounds(glyph)
-	// letterHeight := fixed2int(fuckedRect.Max.Y)
-	//ascend := fuckedRect.min.Y
-	//]
-	targetWidth := d.MeasureString(txt).Ceil() * 2
-	targetHeight := int(txtSize) * 3
-	rect := image.Rect(0, 0, targetWidth, targetHeight)
-	// rect := image.Rect(0, 0, 30, 30)
-	rgba := image.NewRGBA(rect)
-	d.Dst = rgba
+	return Xadj
+}
 
-	d.Dot = fixed.Point26_6{
-		X: fixed.I(Xadj),
-		Y: fixed.I(int(float32(targetHeight) * float32(1) / float32(2.5))), // fixed.I(rect.Max.Y/3), //rect.Max.Y*2/3), //FIXME
+// The distance the pen moves when drawing txt with DrawStringRGBA, using the font's advance widths and the kerning between neighbouring characters.
+//
+// Characters are measured in the font that draws them (see FontRegistry.FontForRune), and only pairs from the same font are kerned.  Runs in colour fonts are measured shaped, like they are drawn.  Fonts that can't be loaded are measured in gomono, like DrawStringRGBA draws them
+func TextAdvance(txtSize float64, txt, fontfile string) fixed.Int26_6 {
+	fontfile = drawableFont(fontfile)
+	runs, err := Fonts.SplitRuns(fontfile, txt)
+	if err != nil {
+		panic(err)
+	}
+	adv := fixed.I(0)
+	for _, run := range runs {
+		if _, ok := run.Font.(*ColourFont); ok {
+			// Shaped, so a joined emoji sequence counts as its one glyph
+			adv += colourRunAdvance(run.FontName, txtSize, run.Text)
+			continue
+		}
+		prev := rune(-1)
+		for _, r := range run.Text {
+			if prev >= 0 {
+				adv += TextKern(txtSize, prev, r, run.FontName)
+			}
+			adv += glyphAdvance(txtSize, r, run.FontName)
+			prev = r
+		}
 	}
-	d.DrawString(txt)
-	renderCache[cacheKey] = rgba
-	faceCache[cacheKey] = &d.Face
-	//imgBytes := rgba.Pix
-	//for i,v := range imgBytes {
-	//imgBytes[i] = 255 - v
-	//}
-
-	return rgba, &d.Face
+	return adv
 }
 
-func DrawGlyphRGBA(txtSize float64, fontColor RGBA, glyph rune, fontfile string) (*image.RGBA, *font.Face) {
-	// log.Printf("Drawing text (%v), colour (%v), size(%v)\n", glyph, fontColor, txtSize)
-	cacheKey := fmt.Sprintf("%v,%v,%v", txtSize, fontColor, glyph)
-	if renderCache == nil {
-		renderCache = map[string]*image.RGBA{}
+// The kerning adjustment between two characters, or 0 if they are drawn from different fonts
+func TextKern(txtSize float64, r0, r1 rune, fontfile string) fixed.Int26_6 {
+	fontfile = drawableFont(fontfile)
+	name0, font0, err := Fonts.FontForRune(fontfile, r0)
+	if err != nil {
+		panic(err)
 	}
-	if faceCache == nil {
-		faceCache = map[string]*font.Face{}
+	name1, _, err := Fonts.FontForRune(fontfile, r1)
+	if err != nil {
+		panic(err)
 	}
-	im, ok := renderCache[cacheKey]
-	face, ok1 := faceCache[cacheKey]
-	if ok && ok1 {
-		return im, face
+	if name0 != name1 {
+		return 0
 	}
+	return cachedFace(name0, font0, txtSize, TextDPI()).Kern(r0, r1)
+}
 
-	txtFont := LoadFont(fontfile)
-	d := &font.Drawer{
-		Src: image.NewUniform(RGBAtoColor(fontColor)), // 字体颜色
-		Face: truetype.NewFace(txtFont, &truetype.Options{
-			Size:    txtSize,
-			DPI:     96,
-			Hinting: font.HintingFull,
-		}),
+func glyphAdvance(txtSize float64, r rune, fontfile string) fixed.Int26_6 {
+	name, txtFont, err := Fonts.FontForRune(fontfile, r)
+	if err != nil {
+		panic(err)
 	}
-	fface := d.Face
+	adv, _ := cachedFace(name, txtFont, txtSize, TextDPI()).GlyphAdvance(r)
+	return adv
+}
 
-	fuckedRect, _, _ := fface.GlyphBounds(glyph)
-	// letterWidth := fixed2int(fuckedRect.Max.X)
-	Xadj := Fixed2int(fuckedRect.Min.X)
-	if Xadj < 0 {
-		Xadj = Xadj * -1
+// Does the actual drawing for DrawStringRGBA and DrawGlyphRGBA.  txt is split into runs by font (see FontRegistry.SplitRuns), and each run is drawn after the previous one.  Runs in colour fonts are shaped and drawn in the font's colours
+func drawText(txtSize, dpi float64, fontColor RGBA, txt, fontfile string) (*image.RGBA, font.Face) {
+	runs, err := Fonts.SplitRuns(fontfile, txt)
+	if err != nil {
+		panic(err)
+	}
+	faces := make([]*syncFace, len(runs))
+	width := fixed.I(0)
+	for i, run := range runs {
+		faces[i] = cachedFace(run.FontName, run.Font, txtSize, dpi)
+		if _, ok := run.Font.(*ColourFont); ok {
+			width += colourRunAdvance(run.FontName, txtSize, run.Text)
+			continue
+		}
+		faces[i].mu.Lock()
+		width += font.MeasureString(faces[i].face, run.Text)
+		faces[i].mu.Unlock()
 	}
-	// fuckedRect, _, _ = fface.GlyphBounds(glyph)
-	// letterHeight := fixed2int(fuckedRect.Max.Y)
-	//ascend := fuckedRect.min.Y
-	//]
-	targetWidth := d.MeasureString(string(glyph)).Ceil() * 2
-	targetHeight := int(txtSize) * 3
+
+	Xadj := textOriginX(faces[0], txt)
+	targetWidth := width.Ceil() * 2
+	targetHeight := textCanvasHeight(txtSize)
 	rect := image.Rect(0, 0, targetWidth, targetHeight)
-	// rect := image.Rect(0, 0, 30, 30)
 	rgba := image.NewRGBA(rect)
-	d.Dst = rgba
 
-	d.Dot = fixed.Point26_6{
-		X: fixed.I(Xadj),
-		Y: fixed.I(int(float32(targetHeight) * float32(1) / float32(2.5))), // fixed.I(rect.Max.Y/3), //rect.Max.Y*2/3), //FIXME
+	d := &font.Drawer{
+		Dst: rgba,
+		Src: image.NewUniform(RGBAtoColor(fontColor)), // 字体颜色
+		Dot: fixed.Point26_6{
+			X: fixed.I(Xadj),
+			Y: fixed.I(textBaseline(txtSize)),
+		},
+	}
+	for i, run := range runs {
+		if _, ok := run.Font.(*ColourFont); ok {
+			d.Dot.X += drawColourRun(rgba, run.FontName, txtSize, run.Text, d.Dot, fontColor)
+			continue
+		}
+		faces[i].mu.Lock()
+		d.Face = faces[i].face
+		d.DrawString(run.Text)
+		faces[i].mu.Unlock()
 	}
-	d.DrawString(string(glyph))
-	renderCache[cacheKey] = rgba
-	faceCache[cacheKey] = &d.Face
-	//imgBytes := rgba.Pix
-	//for i,v := range imgBytes {
-	//imgBytes[i] = 255 - v
-	//}
-
-	return rgba, &d.Face
+	return rgba, faces[0]
 }
 
 func Fixed2int(n fixed.Int26_6) int {
@@ -502,8 +547,12 @@ type Vec2 struct {
 
 // Get the maximum pixel size needed to hold a string
 func GetGlyphSize(size float64, str string) (int, int) {
+	return glyphSize(size, str, DefaultFontName)
+}
+
+func glyphSize(size float64, str, fontName string) (int, int) {
 	_, str_size := utf8.DecodeRuneInString(str)
-	img, _ := DrawStringRGBA(size, RGBA{1.0, 1.0, 1.0, 1.0}, str[0:str_size], "f1.ttf")
+	img, _ := DrawStringRGBA(size, RGBA{1.0, 1.0, 1.0, 1.0}, str[0:str_size], fontName)
 	XmaX, YmaX := img.Bounds().Max.X, img.Bounds().Max.Y
 	if XmaX > 4000 {
 		panic("X can't be that big")
@@ -622,7 +671,7 @@ func PasteImg(img *image.RGBA, xstart, ystart, clientWidth, clientHeight int, u8
 
 // Write some text into a bag of bytes image.
 func PasteText(tSize float64, xpos, ypos, clientWidth, clientHeight int, text string, u8Pix []uint8, transparent bool) {
-	img, _ := DrawStringRGBA(tSize, RGBA{255, 255, 255, 255}, text, "f1.ttf")
+	img, _ := DrawStringRGBA(tSize, RGBA{255, 255, 255, 255}, text, DefaultFontName)
 	po2 := int(MaxI(NextPo2(img.Bounds().Max.X), NextPo2(img.Bounds().Max.Y)))
 	// log.Printf("Chose texture size: %v\n", po2)
 	wordBuff := PaintTexture(img, nil, po2)
@@ -0,0 +1,86 @@
+// Glyph bitmaps.  Tight, single glyph rasterisation for atlases and font exporters
+package glim
+
+import (
+	"image"
+	"image/draw"
+
+	"golang.org/x/image/math/fixed"
+)
+
+// A single rasterised glyph, cropped to its ink
+type GlyphBitmap struct {
+	Rune     rune
+	FontName string        // The font that drew it, which may be a fallback of the requested font
+	Mask     *image.Alpha  // Coverage, 0 to 255.  Empty (0x0) for glyphs with no ink, like space
+	Bearing  image.Point   // Offset from the pen position on the baseline to the top left of Mask
+	Advance  fixed.Int26_6 // How far to move the pen after drawing
+}
+
+// Rasterise one glyph from fontName (or its fallbacks, see FontRegistry.FontForRune) at size points
+func RasterGlyph(fontName string, size float64, r rune) (GlyphBitmap, error) {
+	runName, runFont, err := Fonts.FontForRune(fontName, r)
+	if err != nil {
+		return GlyphBitmap{}, err
+	}
+	face := cachedFace(runName, runFont, size, TextDPI())
+	face.mu.Lock()
+	defer face.mu.Unlock()
+	dr, mask, maskp, advance, _ := face.face.Glyph(fixed.Point26_6{}, r)
+	out := GlyphBitmap{
+		Rune:     r,
+		FontName: runName,
+		Mask:     image.NewAlpha(image.Rect(0, 0, dr.Dx(), dr.Dy())),
+		Bearing:  dr.Min,
+		Advance:  advance,
+	}
+	if mask != nil {
+		// The face reuses its mask buffer, so copy it out while we hold the lock
+		draw.Draw(out.Mask, out.Mask.Bounds(), mask, maskp, draw.Src)
+	}
+	return out, nil
+}
+
+// Convert the glyph to a white RGBA image, ready to upload as a texture and tint.  Like all image.RGBA it is premultiplied, so the coverage is in every channel, not just alpha.  Blend it with ONE, ONE_MINUS_SRC_ALPHA
+func (g GlyphBitmap) RGBA() *image.RGBA {
+	b := g.Mask.Bounds()
+	out := image.NewRGBA(b)
+	for i, a := range g.Mask.Pix {
+		out.Pix[i*4+0] = a
+		out.Pix[i*4+1] = a
+		out.Pix[i*4+2] = a
+		out.Pix[i*4+3] = a
+	}
+	return out
+}
+
+// Packs rectangles into a fixed size page, left to right in rows ("shelves").  Simple and fast, and good enough for glyphs, which are mostly the same height
+type ShelfPacker struct {
+	Width, Height int
+	Padding       int // Empty pixels kept around each rectangle, so filtering doesn't bleed between neighbours
+	x, y          int
+	rowHeight     int
+}
+
+func NewShelfPacker(width, height, padding int) *ShelfPacker {
+	return &ShelfPacker{Width: width, Height: height, Padding: padding, x: padding, y: padding}
+}
+
+// Find space for a w by h rectangle.  Returns false if the page is full
+func (p *ShelfPacker) Pack(w, h int) (image.Point, bool) {
+	if w+2*p.Padding > p.Width || h+2*p.Padding > p.Height {
+		return image.Point{}, false
+	}
+	if p.x+w+p.Padding > p.Width {
+		p.x = p.Padding
+		p.y += p.rowHeight + p.Padding
+		p.rowHeight = 0
+	}
+	if p.y+h+p.Padding > p.Height {
+		return image.Point{}, false
+	}
+	pos := image.Point{p.x, p.y}
+	p.x += w + p.Padding
+	p.rowHeight = MaxI(p.rowHeight, h)
+	return pos, true
+}
@@ -0,0 +1,132 @@
+// Grammars for the syntax highlighter.  Go, JSON, Markdown and shell
+package glim
+
+const (
+	goKeywords  = `\b(?:break|case|chan|const|continue|default|defer|else|fallthrough|for|func|go|goto|if|import|interface|map|package|range|return|select|struct|switch|type|var)\b`
+	goTypes     = `\b(?:any|bool|byte|comparable|complex64|complex128|error|float32|float64|int|int8|int16|int32|int64|rune|string|uint|uint8|uint16|uint32|uint64|uintptr)\b`
+	goBuiltins  = `\b(append|cap|clear|close|complex|copy|delete|imag|len|make|max|min|new|panic|print|println|real|recover)(\s*\()`
+	goNumber    = `(?:0[xX][0-9a-fA-F_]+(?:\.[0-9a-fA-F_]*)?(?:[pP][+-]?\d+)?|0[bB][01_]+|0[oO][0-7_]+|\d[\d_]*(?:\.[\d_]*)?(?:[eE][+-]?\d+)?|\.\d[\d_]*(?:[eE][+-]?\d+)?)i?`
+	jsonString  = `"(?:[^"\\]|\\.)*"`
+	shellVar    = `\$\{[^}]*\}|\$[A-Za-z_]\w*|\$[@*#?$!0-9-]`
+	shellEscape = `\\.`
+)
+
+// Go source code
+var GoGrammar = &Grammar{
+	Name:       "Go",
+	Extensions: []string{".go"},
+	States: map[string][]Rule{
+		"root": {
+			{Pattern: `\s+`},
+			{Pattern: `//.*`, Scope: "comment.line"},
+			{Pattern: `/\*`, Scope: "comment.block", Push: "comment"},
+			{Pattern: "`", Scope: "string.quoted.raw", Push: "rawString"},
+			{Pattern: `"`, Scope: "string.quoted.double", Push: "string"},
+			{Pattern: `'(?:[^'\\]|\\.)*'`, Scope: "string.quoted.single"},
+			{Pattern: `\b(func)(\s+)([A-Za-z_]\w*)`, Groups: []string{"keyword", "", "entity.name.function"}},
+			{Pattern: goKeywords, Scope: "keyword"},
+			{Pattern: goTypes, Scope: "support.type"},
+			{Pattern: `\b(?:true|false|nil|iota)\b`, Scope: "constant.language"},
+			{Pattern: goBuiltins, Groups: []string{"support.function", ""}},
+			{Pattern: `([A-Za-z_]\w*)(\s*\()`, Groups: []string{"entity.name.function", ""}},
+			{Pattern: `[A-Za-z_]\w*`},
+			{Pattern: goNumber, Scope: "constant.numeric"},
+			{Pattern: `[-+*/%&|^<>=!:]+|\.\.\.`, Scope: "keyword.operator"},
+			{Pattern: `[(){}\[\],;.]`, Scope: "punctuation"},
+		},
+		"comment": {
+			{Pattern: `\*/`, Scope: "comment.block", Pop: true},
+			{Pattern: `[^*]+|\*`, Scope: "comment.block"},
+		},
+		"rawString": {
+			{Pattern: "`", Scope: "string.quoted.raw", Pop: true},
+			{Pattern: "[^`]+", Scope: "string.quoted.raw"},
+		},
+		"string": {
+			{Pattern: `"`, Scope: "string.quoted.double", Pop: true},
+			{Pattern: `\\(?:[abfnrtv\\'"]|[0-7]{3}|x[0-9a-fA-F]{2}|u[0-9a-fA-F]{4}|U[0-9a-fA-F]{8})`, Scope: "constant.character.escape"},
+			{Pattern: `%[-+# 0]*(?:\d+|\*)?(?:\.(?:\d+|\*))?[a-zA-Z%]`, Scope: "constant.other.placeholder"},
+			{Pattern: `[^"\\%]+|[\\%]`, Scope: "string.quoted.double"},
+			// Go strings can't run over a line, so an unfinished one ends at the end of the line
+			{Pattern: `$`, Scope: "invalid", Pop: true},
+		},
+	},
+}
+
+// JSON documents
+var JSONGrammar = &Grammar{
+	Name:       "JSON",
+	Extensions: []string{".json"},
+	States: map[string][]Rule{
+		"root": {
+			{Pattern: `\s+`},
+			{Pattern: `(` + jsonString + `)(\s*)(:)`, Groups: []string{"support.type.property-name", "", "punctuation"}},
+			{Pattern: jsonString, Scope: "string.quoted.double"},
+			{Pattern: `-?(?:0|[1-9]\d*)(?:\.\d+)?(?:[eE][+-]?\d+)?`, Scope: "constant.numeric"},
+			{Pattern: `\b(?:true|false|null)\b`, Scope: "constant.language"},
+			{Pattern: `[{}\[\],:]`, Scope: "punctuation"},
+			{Pattern: `[^\s{}\[\],:"]+|"`, Scope: "invalid"},
+		},
+	},
+}
+
+// Markdown documents.  Only the block structure that can be seen one line at a time, and inline code, emphasis and links
+var MarkdownGrammar = &Grammar{
+	Name:       "Markdown",
+	Extensions: []string{".md", ".markdown"},
+	States: map[string][]Rule{
+		"root": {
+			{Pattern: "\\s*(?:```|~~~).*", Scope: "markup.raw.block", Push: "fence", LineStart: true},
+			{Pattern: `#{1,6}(?:\s.*)?$`, Scope: "markup.heading", LineStart: true},
+			{Pattern: `\s*>.*`, Scope: "markup.quote", LineStart: true},
+			{Pattern: `(?:-\s*){3,}$|(?:\*\s*){3,}$|(?:_\s*){3,}$`, Scope: "meta.separator", LineStart: true},
+			{Pattern: `(\s*)([-*+]|\d+[.)])(\s)`, Groups: []string{"", "markup.list", ""}, LineStart: true},
+			{Pattern: `(?: {4}|\t).*`, Scope: "markup.raw.block", LineStart: true},
+			{Pattern: "`[^`]+`", Scope: "markup.raw.inline"},
+			{Pattern: `\*\*[^*]+\*\*|__[^_]+__`, Scope: "markup.bold"},
+			{Pattern: `\*[^*\s][^*]*\*|\b_[^_\s][^_]*_\b`, Scope: "markup.italic"},
+			{Pattern: `(!?\[)([^\]]*)(\])(\([^)]*\))`, Groups: []string{"punctuation", "string.other.link", "punctuation", "markup.underline.link"}},
+			{Pattern: `<https?://[^>]+>`, Scope: "markup.underline.link"},
+			{Pattern: "[^`*_\\[<!]+"},
+		},
+		"fence": {
+			{Pattern: "\\s*(?:```|~~~)\\s*$", Scope: "markup.raw.block", Pop: true, LineStart: true},
+			{Pattern: `.+`, Scope: "markup.raw.block"},
+		},
+	},
+}
+
+// Shell scripts, for sh and bash
+var ShellGrammar = &Grammar{
+	Name:       "Shell",
+	Extensions: []string{".sh", ".bash", ".zsh"},
+	States: map[string][]Rule{
+		"root": {
+			{Pattern: `\s+`},
+			{Pattern: `#.*`, Scope: "comment.line"},
+			{Pattern: `'`, Scope: "string.quoted.single", Push: "single"},
+			{Pattern: `"`, Scope: "string.quoted.double", Push: "double"},
+			{Pattern: `\b(?:if|then|else|elif|fi|for|while|until|do|done|case|esac|in|function|select|return|break|continue|local|export|readonly|declare|unset|shift|exit|source)\b`, Scope: "keyword"},
+			{Pattern: `\b(?:alias|bg|cd|command|echo|eval|exec|fg|getopts|jobs|kill|printf|pwd|read|set|test|trap|type|ulimit|umask|wait)\b`, Scope: "support.function.builtin"},
+			{Pattern: `([A-Za-z_]\w*)(\+?=)`, Groups: []string{"variable.other.assignment", "keyword.operator"}},
+			{Pattern: shellVar, Scope: "variable.other"},
+			{Pattern: `\$\(\(?|\)\)?|\$\[|\$`, Scope: "punctuation"},
+			{Pattern: shellEscape, Scope: "constant.character.escape"},
+			{Pattern: `--?[A-Za-z][\w-]*`, Scope: "variable.parameter"},
+			{Pattern: `\b\d+\b`, Scope: "constant.numeric"},
+			{Pattern: `&&|\|\||;;|[|&;<>!]+|\d?>&?\d?`, Scope: "keyword.operator"},
+			{Pattern: `[(){}\[\]]`, Scope: "punctuation"},
+			{Pattern: `[^\s$"'#;&|<>(){}\[\]\\=]+|=`},
+		},
+		"single": {
+			{Pattern: `'`, Scope: "string.quoted.single", Pop: true},
+			{Pattern: `[^']+`, Scope: "string.quoted.single"},
+		},
+		"double": {
+			{Pattern: `"`, Scope: "string.quoted.double", Pop: true},
+			{Pattern: `\\[$"\\` + "`" + `]`, Scope: "constant.character.escape"},
+			{Pattern: shellVar, Scope: "variable.other"},
+			{Pattern: `[^"\\$]+|[\\$]`, Scope: "string.quoted.double"},
+		},
+	},
+}
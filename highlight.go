@@ -0,0 +1,321 @@
+// Syntax highlighting.  Regular expression lexers, in the style of Pygments and Chroma, that turn source code into styled tokens for RenderTokenPara
+package glim
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// One rule of a lexer state.  The first rule that matches at the current position wins
+type Rule struct {
+	Pattern   string   // A regular expression, matched at the current position.  Rules only ever see one line, so they can't match a newline, but "$" matches at the end of it.  A rule that matches nothing only applies if it moves to a state that hasn't been tried at this position
+	Scope     string   // The scope of the matched text, e.g. "keyword" or "string.quoted".  Empty for plain text
+	Groups    []string // If set, the scopes of the pattern's groups, in order.  Text outside the groups gets Scope
+	Push      string   // A state to enter after the match
+	Pop       bool     // Go back to the state before this one after the match
+	LineStart bool     // Only match at the start of a line
+
+	re *regexp.Regexp
+}
+
+// A lexer for one language.  Lexing is line by line, and states carry constructs like block comments from one line to the next
+type Grammar struct {
+	Name       string
+	Extensions []string          // File extensions, including the dot, for FindGrammar
+	States     map[string][]Rule // Lexing starts in "root"
+
+	once sync.Once
+	err  error
+}
+
+// Compile the rules' patterns, once
+func (g *Grammar) compile() error {
+	g.once.Do(func() {
+		for name, rules := range g.States {
+			for i := range rules {
+				re, err := regexp.Compile(`^(?:` + rules[i].Pattern + `)`)
+				if err != nil {
+					g.err = fmt.Errorf("grammar %v, state %v: %w", g.Name, name, err)
+					return
+				}
+				rules[i].re = re
+			}
+		}
+		if _, ok := g.States["root"]; !ok {
+			g.err = fmt.Errorf("grammar %v has no root state", g.Name)
+		}
+	})
+	return g.err
+}
+
+// A piece of a line with one scope
+type scopeSpan struct {
+	end   int // Byte offset in the line where the span ends
+	scope string
+}
+
+// Split a line into scoped spans, starting in state (a stack of state names, innermost last).  Returns the spans and the state at the end of the line
+func (g *Grammar) lexLine(line string, state []string) ([]scopeSpan, []string) {
+	state = append([]string{}, state...)
+	spans := []scopeSpan{}
+	add := func(end int, scope string) {
+		n := len(spans)
+		if end == 0 || (n > 0 && end <= spans[n-1].end) {
+			return
+		}
+		if n > 0 && spans[n-1].scope == scope {
+			spans[n-1].end = end
+			return
+		}
+		spans = append(spans, scopeSpan{end, scope})
+	}
+	pos := 0
+	// The states already entered at pos.  A rule that matches nothing has to move to a state not tried yet, so rules can't go round in circles without reading anything
+	visited := map[string]bool{state[len(state)-1]: true}
+	// Apply the first of the current state's rules that matches at pos
+	step := func() bool {
+		for _, rule := range g.States[state[len(state)-1]] {
+			if rule.LineStart && pos > 0 {
+				continue
+			}
+			m := rule.re.FindStringSubmatchIndex(line[pos:])
+			if m == nil {
+				continue
+			}
+			next := state
+			if rule.Pop && len(next) > 1 {
+				next = next[:len(next)-1]
+			}
+			if rule.Push != "" {
+				next = append(next[:len(next):len(next)], rule.Push)
+			}
+			if m[1] == 0 && visited[next[len(next)-1]] {
+				continue
+			}
+			for k, scope := range rule.Groups {
+				if 2*k+3 >= len(m) || m[2*k+2] < 0 {
+					continue
+				}
+				add(pos+m[2*k+2], rule.Scope)
+				add(pos+m[2*k+3], scope)
+			}
+			add(pos+m[1], rule.Scope)
+			if m[1] > 0 {
+				pos += m[1]
+				visited = map[string]bool{}
+			}
+			state = next
+			visited[state[len(state)-1]] = true
+			return true
+		}
+		return false
+	}
+	for pos < len(line) {
+		if !step() {
+			// Nothing matched, so the next character is plain text
+			_, size := utf8.DecodeRuneInString(line[pos:])
+			pos += size
+			add(pos, "")
+			visited = map[string]bool{state[len(state)-1]: true}
+		}
+	}
+	// Rules that match at the end of the line, like "$" ending an unfinished string, still change the state
+	for step() {
+	}
+	return spans, state
+}
+
+// All the grammars that FindGrammar knows
+var Grammars = []*Grammar{GoGrammar, JSONGrammar, MarkdownGrammar, ShellGrammar}
+
+// Find a grammar by its name (ignoring case), or by the extension of a file name.  Returns nil if there isn't one
+func FindGrammar(name string) *Grammar {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, g := range Grammars {
+		if strings.EqualFold(g.Name, name) {
+			return g
+		}
+		for _, e := range g.Extensions {
+			if e == ext {
+				return g
+			}
+		}
+	}
+	return nil
+}
+
+// Highlights a text, and keeps it highlighted as it is edited.  Each line remembers the lexer state it starts in, so an edit only re-lexes the lines it touched, and the lines after them whose state changed (e.g. after typing "/*")
+type Highlighter struct {
+	Grammar *Grammar
+	Theme   *Theme // nil for DefaultTheme
+
+	lines    []string      // Without their newlines
+	newlines []string      // The newline after each line, "" for the last one
+	states   [][]string    // The lexer state at the start of each line
+	spans    [][]scopeSpan // The scoped pieces of each line
+}
+
+// Create a highlighter for text written in g
+func NewHighlighter(g *Grammar, theme *Theme, text string) (*Highlighter, error) {
+	if err := g.compile(); err != nil {
+		return nil, err
+	}
+	h := &Highlighter{Grammar: g, Theme: theme}
+	h.SetText(text)
+	return h, nil
+}
+
+// Highlight text in one go
+func Highlight(g *Grammar, theme *Theme, text string) ([]Token, error) {
+	h, err := NewHighlighter(g, theme, text)
+	if err != nil {
+		return nil, err
+	}
+	return h.Tokens(), nil
+}
+
+// Split text into lines and newlines
+func splitTextLines(text string) ([]string, []string) {
+	lines := strings.Split(text, "\n")
+	newlines := make([]string, len(lines))
+	for i := range lines[:len(lines)-1] {
+		newlines[i] = "\n"
+		if strings.HasSuffix(lines[i], "\r") {
+			lines[i] = lines[i][:len(lines[i])-1]
+			newlines[i] = "\r\n"
+		}
+	}
+	return lines, newlines
+}
+
+// Replace the whole text, and highlight all of it
+func (h *Highlighter) SetText(text string) {
+	h.lines, h.newlines = splitTextLines(text)
+	h.states = make([][]string, len(h.lines))
+	h.spans = make([][]scopeSpan, len(h.lines))
+	h.states[0] = []string{"root"}
+	h.relex(0, len(h.lines))
+}
+
+// Lex from line first on, until past line last and back in step with the old states.  Returns the line after the last one that was lexed
+func (h *Highlighter) relex(first, last int) int {
+	state := h.states[first]
+	for i := first; i < len(h.lines); i++ {
+		h.states[i] = state
+		h.spans[i], state = h.Grammar.lexLine(h.lines[i], state)
+		if i+1 < len(h.lines) && i >= last && sameState(state, h.states[i+1]) {
+			return i + 1
+		}
+	}
+	return len(h.lines)
+}
+
+func sameState(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The number of lines
+func (h *Highlighter) Lines() int {
+	return len(h.lines)
+}
+
+// Replace count lines, starting at first, with lines (which have no newlines), and re-highlight.  Returns the lines whose highlighting may have changed, from start up to end
+func (h *Highlighter) ReplaceLines(first, count int, lines []string) (int, int) {
+	if first > len(h.lines) {
+		first = len(h.lines)
+	}
+	if first+count > len(h.lines) {
+		count = len(h.lines) - first
+	}
+	// The new lines end with newlines, except that the last one takes over the ending of the last line it replaced
+	tail := "\n"
+	if count > 0 {
+		tail = h.newlines[first+count-1]
+	} else if first == len(h.lines) {
+		tail = ""
+	}
+	if first > 0 && first+count == len(h.lines) {
+		h.newlines[first-1] = "\n"
+		if len(lines) == 0 {
+			h.newlines[first-1] = tail
+		}
+	}
+	newlines := make([]string, len(lines))
+	for i := range newlines {
+		newlines[i] = "\n"
+	}
+	if len(newlines) > 0 {
+		newlines[len(newlines)-1] = tail
+	}
+	var state []string
+	if first < len(h.lines) {
+		state = h.states[first]
+	} else {
+		_, state = h.Grammar.lexLine(h.lines[first-1], h.states[first-1])
+	}
+	h.lines = append(h.lines[:first], append(append([]string{}, lines...), h.lines[first+count:]...)...)
+	h.newlines = append(h.newlines[:first], append(newlines, h.newlines[first+count:]...)...)
+	h.states = append(h.states[:first], append(make([][]string, len(lines)), h.states[first+count:]...)...)
+	h.spans = append(h.spans[:first], append(make([][]scopeSpan, len(lines)), h.spans[first+count:]...)...)
+	if len(h.lines) == 0 {
+		h.SetText("")
+		return 0, 1
+	}
+	if first >= len(h.lines) {
+		return first, first
+	}
+	h.states[first] = state
+	return first, h.relex(first, first+len(lines)-1)
+}
+
+func (h *Highlighter) theme() *Theme {
+	if h.Theme == nil {
+		return DefaultTheme
+	}
+	return h.Theme
+}
+
+// The style of the text at a byte offset in a line
+func (h *Highlighter) styleAt(line, offset int) Style {
+	for _, span := range h.spans[line] {
+		if offset < span.end {
+			return h.theme().StyleFor(span.scope)
+		}
+	}
+	return h.theme().Default
+}
+
+// The tokens for one line, one per grapheme cluster like RenderPara's, not including its newline
+func (h *Highlighter) LineTokens(line int) []Token {
+	out := []Token{}
+	offset := 0
+	for _, g := range Graphemes(h.lines[line]) {
+		out = append(out, Token{g, h.styleAt(line, offset)})
+		offset += len(g)
+	}
+	return out
+}
+
+// The whole text as tokens, one per grapheme cluster, ready for RenderTokenPara
+func (h *Highlighter) Tokens() []Token {
+	out := []Token{}
+	for i := range h.lines {
+		out = append(out, h.LineTokens(i)...)
+		if h.newlines[i] != "" {
+			out = append(out, Token{h.newlines[i], h.theme().Default})
+		}
+	}
+	return out
+}
@@ -0,0 +1,144 @@
+package glim
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// The scope of every byte of each line, and the state each line starts in
+func lexScopes(t *testing.T, h *Highlighter) ([][]string, [][]string) {
+	t.Helper()
+	scopes := [][]string{}
+	for i, line := range h.lines {
+		out := make([]string, len(line))
+		k := 0
+		for _, span := range h.spans[i] {
+			for ; k < span.end; k++ {
+				out[k] = span.scope
+			}
+		}
+		scopes = append(scopes, out)
+	}
+	return scopes, h.states
+}
+
+func TestLexerStateAcrossLines(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		states [][]string // The state each line starts in
+		check  func(t *testing.T, scopes [][]string)
+	}{
+		{"unterminated string ends at the end of its line", "x := \"abc\ny := 1", [][]string{{"root"}, {"root"}}, func(t *testing.T, scopes [][]string) {
+			if scopes[0][6] != "string.quoted.double" {
+				t.Errorf("string scope %q", scopes[0][6])
+			}
+			if scopes[1][0] != "" || scopes[1][5] != "constant.numeric" {
+				t.Errorf("next line lexed as %q", scopes[1])
+			}
+		}},
+		{"block comment carries on", "a /* one\ntwo\nthree */ b", [][]string{{"root"}, {"root", "comment"}, {"root", "comment"}}, func(t *testing.T, scopes [][]string) {
+			if scopes[1][0] != "comment.block" || scopes[2][7] != "comment.block" {
+				t.Errorf("comment scopes %q %q", scopes[1], scopes[2])
+			}
+			if scopes[2][9] != "" {
+				t.Errorf("text after the comment is %q", scopes[2][9])
+			}
+		}},
+		{"raw string carries on", "s := `a\nb` + 1", [][]string{{"root"}, {"root", "rawString"}}, func(t *testing.T, scopes [][]string) {
+			if scopes[1][0] != "string.quoted.raw" || scopes[1][5] != "constant.numeric" {
+				t.Errorf("raw string scopes %q", scopes[1])
+			}
+		}},
+		{"finished string", `x := "a" + "b"` + "\nfunc", [][]string{{"root"}, {"root"}}, func(t *testing.T, scopes [][]string) {
+			if scopes[1][0] != "keyword" {
+				t.Errorf("keyword scope %q", scopes[1][0])
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := NewHighlighter(GoGrammar, nil, tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			scopes, states := lexScopes(t, h)
+			if !reflect.DeepEqual(states, tt.states) {
+				t.Errorf("states %v, want %v", states, tt.states)
+			}
+			tt.check(t, scopes)
+		})
+	}
+}
+
+func TestHighlighterRelexesOnlyWhatChanged(t *testing.T) {
+	lines := []string{"package main", "", "var a = 1", "var b = \"x\"", "var c = 3", "var d = 4"}
+	h, err := NewHighlighter(GoGrammar, nil, strings.Join(lines, "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Typing inside a string only re-lexes that line, even while the string is unfinished
+	start, end := h.ReplaceLines(3, 1, []string{"var b = \"x"})
+	if start != 3 || end != 4 {
+		t.Errorf("unterminated string re-lexed lines %v to %v, want 3 to 4", start, end)
+	}
+	// Opening a block comment re-lexes to the end of the text
+	start, end = h.ReplaceLines(2, 1, []string{"var a = 1 /*"})
+	if start != 2 || end != len(lines) {
+		t.Errorf("opening a comment re-lexed lines %v to %v, want 2 to %v", start, end, len(lines))
+	}
+	if got := h.states[5]; !reflect.DeepEqual(got, []string{"root", "comment"}) {
+		t.Errorf("last line starts in %v", got)
+	}
+	// and so does closing it
+	start, end = h.ReplaceLines(2, 1, []string{"var a = 1 /* */"})
+	if start != 2 || end != len(lines) {
+		t.Errorf("closing the comment re-lexed lines %v to %v, want 2 to %v", start, end, len(lines))
+	}
+	// After that, lexing stops as soon as the states agree again
+	start, end = h.ReplaceLines(4, 1, []string{"var c = 33"})
+	if start != 4 || end != 5 {
+		t.Errorf("changing a number re-lexed lines %v to %v, want 4 to 5", start, end)
+	}
+}
+
+// Rules that match nothing can't send the lexer round in circles
+func TestLexerEmptyMatches(t *testing.T) {
+	tests := []struct {
+		name   string
+		states map[string][]Rule
+		want   []string
+	}{
+		{"pop at the bottom of the stack", map[string][]Rule{
+			"root": {{Pattern: ``, Pop: true}, {Pattern: `x`, Scope: "x"}},
+		}, []string{"root"}},
+		{"push the same state", map[string][]Rule{
+			"root": {{Pattern: ``, Push: "root"}, {Pattern: `x`, Scope: "x"}},
+		}, []string{"root"}},
+		{"two states pushing and popping", map[string][]Rule{
+			"root": {{Pattern: `(?:)`, Push: "a"}},
+			"a":    {{Pattern: ``, Pop: true}, {Pattern: `x`, Scope: "x"}},
+		}, []string{"root", "a"}},
+		{"end of line pops", map[string][]Rule{
+			"root": {{Pattern: `"`, Push: "str"}, {Pattern: `x`, Scope: "x"}},
+			"str":  {{Pattern: `$`, Pop: true}, {Pattern: `[^"]+`, Scope: "string"}},
+		}, []string{"root"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &Grammar{Name: tt.name, States: tt.states}
+			if err := g.compile(); err != nil {
+				t.Fatal(err)
+			}
+			line := `xx"x`
+			spans, state := g.lexLine(line, []string{"root"})
+			if len(spans) == 0 || spans[len(spans)-1].end != len(line) {
+				t.Errorf("spans %v don't cover the line", spans)
+			}
+			if !reflect.DeepEqual(state, tt.want) {
+				t.Errorf("state %v, want %v", state, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,214 @@
+// Paragraph layout.  Where every character goes, worked out once, so it can be painted, hit tested and navigated without measuring the text again
+package glim
+
+import (
+	"image"
+	"image/draw"
+)
+
+// A laid out character
+type LayoutGlyph struct {
+	Index    int             // The token it draws
+	Rect     image.Rectangle // The character's box, its advance across and its line height down
+	Baseline int             // y of the baseline the character sits on
+	Line     int             // Index into Layout.Lines
+	Level    int             // Bidi embedding level, odd for right-to-left
+
+	// How to draw it
+	text     string        // Already reversed for right-to-left.  Empty if there is nothing to draw
+	shaped   []ShapedGlyph // Used instead of text, when the paragraph was shaped
+	fontName string
+	size     float64
+	colour   RGBA
+	originX  int // Where the pen starts in the rendered image
+
+	fakeBold, fakeItalic bool
+	style                Style // For the decorations
+	tab                  bool  // Drawn as an arrow, if FormatParams.ShowTabs is set
+}
+
+// A laid out line (or column, for vertical text)
+type LayoutLine struct {
+	Rect       image.Rectangle // Encloses the line's characters and carets
+	Baseline   int             // y of the baseline.  Vertical columns don't share a baseline, so for them it is the x of the column's left edge
+	Start, End int             // The tokens on the line, End not included.  A hard line includes its newline
+	Pitch      int             // The distance to the next line down (or column to the left)
+}
+
+// The result of laying out a paragraph, see LayoutTokenPara
+type Layout struct {
+	Glyphs     []LayoutGlyph     // In display order, line by line.  Newlines don't get a glyph
+	Lines      []LayoutLine      // In order down the page (or right to left, for vertical text)
+	TokenGlyph []int             // For each token from First on, its index in Glyphs.  -1 if it wasn't laid out.  Use GlyphOf
+	Carets     []image.Rectangle // For each cursor position from First on, the box the cursor is drawn in.  Empty if the position wasn't laid out.  Use Caret
+	First      int               // The first token laid out
+	Last       int               // The last token that fit
+	Count      int               // The number of tokens in the whole text
+	EndX, EndY int               // The pen position where layout stopped
+	Vertical   bool
+	Clip       image.Rectangle // Paint doesn't draw outside this box
+
+	tokens tokenView  // The whole text, for finding words
+	index  *LineIndex // For finding hard lines in tokens, can be nil
+}
+
+// The caret box for a cursor position, and whether that position was laid out
+func (l *Layout) Caret(index int) (image.Rectangle, bool) {
+	index -= l.First
+	if index < 0 || index >= len(l.Carets) || l.Carets[index].Empty() {
+		return image.Rectangle{}, false
+	}
+	return l.Carets[index], true
+}
+
+// The glyph drawing token index, and whether it was laid out
+func (l *Layout) GlyphOf(index int) (LayoutGlyph, bool) {
+	index -= l.First
+	if index < 0 || index >= len(l.TokenGlyph) || l.TokenGlyph[index] < 0 {
+		return LayoutGlyph{}, false
+	}
+	return l.Glyphs[l.TokenGlyph[index]], true
+}
+
+func (l *Layout) setCaret(index int, caret image.Rectangle) {
+	for len(l.Carets) <= index-l.First {
+		l.Carets = append(l.Carets, image.Rectangle{})
+	}
+	l.Carets[index-l.First] = caret
+}
+
+func (l *Layout) setTokenGlyph(index, glyph int) {
+	for len(l.TokenGlyph) <= index-l.First {
+		l.TokenGlyph = append(l.TokenGlyph, -1)
+	}
+	l.TokenGlyph[index-l.First] = glyph
+}
+
+// The index of the line holding cursor position index, or -1 if it wasn't laid out
+func (l *Layout) LineOf(index int) int {
+	for i, line := range l.Lines {
+		if index >= line.Start && index < line.End {
+			return i
+		}
+	}
+	if len(l.Lines) > 0 && index == l.Lines[len(l.Lines)-1].End {
+		return len(l.Lines) - 1
+	}
+	return -1
+}
+
+// Find the cursor position for a point, e.g. a mouse click.  A point inside a character gives that character, otherwise the nearest caret wins
+func (l *Layout) HitTest(x, y int) int {
+	pt := image.Point{x, y}
+	for _, g := range l.Glyphs {
+		if pt.In(g.Rect) {
+			return g.Index
+		}
+	}
+	best := l.First
+	bestDist := 9999999
+	for i, caret := range l.Carets {
+		if caret.Empty() {
+			continue
+		}
+		dx := x - caret.Min.X
+		dy := y - (caret.Min.Y+caret.Max.Y)/2
+		if d := dx*dx + dy*dy; d < bestDist {
+			bestDist = d
+			best = l.First + i
+		}
+	}
+	return best
+}
+
+// Move everything by dx, dy
+func (l *Layout) shift(dx, dy int) {
+	if dx == 0 && dy == 0 {
+		return
+	}
+	d := image.Pt(dx, dy)
+	for i := range l.Glyphs {
+		l.Glyphs[i].Rect = l.Glyphs[i].Rect.Add(d)
+		l.Glyphs[i].Baseline += dy
+	}
+	for i := range l.Lines {
+		l.Lines[i].Rect = l.Lines[i].Rect.Add(d)
+		if l.Vertical {
+			l.Lines[i].Baseline += dx
+		} else {
+			l.Lines[i].Baseline += dy
+		}
+	}
+	for i := range l.Carets {
+		if !l.Carets[i].Empty() {
+			l.Carets[i] = l.Carets[i].Add(d)
+		}
+	}
+	l.EndX += dx
+	l.EndY += dy
+}
+
+// Paste img with its top left at x, y, leaving out anything outside clip
+func pasteClipped(img *image.RGBA, x, y int, clip image.Rectangle, pixWidth, pixHeight int, u8Pix []uint8) {
+	at := image.Pt(x, y)
+	r := img.Bounds().Add(at).Intersect(clip)
+	if r.Empty() {
+		return
+	}
+	if r != img.Bounds().Add(at) {
+		part := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+		draw.Draw(part, part.Bounds(), img, r.Min.Sub(at), draw.Src)
+		img = part
+	}
+	PasteBytes(img.Bounds().Max.X, img.Bounds().Max.Y, img.Pix, r.Min.X, r.Min.Y, pixWidth, pixHeight, u8Pix, true, false, false)
+}
+
+// Draw the layout.  The selection and cursor come from f, so moving them only needs a repaint, not a new layout.
+//
+// The formatter's background colour goes down first, then the tokens' backgrounds, then the selection, then text effects (see TextEffects), then the text, then underlines, strikethrough and boxes
+func (l *Layout) Paint(f *FormatParams, pixWidth, pixHeight int, u8Pix []uint8, showCursor bool) {
+	selStart := f.SelectStart
+	selEnd := f.SelectEnd
+	hasSelection := selStart >= 0 && selEnd >= 0 && selStart != selEnd
+	if hasSelection && selStart > selEnd {
+		selStart, selEnd = selEnd, selStart
+	}
+	selected := func(g LayoutGlyph) bool {
+		return hasSelection && g.Index >= selStart && g.Index <= selEnd
+	}
+	if f.BackgroundColour != nil {
+		fillClipped(l.Clip, l.Clip, pixWidth, pixHeight, u8Pix, f.BackgroundColour)
+	}
+	l.paintBackgrounds(pixWidth, pixHeight, u8Pix)
+	for _, g := range l.Glyphs {
+		if selected(g) {
+			fillClipped(l.cell(g), l.Clip, pixWidth, pixHeight, u8Pix, f.HighlightColour)
+		}
+	}
+	colourOf := func(g LayoutGlyph) RGBA {
+		if selected(g) && f.SelectColour != nil {
+			return *f.SelectColour
+		}
+		return g.colour
+	}
+	l.paintEffects(f.Effects, colourOf, pixWidth, pixHeight, u8Pix)
+	for _, g := range l.Glyphs {
+		colour := colourOf(g)
+		if g.tab {
+			if f.ShowTabs {
+				l.paintTab(g, pixWidth, pixHeight, u8Pix, &colour)
+			}
+			continue
+		}
+		if img, originX, _ := g.image(colour); img != nil {
+			pasteClipped(img, g.Rect.Min.X-originX, g.Baseline-textBaseline(g.size), l.Clip, pixWidth, pixHeight, u8Pix)
+		}
+	}
+	l.paintDecorations(pixWidth, pixHeight, u8Pix)
+	if caret, ok := l.Caret(f.Cursor); ok && showCursor {
+		caret = caret.Intersect(l.Clip)
+		if !caret.Empty() {
+			DrawCursor(caret.Min.X, caret.Min.Y, caret.Dy(), pixWidth, u8Pix, f.CursorColour)
+		}
+	}
+}
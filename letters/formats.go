@@ -0,0 +1,199 @@
+// formats.go
+//
+// The output formats: AngelCode BMFont, JSON atlas metadata and packed C arrays
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/donomii/glim"
+)
+
+// Write the atlas pages as PNGs, and return their file names (without the directory, as the metadata refers to them)
+func writePages(f *bakedFont, out string) ([]string, error) {
+	names := []string{}
+	for i, page := range f.Pages {
+		name := fmt.Sprintf("%v_%v.png", out, i)
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, page); err != nil {
+			return nil, err
+		}
+		if err := writeFile(name, buf.Bytes()); err != nil {
+			return nil, err
+		}
+		names = append(names, filepath.Base(name))
+	}
+	return names, nil
+}
+
+// Write an AngelCode BMFont text file (see angelcode.com/products/bmfont/doc/file_format.html) and its pages
+func writeBMFont(f *bakedFont, out string) error {
+	pages, err := writePages(f, out)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	size := f.Pages[0].Bounds().Size()
+	fmt.Fprintf(&b, "info face=%q size=%v bold=0 italic=0 charset=\"\" unicode=1 stretchH=100 smooth=1 aa=1 padding=0,0,0,0 spacing=1,1\n", filepath.Base(f.Name), int(f.Size+0.5))
+	fmt.Fprintf(&b, "common lineHeight=%v base=%v scaleW=%v scaleH=%v pages=%v packed=0\n", f.LineHeight, f.Base, size.X, size.Y, len(pages))
+	for i, name := range pages {
+		fmt.Fprintf(&b, "page id=%v file=%q\n", i, name)
+	}
+	fmt.Fprintf(&b, "chars count=%v\n", len(f.Glyphs))
+	for _, g := range f.Glyphs {
+		fmt.Fprintf(&b, "char id=%v x=%v y=%v width=%v height=%v xoffset=%v yoffset=%v xadvance=%v page=%v chnl=15\n",
+			g.Rune, g.Pos.X, g.Pos.Y, g.Mask.Bounds().Dx(), g.Mask.Bounds().Dy(), g.Bearing.X, f.Base+g.Bearing.Y, g.Advance, g.Page)
+	}
+	if len(f.Kerning) > 0 {
+		fmt.Fprintf(&b, "kernings count=%v\n", len(f.Kerning))
+		for _, k := range f.Kerning {
+			fmt.Fprintf(&b, "kerning first=%v second=%v amount=%v\n", k.First, k.Second, k.Amount)
+		}
+	}
+	return writeFile(out+".fnt", []byte(b.String()))
+}
+
+type jsonGlyph struct {
+	ID       rune   `json:"id"`
+	Char     string `json:"char"`
+	Page     int    `json:"page"`
+	X        int    `json:"x"`
+	Y        int    `json:"y"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	XOffset  int    `json:"xOffset"`
+	YOffset  int    `json:"yOffset"`
+	XAdvance int    `json:"xAdvance"`
+}
+
+type jsonKern struct {
+	First  rune `json:"first"`
+	Second rune `json:"second"`
+	Amount int  `json:"amount"`
+}
+
+type jsonAtlas struct {
+	Font       string      `json:"font"`
+	Size       float64     `json:"size"`
+	LineHeight int         `json:"lineHeight"`
+	Base       int         `json:"base"`
+	PageWidth  int         `json:"pageWidth"`
+	PageHeight int         `json:"pageHeight"`
+	Pages      []string    `json:"pages"`
+	Glyphs     []jsonGlyph `json:"glyphs"`
+	Kerning    []jsonKern  `json:"kerning"`
+}
+
+// Write JSON atlas metadata and its pages.  Offsets are like BMFont's: yOffset is from the top of the line
+func writeJSON(f *bakedFont, out string) error {
+	pages, err := writePages(f, out)
+	if err != nil {
+		return err
+	}
+	size := f.Pages[0].Bounds().Size()
+	atlas := jsonAtlas{Font: filepath.Base(f.Name), Size: f.Size, LineHeight: f.LineHeight, Base: f.Base, PageWidth: size.X, PageHeight: size.Y, Pages: pages, Glyphs: []jsonGlyph{}, Kerning: []jsonKern{}}
+	for _, g := range f.Glyphs {
+		atlas.Glyphs = append(atlas.Glyphs, jsonGlyph{g.Rune, string(g.Rune), g.Page, g.Pos.X, g.Pos.Y, g.Mask.Bounds().Dx(), g.Mask.Bounds().Dy(), g.Bearing.X, f.Base + g.Bearing.Y, g.Advance})
+	}
+	for _, k := range f.Kerning {
+		atlas.Kerning = append(atlas.Kerning, jsonKern{k.First, k.Second, k.Amount})
+	}
+	data, err := json.MarshalIndent(atlas, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFile(out+".json", append(data, '\n'))
+}
+
+// Pack a glyph's coverage at bpp bits per pixel, row after row with no padding between rows, most significant bits first.  The last byte is padded with zeros
+func packBits(pix []uint8, bpp int) []byte {
+	out := []byte{}
+	acc, n := 0, 0
+	for _, a := range pix {
+		acc = acc<<uint(bpp) | int(a)>>uint(8-bpp)
+		n += bpp
+		if n == 8 {
+			out = append(out, byte(acc))
+			acc, n = 0, 0
+		}
+	}
+	if n > 0 {
+		out = append(out, byte(acc<<uint(8-n)))
+	}
+	return out
+}
+
+var notIdentifier = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+// Write a C header holding every glyph's bitmap packed at bpp bits per pixel, with tables of the characters, their sizes, offsets and advances
+func writeC(f *bakedFont, out string, bpp int) error {
+	if bpp != 1 && bpp != 4 && bpp != 8 {
+		return fmt.Errorf("-bpp must be 1, 4 or 8, not %v", bpp)
+	}
+	name := notIdentifier.ReplaceAllString(filepath.Base(out), "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "font_" + name
+	}
+	upper := strings.ToUpper(name)
+	var b strings.Builder
+	fmt.Fprintf(&b, "// %v at %v, %v bits per pixel.  Made by letters\n", filepath.Base(f.Name), f.Size, bpp)
+	fmt.Fprintf(&b, "//\n// Each glyph's pixels are packed row after row, most significant bits first, with no padding between rows.\n")
+	fmt.Fprintf(&b, "// Draw a glyph with its top left at (pen x + x_offset, baseline + y_offset), then move the pen on by advance\n\n")
+	fmt.Fprintf(&b, "#ifndef %v_H\n#define %v_H\n\n#include <stdint.h>\n\n", upper, upper)
+	fmt.Fprintf(&b, "#define %v_BPP %v\n#define %v_LINE_HEIGHT %v\n#define %v_BASELINE %v\n#define %v_GLYPH_COUNT %v\n\n", upper, bpp, upper, f.LineHeight, upper, f.Base, upper, len(f.Glyphs))
+	fmt.Fprintf(&b, "typedef struct {\n\tuint32_t codepoint;\n\tuint32_t offset; // Into %v_bitmaps\n\tuint16_t width, height;\n\tint16_t x_offset, y_offset; // From the pen position on the baseline\n\tint16_t advance;\n} %v_glyph_t;\n\n", name, name)
+
+	fmt.Fprintf(&b, "static const uint8_t %v_bitmaps[] = {\n", name)
+	offsets := make([]int, len(f.Glyphs))
+	offset := 0
+	for i, g := range f.Glyphs {
+		offsets[i] = offset
+		data := packBits(g.Mask.Pix, bpp)
+		if len(data) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "\t// U+%04X %q\n", g.Rune, g.Rune)
+		for k := 0; k < len(data); k += 16 {
+			b.WriteString("\t")
+			for _, v := range data[k:glim.MinI(k+16, len(data))] {
+				fmt.Fprintf(&b, "0x%02x, ", v)
+			}
+			b.WriteString("\n")
+		}
+		offset += len(data)
+	}
+	if offset == 0 {
+		b.WriteString("\t0\n")
+	}
+	b.WriteString("};\n\n")
+
+	fmt.Fprintf(&b, "// Sorted by codepoint, for a binary search\nstatic const %v_glyph_t %v_glyphs[] = {\n", name, name)
+	for i, g := range f.Glyphs {
+		fmt.Fprintf(&b, "\t{0x%04X, %v, %v, %v, %v, %v, %v},\n", g.Rune, offsets[i], g.Mask.Bounds().Dx(), g.Mask.Bounds().Dy(), g.Bearing.X, g.Bearing.Y, g.Advance)
+	}
+	b.WriteString("};\n\n")
+
+	// The same widths and advances again as plain arrays, for code that only needs to measure text
+	fmt.Fprintf(&b, "static const uint16_t %v_widths[] = {", name)
+	for i, g := range f.Glyphs {
+		if i%16 == 0 {
+			b.WriteString("\n\t")
+		}
+		fmt.Fprintf(&b, "%v, ", g.Mask.Bounds().Dx())
+	}
+	fmt.Fprintf(&b, "\n};\n\nstatic const int16_t %v_advances[] = {", name)
+	for i, g := range f.Glyphs {
+		if i%16 == 0 {
+			b.WriteString("\n\t")
+		}
+		fmt.Fprintf(&b, "%v, ", g.Advance)
+	}
+	fmt.Fprintf(&b, "\n};\n\n#endif\n")
+	return writeFile(out+".h", []byte(b.String()))
+}
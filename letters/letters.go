@@ -1,14 +1,199 @@
 // letters.go
+//
+// Bakes a font into bitmaps: AngelCode BMFont (.fnt and PNG pages), JSON atlas metadata with PNG pages, or packed C arrays for microcontroller displays.
+//
+//	letters -font DejaVuSans.ttf -size 16 -ranges 32-126,0xA0-0xFF -format c -bpp 4 -out dejavu16
 package main
 
 import (
+	"flag"
 	"fmt"
-	//	"log"
+	"image"
+	"image/draw"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/donomii/glim"
-	//"github.com/donomii/goof"
 )
 
+// A glyph ready to write out, with its place in the atlas
+type bakedGlyph struct {
+	glim.GlyphBitmap
+	Page    int
+	Pos     image.Point // Top left of the glyph in its page
+	Advance int         // Rounded to whole pixels
+}
+
+// A whole baked font
+type bakedFont struct {
+	Name       string // The font, as given on the command line
+	Size       float64
+	LineHeight int
+	Base       int // The distance from the top of a line to the baseline
+	Glyphs     []bakedGlyph
+	Pages      []*image.RGBA
+	Kerning    []kernPair
+}
+
+type kernPair struct {
+	First, Second rune
+	Amount        int
+}
+
+func main() {
+	fontName := flag.String("font", "goregular", "Font file to bake, or the name of a registered font (gomono, goregular, ...)")
+	size := flag.Float64("size", 16, "Font size, in points.  With the default -dpi of 72 this is in pixels")
+	dpi := flag.Float64("dpi", 72, "Dots per inch used to turn -size into pixels")
+	ranges := flag.String("ranges", "32-126", "Characters to bake, as a comma separated list of code points and ranges, in decimal or 0x hex, e.g. 32-126,0xA0-0xFF,0x2022")
+	format := flag.String("format", "bmfont", "Output format: bmfont (.fnt and PNG pages), json (.json and PNG pages), c (a .h file of packed bitmaps) or strings (the old C functions returning */space strings)")
+	out := flag.String("out", "font", "Output file name, without the extension")
+	bpp := flag.Int("bpp", 1, "Bits per pixel for -format c: 1, 4 or 8")
+	pageSize := flag.Int("page", 256, "Width and height of the atlas pages")
+	padding := flag.Int("padding", 1, "Empty pixels between glyphs in the atlas")
+	kerning := flag.Bool("kerning", true, "Write kerning pairs (bmfont and json).  Slow for large character sets")
+	flag.Parse()
+
+	runes, err := parseRanges(*ranges)
+	if err != nil {
+		log.Fatalf("Bad -ranges: %v", err)
+	}
+	if _, err := glim.LoadFont(*fontName); err != nil {
+		log.Fatalf("Could not load font: %v", err)
+	}
+	glim.SetTextDPI(*dpi)
+
+	if *format == "strings" {
+		writeStrings(*size, runes, *fontName)
+		return
+	}
+	baked, err := bake(*fontName, *size, runes, *pageSize, *padding, *kerning && *format != "c")
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch *format {
+	case "bmfont":
+		err = writeBMFont(baked, *out)
+	case "json":
+		err = writeJSON(baked, *out)
+	case "c":
+		err = writeC(baked, *out, *bpp)
+	default:
+		err = fmt.Errorf("unknown -format %v", *format)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Parse a list like "32-126,0xA0-0xFF,9731" into sorted code points, without repeats
+func parseRanges(s string) ([]rune, error) {
+	seen := map[rune]bool{}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to := part, part
+		if i := strings.Index(part[1:], "-"); i >= 0 {
+			from, to = part[:i+1], part[i+2:]
+		}
+		lo, err := strconv.ParseInt(strings.TrimSpace(from), 0, 32)
+		if err != nil {
+			return nil, err
+		}
+		hi, err := strconv.ParseInt(strings.TrimSpace(to), 0, 32)
+		if err != nil {
+			return nil, err
+		}
+		if lo < 0 || hi < lo || hi > 0x10FFFF {
+			return nil, fmt.Errorf("bad range %v", part)
+		}
+		for r := lo; r <= hi; r++ {
+			seen[rune(r)] = true
+		}
+	}
+	runes := []rune{}
+	for r := range seen {
+		runes = append(runes, r)
+	}
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+	if len(runes) == 0 {
+		return nil, fmt.Errorf("no characters in %q", s)
+	}
+	return runes, nil
+}
+
+// Rasterise the characters and pack them into atlas pages.  Characters that the font (and its fallbacks) don't have are left out
+func bake(fontName string, size float64, runes []rune, pageSize, padding int, kerning bool) (*bakedFont, error) {
+	_, face := glim.DrawGlyphRGBA(size, glim.RGBA{255, 255, 255, 255}, 'M', fontName)
+	metrics := (*face).Metrics()
+	f := &bakedFont{Name: fontName, Size: size, LineHeight: glim.MaxI(metrics.Height.Ceil(), (metrics.Ascent + metrics.Descent).Ceil()), Base: metrics.Ascent.Ceil()}
+
+	missing := 0
+	for _, r := range runes {
+		_, runFont, err := glim.Fonts.FontForRune(fontName, r)
+		if err != nil {
+			return nil, err
+		}
+		if runFont.Index(r) == 0 {
+			missing++
+			continue
+		}
+		g, err := glim.RasterGlyph(fontName, size, r)
+		if err != nil {
+			return nil, err
+		}
+		f.Glyphs = append(f.Glyphs, bakedGlyph{GlyphBitmap: g, Advance: g.Advance.Round()})
+	}
+	if missing > 0 {
+		log.Printf("Skipped %v characters that %v doesn't have", missing, fontName)
+	}
+	if len(f.Glyphs) == 0 {
+		return nil, fmt.Errorf("%v has none of the characters asked for", fontName)
+	}
+
+	// Pack the tallest glyphs first, so the shelves are filled evenly
+	order := make([]int, len(f.Glyphs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return f.Glyphs[order[a]].Mask.Bounds().Dy() > f.Glyphs[order[b]].Mask.Bounds().Dy()
+	})
+	var packer *glim.ShelfPacker
+	for _, i := range order {
+		g := &f.Glyphs[i]
+		w, h := g.Mask.Bounds().Dx(), g.Mask.Bounds().Dy()
+		pos, ok := image.Point{}, false
+		if packer != nil {
+			pos, ok = packer.Pack(w, h)
+		}
+		if !ok {
+			packer = glim.NewShelfPacker(pageSize, pageSize, padding)
+			f.Pages = append(f.Pages, image.NewRGBA(image.Rect(0, 0, pageSize, pageSize)))
+			if pos, ok = packer.Pack(w, h); !ok {
+				return nil, fmt.Errorf("%q is %vx%v, which doesn't fit on a %v pixel page", g.Rune, w, h, pageSize)
+			}
+		}
+		g.Page, g.Pos = len(f.Pages)-1, pos
+		draw.Draw(f.Pages[g.Page], image.Rectangle{pos, pos.Add(image.Pt(w, h))}, g.RGBA(), image.Point{}, draw.Src)
+	}
+
+	if kerning {
+		for _, a := range f.Glyphs {
+			for _, b := range f.Glyphs {
+				if k := glim.TextKern(size, a.Rune, b.Rune, fontName).Round(); k != 0 {
+					f.Kerning = append(f.Kerning, kernPair{a.Rune, b.Rune, k})
+				}
+			}
+		}
+	}
+	return f, nil
+}
+
 func DumpBuff(buff []uint8, width, height uint) string {
 	out := ""
 	//log.Printf("Dumping buffer with width, height %v,%v\n", width, height)
@@ -29,27 +214,26 @@ func DumpBuff(buff []uint8, width, height uint) string {
 	return out
 }
 
-func main() {
-    size := float64(10)
-
-	img, _ := glim.DrawStringRGBA(size, glim.RGBA{255, 255, 255, 255}, string(64), "f1.ttf")
+// The original output: a C function per character, returning the character drawn in * and space, and a lookup function
+func writeStrings(size float64, runes []rune, fontName string) {
+	img, _ := glim.DrawStringRGBA(size, glim.RGBA{255, 255, 255, 255}, string(rune(64)), fontName)
 	XmaX, YmaX := img.Bounds().Max.X, img.Bounds().Max.Y
 
 	fmt.Printf("#define LETTER_WIDTH %v\n", XmaX/2)
 	fmt.Printf("#define LETTER_HEIGHT %v\n\n\n", YmaX/2)
 
-	for i := 0; i < 256; i++ {
-		img, _ := glim.DrawStringRGBA(size, glim.RGBA{255, 255, 255, 255}, string(i), "f1.ttf")
+	for _, i := range runes {
+		img, _ := glim.DrawStringRGBA(size, glim.RGBA{255, 255, 255, 255}, string(i), fontName)
 		XmaX, YmaX := img.Bounds().Max.X, img.Bounds().Max.Y
 		bts, X, Y := glim.GFormatToImage(img, nil, XmaX, YmaX)
 		//log.Println(bts)
 		letter := DumpBuff(bts, uint(X)/2, uint(Y))
 
-        fmt.Printf("//Width:%v height:%v\n", X, Y)
-		fmt.Println(output_c(i, letter))
+		fmt.Printf("//Width:%v height:%v\n", X, Y)
+		fmt.Println(output_c(int(i), letter))
 
 	}
-	fmt.Println(letterlookup_c())
+	fmt.Println(letterlookup_c(runes))
 }
 
 func output_c(index int, letter string) string {
@@ -59,11 +243,20 @@ func output_c(index int, letter string) string {
 	return out
 }
 
-func letterlookup_c() string {
+func letterlookup_c(runes []rune) string {
 	out := "char * letterlookup(int letter) {\n"
-	for i := 0; i < 256; i++ {
+	for _, i := range runes {
 		out = out + fmt.Sprintf("	if(letter==%v) { return(letter_%v());}\n", i, i)
 	}
 	out = out + "	return(\"whoops\");\n}"
 	return out
 }
+
+// Write a file, or report which one couldn't be written
+func writeFile(name string, data []byte) error {
+	if err := os.WriteFile(name, data, 0644); err != nil {
+		return fmt.Errorf("could not write %v: %w", name, err)
+	}
+	log.Printf("Wrote %v", name)
+	return nil
+}
@@ -0,0 +1,269 @@
+// Line index.  Finds hard lines in a token stream in O(log n), and keeps up with edits without a rescan
+package glim
+
+import "sync/atomic"
+
+// An index of the hard lines (paragraphs) in a list of tokens.
+//
+// Text with n newlines has n+1 lines, and the last line has no newline.  Lines are stored in a treap, ordered by position, where each node knows how many lines and tokens are under it.
+//
+// Only hard lines are indexed.  Soft wrapped lines depend on the font and the width of the box, so finding one still lays out its hard line from the start
+type LineIndex struct {
+	root       *lineNode
+	seed       uint32 // For node priorities
+	generation uint64
+}
+
+// The last generation handed out, shared by every index so no two indexes have the same one
+var lineIndexGeneration uint64
+
+type lineNode struct {
+	length      int // Tokens in the line, including its newline
+	priority    uint32
+	left, right *lineNode
+	lines       int // Lines in this subtree
+	tokens      int // Tokens in this subtree
+}
+
+func (n *lineNode) update() {
+	n.lines = 1
+	n.tokens = n.length
+	if n.left != nil {
+		n.lines += n.left.lines
+		n.tokens += n.left.tokens
+	}
+	if n.right != nil {
+		n.lines += n.right.lines
+		n.tokens += n.right.tokens
+	}
+}
+
+// Build an index for tokens
+func NewLineIndex(tokens []Token) *LineIndex {
+	x := &LineIndex{seed: 2463534242, generation: atomic.AddUint64(&lineIndexGeneration, 1)}
+	x.root = x.build(lineLengths(0, tokens, 0))
+	return x
+}
+
+// Changes every time the index is built or updated, and is never the same for two indexes.  FormatParams.IndexGeneration has to match it before the index is used, so an index for other text, or for an older version of the text, is never trusted
+func (x *LineIndex) Generation() uint64 {
+	return x.generation
+}
+
+// Split text into line lengths.  prefix tokens from an unchanged line go before tokens, and suffix tokens after them
+func lineLengths(prefix int, tokens []Token, suffix int) []int {
+	out := []int{}
+	length := prefix
+	for _, t := range tokens {
+		length++
+		if isNewLine(t.Text) {
+			out = append(out, length)
+			length = 0
+		}
+	}
+	return append(out, length+suffix)
+}
+
+// xorshift, so priorities don't need a lock or the global random source
+func (x *LineIndex) random() uint32 {
+	x.seed ^= x.seed << 13
+	x.seed ^= x.seed >> 17
+	x.seed ^= x.seed << 5
+	return x.seed
+}
+
+// Build a treap from line lengths in O(n), by building the Cartesian tree of random priorities
+func (x *LineIndex) build(lengths []int) *lineNode {
+	stack := []*lineNode{}
+	for _, length := range lengths {
+		n := &lineNode{length: length, priority: x.random()}
+		var last *lineNode
+		for len(stack) > 0 && stack[len(stack)-1].priority < n.priority {
+			last = stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			last.update()
+		}
+		n.left = last
+		if len(stack) > 0 {
+			stack[len(stack)-1].right = n
+		}
+		stack = append(stack, n)
+	}
+	for i := len(stack) - 1; i >= 0; i-- {
+		stack[i].update()
+	}
+	if len(stack) == 0 {
+		return nil
+	}
+	return stack[0]
+}
+
+// Split a treap into its first k lines and the rest
+func splitLines(n *lineNode, k int) (*lineNode, *lineNode) {
+	if n == nil {
+		return nil, nil
+	}
+	leftLines := 0
+	if n.left != nil {
+		leftLines = n.left.lines
+	}
+	if k <= leftLines {
+		a, b := splitLines(n.left, k)
+		n.left = b
+		n.update()
+		return a, n
+	}
+	a, b := splitLines(n.right, k-leftLines-1)
+	n.right = a
+	n.update()
+	return n, b
+}
+
+func mergeLines(a, b *lineNode) *lineNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.priority > b.priority {
+		a.right = mergeLines(a.right, b)
+		a.update()
+		return a
+	}
+	b.left = mergeLines(a, b.left)
+	b.update()
+	return b
+}
+
+// The number of lines
+func (x *LineIndex) Lines() int {
+	if x.root == nil {
+		return 0
+	}
+	return x.root.lines
+}
+
+// The number of tokens
+func (x *LineIndex) Len() int {
+	if x.root == nil {
+		return 0
+	}
+	return x.root.tokens
+}
+
+// The token index where line starts.  Lines past the end start at Len()
+func (x *LineIndex) LineStart(line int) int {
+	if line >= x.Lines() {
+		return x.Len()
+	}
+	pos := 0
+	n := x.root
+	for n != nil {
+		leftLines, leftTokens := 0, 0
+		if n.left != nil {
+			leftLines, leftTokens = n.left.lines, n.left.tokens
+		}
+		switch {
+		case line < leftLines:
+			n = n.left
+		case line == leftLines:
+			return pos + leftTokens
+		default:
+			line -= leftLines + 1
+			pos += leftTokens + n.length
+			n = n.right
+		}
+	}
+	return pos
+}
+
+// The line holding token pos.  Len() is on the last line
+func (x *LineIndex) LineOf(pos int) int {
+	if pos >= x.Len() {
+		return x.Lines() - 1
+	}
+	line := 0
+	n := x.root
+	for n != nil {
+		leftLines, leftTokens := 0, 0
+		if n.left != nil {
+			leftLines, leftTokens = n.left.lines, n.left.tokens
+		}
+		switch {
+		case pos < leftTokens:
+			n = n.left
+		case pos < leftTokens+n.length:
+			return line + leftLines
+		default:
+			pos -= leftTokens + n.length
+			line += leftLines + 1
+			n = n.right
+		}
+	}
+	return line
+}
+
+// The start of the line holding pos, and the end, which is the position of its newline (or Len() for the last line)
+func (x *LineIndex) LineBounds(pos int) (int, int) {
+	line := x.LineOf(pos)
+	start := x.LineStart(line)
+	end := x.LineStart(line + 1)
+	if line < x.Lines()-1 {
+		end--
+	}
+	return start, end
+}
+
+// Update the index after the tokens from start to end were replaced by inserted.  Only the lines touched by the edit are rebuilt
+func (x *LineIndex) Update(start, end int, inserted []Token) {
+	first := x.LineOf(start)
+	last := x.LineOf(end)
+	lineStart := x.LineStart(first)
+	before, rest := splitLines(x.root, first)
+	middle, after := splitLines(rest, last-first+1)
+	oldLength := 0
+	if middle != nil {
+		oldLength = middle.tokens
+	}
+	prefix := start - lineStart
+	suffix := oldLength - (end - lineStart)
+	middle = x.build(lineLengths(prefix, inserted, suffix))
+	x.root = mergeLines(mergeLines(before, middle), after)
+	x.generation = atomic.AddUint64(&lineIndexGeneration, 1)
+}
+
+// f's LineIndex, if it was made for tokens and hasn't changed since.  Tokens from a TextBuffer know which generation they match, and plain slices are checked against f.IndexGeneration.  nil if the index can't be trusted, so lines are found by searching
+func (f *FormatParams) lineIndex(tokens tokenView) *LineIndex {
+	x := f.LineIndex
+	want := tokens.generation
+	if want == 0 {
+		want = f.IndexGeneration
+	}
+	if x == nil || x.Generation() != want || x.Len() != tokens.Len() {
+		return nil
+	}
+	return x
+}
+
+// The hard line holding tokens[pos]: its first token, and the position of its newline (len(tokens) for the last line).  Uses index if it is set (see FormatParams.lineIndex), otherwise searches for newlines
+func lineBounds(index *LineIndex, tokens tokenView, pos int) (int, int) {
+	if pos < 0 {
+		pos = 0
+	}
+	if pos > tokens.Len() {
+		pos = tokens.Len()
+	}
+	if index != nil && index.Len() == tokens.Len() {
+		return index.LineBounds(pos)
+	}
+	start := pos
+	for start > 0 && !isNewLine(tokens.At(start-1).Text) {
+		start--
+	}
+	end := pos
+	for end < tokens.Len() && !isNewLine(tokens.At(end).Text) {
+		end++
+	}
+	return start, end
+}
@@ -0,0 +1,136 @@
+package glim
+
+import (
+	"math/rand"
+	"testing"
+)
+
+func lineTokens(text string) []Token {
+	out := []Token{}
+	for _, v := range Graphemes(text) {
+		out = append(out, Token{Text: v})
+	}
+	return out
+}
+
+// Check every query against an index built from scratch, and against a plain search of the tokens
+func checkLineIndex(t *testing.T, x *LineIndex, tokens []Token) {
+	t.Helper()
+	want := NewLineIndex(tokens)
+	if x.Len() != len(tokens) || x.Lines() != want.Lines() {
+		t.Fatalf("index has %v tokens and %v lines, want %v and %v", x.Len(), x.Lines(), len(tokens), want.Lines())
+	}
+	for line := 0; line <= want.Lines(); line++ {
+		if got, w := x.LineStart(line), want.LineStart(line); got != w {
+			t.Fatalf("LineStart(%v) = %v, want %v", line, got, w)
+		}
+	}
+	for pos := 0; pos <= len(tokens); pos++ {
+		if got, w := x.LineOf(pos), want.LineOf(pos); got != w {
+			t.Fatalf("LineOf(%v) = %v, want %v", pos, got, w)
+		}
+		start, end := x.LineBounds(pos)
+		wantStart, wantEnd := lineBounds(nil, flatTokens(tokens), pos)
+		if start != wantStart || end != wantEnd {
+			t.Fatalf("LineBounds(%v) = %v, %v, want %v, %v", pos, start, end, wantStart, wantEnd)
+		}
+	}
+}
+
+func TestLineIndex(t *testing.T) {
+	tests := []struct {
+		text      string
+		lines     int
+		lineStart []int
+	}{
+		{"", 1, []int{0}},
+		{"abc", 1, []int{0}},
+		{"\n", 2, []int{0, 1}},
+		{"ab\ncd\n\nef", 4, []int{0, 3, 6, 7}},
+		{"a\r\nb", 2, []int{0, 2}}, // \r\n is one grapheme, so one token
+	}
+	for _, tt := range tests {
+		tokens := lineTokens(tt.text)
+		x := NewLineIndex(tokens)
+		if x.Lines() != tt.lines {
+			t.Errorf("%q: %v lines, want %v", tt.text, x.Lines(), tt.lines)
+		}
+		for line, want := range tt.lineStart {
+			if got := x.LineStart(line); got != want {
+				t.Errorf("%q: LineStart(%v) = %v, want %v", tt.text, line, got, want)
+			}
+		}
+		checkLineIndex(t, x, tokens)
+	}
+}
+
+func TestLineIndexRandomEdits(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	pieces := []string{"a", "bc", "\n", "x\ny", "\n\n", "", "long line of text", "é"}
+	tokens := lineTokens("one\ntwo\nthree")
+	x := NewLineIndex(tokens)
+	for i := 0; i < 500; i++ {
+		start := rng.Intn(len(tokens) + 1)
+		end := start + rng.Intn(len(tokens)-start+1)
+		if rng.Intn(3) == 0 {
+			end = start // A pure insertion
+		}
+		inserted := lineTokens(pieces[rng.Intn(len(pieces))])
+		x.Update(start, end, inserted)
+		tokens = append(append(append([]Token{}, tokens[:start]...), inserted...), tokens[end:]...)
+		checkLineIndex(t, x, tokens)
+	}
+}
+
+// An index is only used for the text it was made for, so a stale or borrowed index can't put lines in the wrong place
+func TestLineIndexGeneration(t *testing.T) {
+	tokens := lineTokens("a\nb\nc")
+	other := lineTokens("abcd\n") // The same length, with the newline somewhere else
+	tests := []struct {
+		name  string
+		setup func(f *FormatParams) tokenView
+		used  bool
+		line  int // The line at FirstDrawnCharPos 3, and the number of lines
+		total int
+	}{
+		{"matching index", func(f *FormatParams) tokenView {
+			f.LineIndex = NewLineIndex(tokens)
+			f.IndexGeneration = f.LineIndex.Generation()
+			return flatTokens(tokens)
+		}, true, 1, 3},
+		{"generation not set", func(f *FormatParams) tokenView {
+			f.LineIndex = NewLineIndex(tokens)
+			return flatTokens(other)
+		}, false, 0, 2},
+		{"index updated since", func(f *FormatParams) tokenView {
+			f.LineIndex = NewLineIndex(tokens)
+			f.IndexGeneration = f.LineIndex.Generation()
+			f.LineIndex.Update(0, 4, lineTokens("abcd"))
+			return flatTokens(other)
+		}, false, 0, 2},
+		{"index from another buffer", func(f *FormatParams) tokenView {
+			b := NewTextBuffer(f, "a\nb\nc")
+			NewTextBuffer(f, "abcd\n")
+			return b.view()
+		}, false, 1, 3},
+		{"buffer after an edit", func(f *FormatParams) tokenView {
+			b := NewTextBuffer(f, "a\nbc")
+			b.Format.Cursor = 3
+			b.Type("\n")
+			return flatTokens(b.Tokens())
+		}, true, 1, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFormatter()
+			tokens := tt.setup(f)
+			if used := f.lineIndex(tokens) != nil; used != tt.used {
+				t.Errorf("index used %v, want %v", used, tt.used)
+			}
+			f.FirstDrawnCharPos = 3
+			if line, total := scrollPosition(f, tokens); line != tt.line || total != tt.total {
+				t.Errorf("line %v of %v, want %v of %v", line, total, tt.line, tt.total)
+			}
+		})
+	}
+}
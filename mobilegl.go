@@ -5,12 +5,15 @@
 package glim
 
 import (
+	"encoding/binary"
 	"fmt"
 	"image"
 	_ "image/jpeg"
 	_ "image/png"
 	"log"
+	"sync"
 
+	"golang.org/x/mobile/exp/f32"
 	"golang.org/x/mobile/gl"
 )
 
@@ -108,7 +111,7 @@ func GenTexture(glctx gl.Context, w, h int, format gl.Enum) gl.Texture {
 
 //Renders a string into a openGL texture.  No guarantees are made that the text will fit
 func String2Tex(glctx gl.Context, str string, tSize float64, glTex gl.Texture, texSize int) {
-	img, _ := DrawStringRGBA(tSize, RGBA{255, 255, 255, 255}, str, "f1.ttf")
+	img, _ := DrawStringRGBA(tSize, RGBA{255, 255, 255, 255}, str, DefaultFontName)
 	//SaveImage(img, "texttest.png")
 
 	buff := PaintTexture(img, nil, int(texSize))
@@ -248,3 +251,316 @@ func CopyScreenToGFormat(glctx gl.Context, clientWidth, clientHeight int) image.
 	rgba.Pix = buff
 	return rgba
 }
+
+//Where a glyph lives in a GlyphAtlas
+type AtlasGlyph struct {
+	Page           int     //Index into GlyphAtlas.Pages
+	U0, V0, U1, V1 float32 //Texture coordinates of the glyph's corners
+	Width, Height  int     //Size of the glyph bitmap, in pixels
+	Bearing        image.Point
+	Advance        float32 //Pen advance, in pixels
+}
+
+type atlasKey struct {
+	Font string
+	Size float64
+	DPI  float64
+	Rune rune
+}
+
+// Every atlas that hasn't been released, so that replacing a font can throw away its glyphs
+var liveAtlases = struct {
+	sync.Mutex
+	atlases map[*GlyphAtlas]bool
+}{atlases: map[*GlyphAtlas]bool{}}
+
+func init() {
+	fontPurgeHooks = append(fontPurgeHooks, purgeAtlases)
+}
+
+// Forget the glyphs drawn from fonts that have been replaced.  Their space in the page textures isn't reused, so a font that is replaced over and over will slowly fill the atlas
+func purgeAtlases(purge map[string]bool) {
+	liveAtlases.Lock()
+	defer liveAtlases.Unlock()
+	for a := range liveAtlases.atlases {
+		a.mu.Lock()
+		for key := range a.glyphs {
+			if purge[key.Font] {
+				delete(a.glyphs, key)
+			}
+		}
+		a.mu.Unlock()
+	}
+}
+
+//A glyph atlas packs rasterised glyphs into a few large textures, so that text can be drawn from them without uploading a new texture for every string.
+//
+//Glyphs are added the first time they are asked for, and stay until Release, or until their font is registered again.  All methods make GL calls, so they must be called on the GL thread
+type GlyphAtlas struct {
+	glctx    gl.Context
+	PageSize int          //Width and height of each page texture
+	Pages    []gl.Texture //The page textures, in premultiplied RGBA format.  Glyphs are white, so every channel holds the coverage
+	packers  []*ShelfPacker
+	mu       sync.Mutex //Guards glyphs, which purgeAtlases changes from other goroutines
+	glyphs   map[atlasKey]AtlasGlyph
+}
+
+//Create an empty atlas.  Pages are pageSize square, and are created as they are needed
+func NewGlyphAtlas(glctx gl.Context, pageSize int) *GlyphAtlas {
+	a := &GlyphAtlas{glctx: glctx, PageSize: pageSize, glyphs: map[atlasKey]AtlasGlyph{}}
+	liveAtlases.Lock()
+	liveAtlases.atlases[a] = true
+	liveAtlases.Unlock()
+	return a
+}
+
+func (a *GlyphAtlas) addPage() {
+	glctx := a.glctx
+	t := glctx.CreateTexture()
+	glctx.BindTexture(gl.TEXTURE_2D, t)
+	glctx.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_S, gl.CLAMP_TO_EDGE)
+	glctx.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_WRAP_T, gl.CLAMP_TO_EDGE)
+	glctx.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MIN_FILTER, gl.NEAREST)
+	glctx.TexParameteri(gl.TEXTURE_2D, gl.TEXTURE_MAG_FILTER, gl.NEAREST)
+	glctx.TexImage2D(gl.TEXTURE_2D, 0, gl.RGBA, a.PageSize, a.PageSize, gl.RGBA, gl.UNSIGNED_BYTE, make([]byte, a.PageSize*a.PageSize*4))
+	checkGlError(glctx)
+	a.Pages = append(a.Pages, t)
+	a.packers = append(a.packers, NewShelfPacker(a.PageSize, a.PageSize, 1))
+}
+
+//Return the atlas entry for a glyph, rasterising and uploading it if this is the first time it has been seen
+func (a *GlyphAtlas) Glyph(fontName string, size float64, r rune) (AtlasGlyph, error) {
+	key := atlasKey{fontName, size, TextDPI(), r}
+	a.mu.Lock()
+	g, ok := a.glyphs[key]
+	a.mu.Unlock()
+	if ok {
+		return g, nil
+	}
+	bm, err := RasterGlyph(fontName, size, r)
+	if err != nil {
+		return AtlasGlyph{}, err
+	}
+	w, h := bm.Mask.Bounds().Dx(), bm.Mask.Bounds().Dy()
+	g = AtlasGlyph{Width: w, Height: h, Bearing: bm.Bearing, Advance: float32(bm.Advance) / 64}
+	if w > 0 && h > 0 {
+		if len(a.Pages) == 0 {
+			a.addPage()
+		}
+		page := len(a.Pages) - 1
+		pos, ok := a.packers[page].Pack(w, h)
+		if !ok {
+			a.addPage()
+			page++
+			pos, ok = a.packers[page].Pack(w, h)
+			if !ok {
+				return AtlasGlyph{}, fmt.Errorf("glyph %q (%vx%v) does not fit in an atlas page of %v", r, w, h, a.PageSize)
+			}
+		}
+		a.glctx.BindTexture(gl.TEXTURE_2D, a.Pages[page])
+		a.glctx.TexSubImage2D(gl.TEXTURE_2D, 0, pos.X, pos.Y, w, h, gl.RGBA, gl.UNSIGNED_BYTE, bm.RGBA().Pix)
+		checkGlError(a.glctx)
+		ps := float32(a.PageSize)
+		g.Page = page
+		g.U0, g.V0 = float32(pos.X)/ps, float32(pos.Y)/ps
+		g.U1, g.V1 = float32(pos.X+w)/ps, float32(pos.Y+h)/ps
+	}
+	a.mu.Lock()
+	a.glyphs[key] = g
+	a.mu.Unlock()
+	return g, nil
+}
+
+//Delete the page textures and forget every glyph.  The atlas can still be used afterwards, and starts again from empty
+func (a *GlyphAtlas) Release() {
+	for _, t := range a.Pages {
+		a.glctx.DeleteTexture(t)
+	}
+	a.Pages = nil
+	a.packers = nil
+	a.mu.Lock()
+	a.glyphs = map[atlasKey]AtlasGlyph{}
+	a.mu.Unlock()
+	liveAtlases.Lock()
+	delete(liveAtlases.atlases, a)
+	liveAtlases.Unlock()
+}
+
+//Vertex shader for TextBatcher.Draw.  Positions are in pixels, with 0,0 at the top left of the screen
+const TextVertexShader = `
+uniform vec2 screen;
+attribute vec2 position;
+attribute vec2 texcoord;
+attribute vec4 colour;
+varying vec2 v_texcoord;
+varying vec4 v_colour;
+void main() {
+	gl_Position = vec4(position.x/screen.x*2.0-1.0, 1.0-position.y/screen.y*2.0, 0.0, 1.0);
+	v_texcoord = texcoord;
+	v_colour = colour;
+}`
+
+//Fragment shader for TextBatcher.Draw.  Tints the white atlas glyphs with the vertex colour, giving premultiplied output for the ONE, ONE_MINUS_SRC_ALPHA blend
+const TextFragmentShader = `
+precision mediump float;
+uniform sampler2D tex;
+varying vec2 v_texcoord;
+varying vec4 v_colour;
+void main() {
+	vec4 t = texture2D(tex, v_texcoord);
+	gl_FragColor = vec4(v_colour.rgb*v_colour.a, v_colour.a)*t;
+}`
+
+//Compile and link TextVertexShader and TextFragmentShader
+func NewTextProgram(glctx gl.Context) (gl.Program, error) {
+	program := glctx.CreateProgram()
+	for _, src := range []struct {
+		ty   gl.Enum
+		code string
+	}{{gl.VERTEX_SHADER, TextVertexShader}, {gl.FRAGMENT_SHADER, TextFragmentShader}} {
+		shader := glctx.CreateShader(src.ty)
+		glctx.ShaderSource(shader, src.code)
+		glctx.CompileShader(shader)
+		if glctx.GetShaderi(shader, gl.COMPILE_STATUS) == 0 {
+			defer glctx.DeleteShader(shader)
+			return program, fmt.Errorf("text shader compile: %s", glctx.GetShaderInfoLog(shader))
+		}
+		glctx.AttachShader(program, shader)
+		glctx.DeleteShader(shader)
+	}
+	glctx.LinkProgram(program)
+	if glctx.GetProgrami(program, gl.LINK_STATUS) == 0 {
+		defer glctx.DeleteProgram(program)
+		return program, fmt.Errorf("text shader link: %s", glctx.GetProgramInfoLog(program))
+	}
+	return program, nil
+}
+
+//Number of float32s per vertex in a TextBatch: x, y, u, v, r, g, b, a
+const TextVertexSize = 8
+
+//The vertices for all the glyphs on one atlas page, as triangles
+type TextBatch struct {
+	Page     gl.Texture
+	Vertices []float32 //TextVertexSize floats per vertex, 6 vertices per glyph
+}
+
+//Collects strings into vertex buffers, one per atlas page, so that a screen full of text can be drawn in one call per page (usually just one).
+//
+//Call Reset at the start of each frame, AddString for each piece of text, then Draw
+type TextBatcher struct {
+	Atlas    *GlyphAtlas
+	vertices [][]float32 //One slice per atlas page
+	buffer   gl.Buffer
+}
+
+func NewTextBatcher(atlas *GlyphAtlas) *TextBatcher {
+	return &TextBatcher{Atlas: atlas}
+}
+
+//Empty the batches, keeping the allocated memory
+func (b *TextBatcher) Reset() {
+	for i := range b.vertices {
+		b.vertices[i] = b.vertices[i][:0]
+	}
+}
+
+//Add a string to the batch.  x, y is the pen position on the baseline, in pixels.  Newlines start a new line below x.
+//
+//Returns the pen position after the last character
+func (b *TextBatcher) AddString(x, y float32, txt, fontName string, size float64, colour RGBA) (float32, float32, error) {
+	c := colourKey(colour)
+	cr, cg, cb, ca := float32(c[0])/255, float32(c[1])/255, float32(c[2])/255, float32(c[3])/255
+	if err := Fonts.Check(fontName); err != nil {
+		return x, y, err
+	}
+	face := cachedFace(fontName, mustLoadFont(fontName), size, TextDPI())
+	lineHeight := float32(face.Metrics().Height) / 64
+	startX := x
+	prev := rune(-1)
+	for _, r := range txt {
+		if r == '\n' {
+			x = startX
+			y += lineHeight
+			prev = -1
+			continue
+		}
+		if prev >= 0 {
+			x += float32(TextKern(size, prev, r, fontName)) / 64 // Only kerns pairs drawn from the same font
+		}
+		prev = r
+		g, err := b.Atlas.Glyph(fontName, size, r)
+		if err != nil {
+			return x, y, err
+		}
+		if g.Width > 0 && g.Height > 0 {
+			for len(b.vertices) <= g.Page {
+				b.vertices = append(b.vertices, nil)
+			}
+			x0, y0 := x+float32(g.Bearing.X), y+float32(g.Bearing.Y)
+			x1, y1 := x0+float32(g.Width), y0+float32(g.Height)
+			b.vertices[g.Page] = append(b.vertices[g.Page],
+				x0, y0, g.U0, g.V0, cr, cg, cb, ca,
+				x1, y0, g.U1, g.V0, cr, cg, cb, ca,
+				x0, y1, g.U0, g.V1, cr, cg, cb, ca,
+				x1, y0, g.U1, g.V0, cr, cg, cb, ca,
+				x1, y1, g.U1, g.V1, cr, cg, cb, ca,
+				x0, y1, g.U0, g.V1, cr, cg, cb, ca,
+			)
+		}
+		x += g.Advance
+	}
+	return x, y, nil
+}
+
+//The batched vertices, one batch per atlas page that has glyphs in it
+func (b *TextBatcher) Batches() []TextBatch {
+	out := []TextBatch{}
+	for page, v := range b.vertices {
+		if len(v) > 0 {
+			out = append(out, TextBatch{b.Atlas.Pages[page], v})
+		}
+	}
+	return out
+}
+
+//Draw everything in the batcher, using a program made by NewTextProgram.  Blending is enabled, since glyph edges are partly transparent.  The atlas is premultiplied, so the blend is ONE, ONE_MINUS_SRC_ALPHA, which leaves the blend function changed afterwards
+func (b *TextBatcher) Draw(glctx gl.Context, program gl.Program, screenWidth, screenHeight int) {
+	if b.buffer.Value == 0 {
+		b.buffer = glctx.CreateBuffer()
+	}
+	glctx.UseProgram(program)
+	glctx.Enable(gl.BLEND)
+	glctx.BlendFunc(gl.ONE, gl.ONE_MINUS_SRC_ALPHA)
+	glctx.Uniform2f(glctx.GetUniformLocation(program, "screen"), float32(screenWidth), float32(screenHeight))
+	glctx.Uniform1i(glctx.GetUniformLocation(program, "tex"), 0)
+	position := glctx.GetAttribLocation(program, "position")
+	texcoord := glctx.GetAttribLocation(program, "texcoord")
+	colour := glctx.GetAttribLocation(program, "colour")
+	glctx.BindBuffer(gl.ARRAY_BUFFER, b.buffer)
+	glctx.EnableVertexAttribArray(position)
+	glctx.EnableVertexAttribArray(texcoord)
+	glctx.EnableVertexAttribArray(colour)
+	stride := TextVertexSize * 4
+	for _, batch := range b.Batches() {
+		glctx.ActiveTexture(gl.TEXTURE0)
+		glctx.BindTexture(gl.TEXTURE_2D, batch.Page)
+		glctx.BufferData(gl.ARRAY_BUFFER, f32.Bytes(binary.LittleEndian, batch.Vertices...), gl.STREAM_DRAW)
+		glctx.VertexAttribPointer(position, 2, gl.FLOAT, false, stride, 0)
+		glctx.VertexAttribPointer(texcoord, 2, gl.FLOAT, false, stride, 2*4)
+		glctx.VertexAttribPointer(colour, 4, gl.FLOAT, false, stride, 4*4)
+		glctx.DrawArrays(gl.TRIANGLES, 0, len(batch.Vertices)/TextVertexSize)
+		checkGlError(glctx)
+	}
+	glctx.DisableVertexAttribArray(position)
+	glctx.DisableVertexAttribArray(texcoord)
+	glctx.DisableVertexAttribArray(colour)
+}
+
+//Delete the vertex buffer.  The atlas is not released
+func (b *TextBatcher) Release(glctx gl.Context) {
+	if b.buffer.Value != 0 {
+		glctx.DeleteBuffer(b.buffer)
+		b.buffer = gl.Buffer{}
+	}
+}
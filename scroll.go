@@ -0,0 +1,253 @@
+// Scrolling.  Moves FirstDrawnCharPos and ScrollOffset so the right part of the text is on screen
+package glim
+
+// Measures visual lines near a scroll position, laying out one hard line at a time, so scrolling costs the same at the end of a big text as at the start
+type lineWalker struct {
+	f                      *FormatParams // Laid out from the start of each hard line, in an endless box
+	tokens                 tokenView
+	minX, minY, maxX, maxY int
+	paras                  map[int][]walkLine // The visual lines of each hard line, by its first token
+}
+
+// A visual line: the token it starts at, and its pitch (see LayoutLine)
+type walkLine struct {
+	start, pitch int
+}
+
+// A visual line, by the hard line holding it and its place in that
+type walkPos struct {
+	para, line int
+}
+
+func newLineWalker(f *FormatParams, minX, minY, maxX, maxY int, tokens tokenView) *lineWalker {
+	full := CopyFormatter(f)
+	full.ScrollOffset = 0
+	full.TailBuffer = false
+	return &lineWalker{f: full, tokens: tokens, minX: minX, minY: minY, maxX: maxX, maxY: maxY, paras: map[int][]walkLine{}}
+}
+
+// The visual lines of the hard line starting at para
+func (w *lineWalker) lines(para int) []walkLine {
+	if lines, ok := w.paras[para]; ok {
+		return lines
+	}
+	_, end := lineBounds(w.f.lineIndex(w.tokens), w.tokens, para)
+	w.f.FirstDrawnCharPos = para
+	const endless = 1 << 30
+	// Leave off the newline, so the hard line ends with the cursor holder at the end of the text
+	var l *Layout
+	if w.f.Vertical {
+		l = layoutTokens(w.f, endless, w.minY, -endless, w.minY, endless, w.maxY, w.tokens.Slice(0, end))
+	} else {
+		l = layoutTokens(w.f, w.minX, 0, w.minX, 0, w.maxX, endless, w.tokens.Slice(0, end))
+	}
+	lines := []walkLine{}
+	for _, line := range l.Lines {
+		lines = append(lines, walkLine{line.Start, line.Pitch})
+	}
+	if len(lines) == 0 {
+		lines = append(lines, walkLine{para, 1})
+	}
+	w.paras[para] = lines
+	return lines
+}
+
+// The visual line holding token pos
+func (w *lineWalker) at(pos int) walkPos {
+	para, _ := lineBounds(w.f.lineIndex(w.tokens), w.tokens, pos)
+	p := walkPos{para, 0}
+	for k, line := range w.lines(para) {
+		if line.start <= pos {
+			p.line = k
+		}
+	}
+	return p
+}
+
+func (w *lineWalker) get(p walkPos) walkLine {
+	return w.lines(p.para)[p.line]
+}
+
+// The line after p, if there is one
+func (w *lineWalker) next(p walkPos) (walkPos, bool) {
+	if p.line+1 < len(w.lines(p.para)) {
+		return walkPos{p.para, p.line + 1}, true
+	}
+	_, end := lineBounds(w.f.lineIndex(w.tokens), w.tokens, p.para)
+	if end >= w.tokens.Len() {
+		return p, false
+	}
+	return walkPos{end + 1, 0}, true
+}
+
+// The line before p, if there is one
+func (w *lineWalker) prev(p walkPos) (walkPos, bool) {
+	if p.line > 0 {
+		return walkPos{p.para, p.line - 1}, true
+	}
+	if p.para == 0 {
+		return p, false
+	}
+	para, _ := lineBounds(w.f.lineIndex(w.tokens), w.tokens, p.para-1)
+	return walkPos{para, len(w.lines(para)) - 1}, true
+}
+
+// The scroll position that puts the bottom of line p at the bottom of the view, or the top of the text if that is closer
+func (w *lineWalker) bottomAt(p walkPos, view int) (walkPos, int) {
+	total := w.get(p).pitch
+	for total < view {
+		q, ok := w.prev(p)
+		if !ok {
+			return p, 0
+		}
+		p = q
+		total += w.get(p).pitch
+	}
+	return p, total - view
+}
+
+// Pull a scroll position back so the view doesn't run past the end of the text
+func (w *lineWalker) clampEnd(p walkPos, offset, view int) (walkPos, int) {
+	remaining := -offset
+	for q := p; ; {
+		remaining += w.get(q).pitch
+		if remaining >= view {
+			return p, offset
+		}
+		var ok bool
+		if q, ok = w.next(q); !ok {
+			break
+		}
+	}
+	return w.bottomAt(w.at(w.tokens.Len()), view)
+}
+
+func (w *lineWalker) set(f *FormatParams, p walkPos, offset int) {
+	f.FirstDrawnCharPos = w.get(p).start
+	f.ScrollOffset = offset
+}
+
+// The size of the view across the lines
+func viewSize(f *FormatParams, minX, minY, maxX, maxY int) int {
+	if f.Vertical {
+		return maxX - minX
+	}
+	return maxY - minY
+}
+
+// Scroll as little as possible to bring the caret for index inside minY..maxY (minX..maxX for vertical text).  Soft wrapped lines aren't indexed, so this lays out the caret's hard line from its start, however far into a long line the caret is
+func ScrollToIndex(f *FormatParams, index, minX, minY, maxX, maxY int, tokens []Token) {
+	scrollToIndex(f, index, minX, minY, maxX, maxY, flatTokens(tokens))
+}
+
+// ScrollToIndex on a tokenView
+func scrollToIndex(f *FormatParams, index, minX, minY, maxX, maxY int, tokens tokenView) {
+	w := newLineWalker(f, minX, minY, maxX, maxY, tokens)
+	view := viewSize(f, minX, minY, maxX, maxY)
+	target := w.at(index)
+	top := w.at(f.FirstDrawnCharPos)
+	offset := f.ScrollOffset
+	if w.get(target).start < w.get(top).start || (target == top && offset > 0) {
+		w.set(f, target, 0)
+		return
+	}
+	// Measure down from the top of the view to the bottom of the target line, giving up once it is past the bottom
+	bottom := -offset
+	for p := top; ; {
+		bottom += w.get(p).pitch
+		if p == target || bottom > view {
+			break
+		}
+		var ok bool
+		if p, ok = w.next(p); !ok {
+			break
+		}
+	}
+	if bottom > view {
+		top, offset = w.bottomAt(target, view)
+	}
+	top, offset = w.clampEnd(top, offset, view)
+	w.set(f, top, offset)
+}
+
+// Scroll as little as possible to bring the cursor on screen.  Call after moving the cursor
+func ScrollToCursor(f *FormatParams, minX, minY, maxX, maxY int, tokens []Token) {
+	ScrollToIndex(f, f.Cursor, minX, minY, maxX, maxY, tokens)
+}
+
+// Scroll by a number of pixels, positive to move further into the text.  Small steps give smooth scrolling, e.g. for a mouse wheel or an animation
+func ScrollBy(f *FormatParams, pixels, minX, minY, maxX, maxY int, tokens []Token) {
+	scrollBy(f, pixels, minX, minY, maxX, maxY, flatTokens(tokens))
+}
+
+// ScrollBy on a tokenView
+func scrollBy(f *FormatParams, pixels, minX, minY, maxX, maxY int, tokens tokenView) {
+	w := newLineWalker(f, minX, minY, maxX, maxY, tokens)
+	p := w.at(f.FirstDrawnCharPos)
+	offset := f.ScrollOffset + pixels
+	for offset < 0 {
+		q, ok := w.prev(p)
+		if !ok {
+			offset = 0
+			break
+		}
+		p = q
+		offset += w.get(p).pitch
+	}
+	for offset >= w.get(p).pitch {
+		q, ok := w.next(p)
+		if !ok {
+			break
+		}
+		offset -= w.get(p).pitch
+		p = q
+	}
+	p, offset = w.clampEnd(p, offset, viewSize(f, minX, minY, maxX, maxY))
+	w.set(f, p, offset)
+}
+
+// Jump to the start of a hard line, counting from 0.  With f.LineIndex set (and f.IndexGeneration matching it), this is O(log n) however big the text is
+func ScrollToLine(f *FormatParams, line int, tokens []Token) {
+	scrollToLine(f, line, flatTokens(tokens))
+}
+
+// ScrollToLine on a tokenView
+func scrollToLine(f *FormatParams, line int, tokens tokenView) {
+	if line < 0 {
+		line = 0
+	}
+	if index := f.lineIndex(tokens); index != nil {
+		f.FirstDrawnCharPos = index.LineStart(line)
+	} else {
+		pos := 0
+		for ; pos < tokens.Len() && line > 0; pos++ {
+			if isNewLine(tokens.At(pos).Text) {
+				line--
+			}
+		}
+		f.FirstDrawnCharPos = pos
+	}
+	f.ScrollOffset = 0
+}
+
+// The hard line at the top of the view, and the number of hard lines in the text, e.g. for drawing a scroll bar
+func ScrollPosition(f *FormatParams, tokens []Token) (int, int) {
+	return scrollPosition(f, flatTokens(tokens))
+}
+
+// ScrollPosition on a tokenView
+func scrollPosition(f *FormatParams, tokens tokenView) (int, int) {
+	if index := f.lineIndex(tokens); index != nil {
+		return index.LineOf(f.FirstDrawnCharPos), index.Lines()
+	}
+	line, total := 0, 1
+	for i := 0; i < tokens.Len(); i++ {
+		if isNewLine(tokens.At(i).Text) {
+			total++
+			if i < f.FirstDrawnCharPos {
+				line++
+			}
+		}
+	}
+	return line, total
+}
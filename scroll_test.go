@@ -0,0 +1,94 @@
+package glim
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Numbered lines, one to n
+func numberedLines(n int) string {
+	lines := []string{}
+	for i := 1; i <= n; i++ {
+		lines = append(lines, fmt.Sprintf("line %v", i))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// With TailBuffer set, every layout scrolls so the end of the text is on screen, as the text grows
+func TestScrollTail(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		more     string // Added before the second layout
+		vertical bool
+		scrolled bool // Whether the view has to move to show the end
+	}{
+		{"short text stays put", "one\ntwo", "\nthree", false, false},
+		{"many lines", numberedLines(100), "\nline 101\nline 102", false, true},
+		{"ending in a blank line", numberedLines(100), "\n\n", false, true},
+		{"a long wrapped line at the end", numberedLines(20), "\n" + strings.Repeat("word ", 200), false, true},
+		{"vertical", numberedLines(100), "\nline 101", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFormatter()
+			f.FontName = "gomono"
+			f.FontSize = 12
+			f.Vertical = tt.vertical
+			f.TailBuffer = true
+			minX, minY, maxX, maxY := 0, 0, 200, 150
+			for _, text := range []string{tt.text, tt.text + tt.more} {
+				tokens := lineTokens(text)
+				l := LayoutTokenPara(f, 0, 0, minX, minY, maxX, maxY, tokens)
+				caret, ok := l.Caret(len(tokens))
+				if !ok {
+					t.Fatalf("the end of %v tokens wasn't laid out, layout went from %v to %v", len(tokens), l.First, l.Last)
+				}
+				if tt.vertical && (caret.Min.X < minX || caret.Max.X > maxX) || !tt.vertical && (caret.Min.Y < minY || caret.Max.Y > maxY) {
+					t.Errorf("the caret at the end is at %v, outside the box", caret)
+				}
+				if scrolled := f.FirstDrawnCharPos > 0 || f.ScrollOffset > 0; scrolled != tt.scrolled {
+					t.Errorf("scrolled to %v (offset %v), want scrolled %v", f.FirstDrawnCharPos, f.ScrollOffset, tt.scrolled)
+				}
+			}
+		})
+	}
+}
+
+// ScrollToIndex moves the view as little as it can, so text that is already on screen stays where it is
+func TestScrollToIndex(t *testing.T) {
+	tokens := lineTokens(numberedLines(100))
+	lineStart := func(n int) int { return NewLineIndex(tokens).LineStart(n) }
+	tests := []struct {
+		name  string
+		top   int // The first line on screen before scrolling
+		index int
+		want  int // The first line on screen afterwards, or -1 if index should be on the bottom line
+	}{
+		{"already on screen", 10, lineStart(12), 10},
+		{"above", 50, lineStart(20), 20},
+		{"below", 0, lineStart(60), -1},
+		{"past the end", 0, len(tokens) + 10, -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFormatter()
+			f.FontName = "gomono"
+			f.FontSize = 12
+			ScrollToLine(f, tt.top, tokens)
+			ScrollToIndex(f, tt.index, 0, 0, 200, 150, tokens)
+			l := LayoutTokenPara(f, 0, 0, 0, 0, 200, 150, tokens)
+			if tt.want >= 0 {
+				if top, _ := ScrollPosition(f, tokens); top != tt.want || f.ScrollOffset != 0 {
+					t.Errorf("line %v is at the top, scrolled %v pixels past it, want line %v", top, f.ScrollOffset, tt.want)
+				}
+				return
+			}
+			last := l.Lines[len(l.Lines)-1]
+			if index := MinI(tt.index, len(tokens)); index < last.Start || index > last.End || last.Rect.Max.Y != 150 {
+				t.Errorf("the bottom line holds %v to %v, and ends at %v", last.Start, last.End, last.Rect.Max.Y)
+			}
+		})
+	}
+}
@@ -0,0 +1,459 @@
+// Distance field glyphs.  SDF and multi-channel MSDF bitmaps built from the TrueType outlines, which stay sharp when scaled on the GPU, and the shaders to draw them
+package glim
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"github.com/golang/freetype/truetype"
+	"golang.org/x/image/font"
+	"golang.org/x/image/math/fixed"
+)
+
+// A glyph drawn as a distance field.  Each pixel holds the distance to the nearest edge of the glyph, mapped so 128 is on the edge, 255 is Spread pixels inside and 0 is Spread pixels outside
+type DistanceGlyph struct {
+	Image   image.Image // An *image.Gray for an SDF.  For an MSDF, an *image.RGBA, with the distances in red, green and blue
+	Origin  image.Point // Where the pen starts, on the baseline, in Image
+	Advance float64     // How far the pen moves after the glyph, in pixels
+	Spread  float64     // The distance, in pixels, covered by half the range of values.  The image has this much space around the glyph
+}
+
+// Draw a character as a signed distance field.  txtSize is in points, like DrawGlyphRGBA, and fonts and fallback fonts are chosen the same way.  spread is how far from the edges, in pixels, the distances go before they are clamped.  Only fonts with outlines (TrueType, not bitmap fonts) can be drawn this way.  Scaled up by more than about spread times, the corners start to round off
+//
+// The returned glyph is shared with other callers, so don't draw on the image
+func DrawGlyphSDF(txtSize float64, glyph rune, fontfile string, spread float64) (*DistanceGlyph, error) {
+	return cachedDistanceGlyph(txtSize, glyph, fontfile, spread, false)
+}
+
+// Draw a character as a multi-channel signed distance field (see github.com/Chlumsky/msdfgen).  The edges of the glyph are shared out between the colour channels so corners stay sharp when it is scaled up, and the shape is the median of the three channels.  Otherwise like DrawGlyphSDF
+func DrawGlyphMSDF(txtSize float64, glyph rune, fontfile string, spread float64) (*DistanceGlyph, error) {
+	return cachedDistanceGlyph(txtSize, glyph, fontfile, spread, true)
+}
+
+type distanceKey struct {
+	Font   string
+	Size   float64
+	DPI    float64
+	Glyph  rune
+	Spread float64
+	Multi  bool
+}
+
+func cachedDistanceGlyph(txtSize float64, glyph rune, fontfile string, spread float64, multi bool) (*DistanceGlyph, error) {
+	if spread <= 0 {
+		return nil, fmt.Errorf("distance field spread must be more than 0, not %v", spread)
+	}
+	dpi := TextDPI()
+	key := distanceKey{fontfile, txtSize, dpi, glyph, spread, multi}
+	if v, ok := renderCache.Get(key); ok {
+		return v.(*DistanceGlyph), nil
+	}
+	runName, txtFont, err := Fonts.FontForRune(fontfile, glyph)
+	if err != nil {
+		return nil, err
+	}
+	ttf, ok := txtFont.(*truetype.Font)
+	if !ok {
+		return nil, fmt.Errorf("%v has no outlines to make a distance field from", runName)
+	}
+	segs, advance, err := glyphSegments(ttf, glyph, txtSize*dpi/72)
+	if err != nil {
+		return nil, err
+	}
+	g := drawDistanceField(segs, spread, multi)
+	g.Advance = advance
+	size := g.Image.Bounds().Dx() * g.Image.Bounds().Dy()
+	if multi {
+		size *= 4
+	}
+	renderCache.Add(key, g, int64(size))
+	return g, nil
+}
+
+// Colour channels of an edge, for MSDF
+const (
+	edgeRed   = 1
+	edgeGreen = 2
+	edgeBlue  = 4
+	edgeWhite = edgeRed | edgeGreen | edgeBlue
+)
+
+// A straight piece of a glyph outline, in pixels, with y going down from the baseline
+type edgeSegment struct {
+	a, b        [2]float64
+	colour      uint8
+	first, last bool // The segment starts or ends an edge (a run of outline between corners), so the distance past that end is measured from the edge's line carried on
+}
+
+// A piece of outline as it is in the font: a line, or a quadratic curve through control point c
+type outlinePiece struct {
+	a, c, b [2]float64
+	curve   bool
+}
+
+func (p outlinePiece) startDir() [2]float64 {
+	if p.curve && p.c != p.a {
+		return sub2(p.c, p.a)
+	}
+	return sub2(p.b, p.a)
+}
+
+func (p outlinePiece) endDir() [2]float64 {
+	if p.curve && p.c != p.b {
+		return sub2(p.b, p.c)
+	}
+	return sub2(p.b, p.a)
+}
+
+// Straight lines close enough to the piece
+func (p outlinePiece) flatten() [][2]float64 {
+	if !p.curve {
+		return [][2]float64{p.a, p.b}
+	}
+	n := MaxI(2, int(math.Ceil(math.Sqrt(length2(sub2(p.c, p.a))+length2(sub2(p.b, p.c)))/2)))
+	n = MinI(n, 32)
+	pts := make([][2]float64, n+1)
+	for i := 0; i <= n; i++ {
+		t := float64(i) / float64(n)
+		for k := 0; k < 2; k++ {
+			pts[i][k] = (1-t)*(1-t)*p.a[k] + 2*(1-t)*t*p.c[k] + t*t*p.b[k]
+		}
+	}
+	return pts
+}
+
+func sub2(a, b [2]float64) [2]float64 {
+	return [2]float64{a[0] - b[0], a[1] - b[1]}
+}
+
+func cross2(a, b [2]float64) float64 {
+	return a[0]*b[1] - a[1]*b[0]
+}
+
+func dot2(a, b [2]float64) float64 {
+	return a[0]*b[0] + a[1]*b[1]
+}
+
+func length2(a [2]float64) float64 {
+	return math.Sqrt(dot2(a, a))
+}
+
+// Load a glyph's outline at ppem pixels per em, and split it into coloured straight segments
+func glyphSegments(f *truetype.Font, glyph rune, ppem float64) ([]edgeSegment, float64, error) {
+	var gb truetype.GlyphBuf
+	if err := gb.Load(f, fixed.Int26_6(ppem*64), f.Index(glyph), font.HintingNone); err != nil {
+		return nil, 0, fmt.Errorf("could not load glyph %q: %w", glyph, err)
+	}
+	segs := []edgeSegment{}
+	start := 0
+	for _, end := range gb.Ends {
+		segs = append(segs, contourSegments(contourPieces(gb.Points[start:end]))...)
+		start = end
+	}
+	return segs, float64(gb.AdvanceWidth) / 64, nil
+}
+
+// Turn a TrueType contour into lines and curves.  Two off-curve points in a row have an on-curve point halfway between them
+func contourPieces(points []truetype.Point) []outlinePiece {
+	if len(points) < 2 {
+		return nil
+	}
+	pt := func(i int) ([2]float64, bool) {
+		p := points[(i+len(points))%len(points)]
+		return [2]float64{float64(p.X) / 64, -float64(p.Y) / 64}, p.Flags&1 != 0
+	}
+	mid := func(a, b [2]float64) [2]float64 {
+		return [2]float64{(a[0] + b[0]) / 2, (a[1] + b[1]) / 2}
+	}
+	// Start on an on-curve point, or between the first two points if there aren't any
+	first := -1
+	for i := range points {
+		if _, on := pt(i); on {
+			first = i
+			break
+		}
+	}
+	var startPt [2]float64
+	if first < 0 {
+		p0, _ := pt(0)
+		p1, _ := pt(1)
+		startPt, first = mid(p0, p1), 0
+	} else {
+		startPt, _ = pt(first)
+	}
+	pieces := []outlinePiece{}
+	cur := startPt
+	var ctrl [2]float64
+	haveCtrl := false
+	for k := 1; k <= len(points); k++ {
+		p, on := pt(first + k)
+		if k == len(points) {
+			p, on = startPt, true
+		}
+		switch {
+		case on && haveCtrl:
+			pieces = append(pieces, outlinePiece{cur, ctrl, p, true})
+			cur, haveCtrl = p, false
+		case on:
+			if p != cur {
+				pieces = append(pieces, outlinePiece{cur, cur, p, false})
+			}
+			cur = p
+		case haveCtrl:
+			m := mid(ctrl, p)
+			pieces = append(pieces, outlinePiece{cur, ctrl, m, true})
+			cur, ctrl = m, p
+		default:
+			ctrl, haveCtrl = p, true
+		}
+	}
+	return pieces
+}
+
+// Find the corners of a contour, colour the edges between them so neighbouring edges differ (sharing one channel), and flatten them into segments
+func contourSegments(pieces []outlinePiece) []edgeSegment {
+	if len(pieces) == 0 {
+		return nil
+	}
+	// Two directions meet at a corner if they turn by more than about 8 degrees (msdfgen uses sin(3) too)
+	crossThreshold := math.Sin(3.0)
+	isCorner := func(in, out [2]float64) bool {
+		li, lo := length2(in), length2(out)
+		if li == 0 || lo == 0 {
+			return false
+		}
+		return dot2(in, out) <= 0 || math.Abs(cross2(in, out))/(li*lo) > crossThreshold
+	}
+	corners := []int{}
+	for i, p := range pieces {
+		prev := pieces[(i+len(pieces)-1)%len(pieces)]
+		if isCorner(prev.endDir(), p.startDir()) {
+			corners = append(corners, i)
+		}
+	}
+	flat := func(from, n int) [][2]float64 {
+		pts := [][2]float64{}
+		for k := 0; k < n; k++ {
+			f := pieces[(from+k)%len(pieces)].flatten()
+			if len(pts) > 0 {
+				f = f[1:]
+			}
+			pts = append(pts, f...)
+		}
+		return pts
+	}
+	segs := []edgeSegment{}
+	edge := func(pts [][2]float64, colour uint8) {
+		for k := 0; k+1 < len(pts); k++ {
+			segs = append(segs, edgeSegment{pts[k], pts[k+1], colour, k == 0, k+2 == len(pts)})
+		}
+	}
+	const cyan, magenta, yellow = edgeGreen | edgeBlue, edgeRed | edgeBlue, edgeRed | edgeGreen
+	switch len(corners) {
+	case 0:
+		edge(flat(0, len(pieces)), edgeWhite)
+	case 1:
+		// A teardrop.  Split the edge in three, so the corner still has two colours either side of it
+		pts := flat(corners[0], len(pieces))
+		n := len(pts) - 1
+		a, b := MaxI(1, n/3), MaxI(2, 2*n/3)
+		if n < 3 {
+			edge(pts, edgeWhite)
+			break
+		}
+		edge(pts[:a+1], magenta)
+		edge(pts[a:b+1], edgeWhite)
+		edge(pts[b:], yellow)
+	default:
+		for k, c := range corners {
+			next := corners[(k+1)%len(corners)]
+			n := (next - c + len(pieces)) % len(pieces)
+			if n == 0 {
+				n = len(pieces)
+			}
+			colour := uint8(cyan)
+			if k%2 == 1 {
+				colour = magenta
+			}
+			if k == len(corners)-1 && k%2 == 0 {
+				// An odd number of edges, so the last would match the first
+				colour = yellow
+			}
+			edge(flat(c, n), colour)
+		}
+	}
+	return segs
+}
+
+// The distances from p to a segment.  dist is the true distance, and signed the signed distance, positive on the left of the segment (with y going down), which is carried on past the ends of an edge as the distance to its line.  ortho says how square on to the segment p is, to choose between segments that are the same distance away
+func (s edgeSegment) distance(p [2]float64) (dist, signed, ortho float64) {
+	d := sub2(s.b, s.a)
+	l := length2(d)
+	if l == 0 {
+		return length2(sub2(p, s.a)), 0, 0
+	}
+	ap := sub2(p, s.a)
+	t := dot2(ap, d) / (l * l)
+	side := cross2(d, ap) / l
+	closest := [2]float64{s.a[0] + d[0]*math.Max(0, math.Min(1, t)), s.a[1] + d[1]*math.Max(0, math.Min(1, t))}
+	dist = length2(sub2(p, closest))
+	if dist > 0 {
+		ortho = math.Abs(side) / dist
+	}
+	if (t < 0 && s.first) || (t > 1 && s.last) {
+		return dist, side, ortho
+	}
+	signed = dist
+	if side < 0 {
+		signed = -dist
+	}
+	return dist, signed, ortho
+}
+
+// Is p inside the outline?  Non-zero winding, like TrueType rasterisers
+func insideOutline(segs []edgeSegment, p [2]float64) bool {
+	winding := 0
+	for _, s := range segs {
+		if (s.a[1] <= p[1]) != (s.b[1] <= p[1]) {
+			x := s.a[0] + (p[1]-s.a[1])*(s.b[0]-s.a[0])/(s.b[1]-s.a[1])
+			if x > p[0] {
+				if s.b[1] > s.a[1] {
+					winding++
+				} else {
+					winding--
+				}
+			}
+		}
+	}
+	return winding != 0
+}
+
+// Draw the distance field for the segments of a glyph
+func drawDistanceField(segs []edgeSegment, spread float64, multi bool) *DistanceGlyph {
+	pad := int(math.Ceil(spread))
+	minX, minY, maxX, maxY := 0.0, 0.0, 0.0, 0.0
+	// Which side of a segment is inside depends on which way round the outlines go
+	area := 0.0
+	for i, s := range segs {
+		if i == 0 {
+			minX, minY, maxX, maxY = s.a[0], s.a[1], s.a[0], s.a[1]
+		}
+		for _, q := range [][2]float64{s.a, s.b} {
+			minX, minY = math.Min(minX, q[0]), math.Min(minY, q[1])
+			maxX, maxY = math.Max(maxX, q[0]), math.Max(maxY, q[1])
+		}
+		area += cross2(s.a, s.b)
+	}
+	orient := 1.0
+	if area < 0 {
+		orient = -1
+	}
+	origin := image.Pt(pad-int(math.Floor(minX)), pad-int(math.Floor(minY)))
+	rect := image.Rect(0, 0, int(math.Ceil(maxX))-int(math.Floor(minX))+2*pad, int(math.Ceil(maxY))-int(math.Floor(minY))+2*pad)
+	value := func(d float64) uint8 {
+		return uint8(math.Max(0, math.Min(255, math.Round((0.5+d/(2*spread))*255))))
+	}
+	g := &DistanceGlyph{Origin: origin, Spread: spread}
+	gray := image.NewGray(rect)
+	var rgba *image.RGBA
+	if multi {
+		rgba = image.NewRGBA(rect)
+	}
+	for y := 0; y < rect.Dy(); y++ {
+		for x := 0; x < rect.Dx(); x++ {
+			p := [2]float64{float64(x-origin.X) + 0.5, float64(y-origin.Y) + 0.5}
+			inside := insideOutline(segs, p)
+			nearest := math.Inf(1)
+			// The closest segment for each channel
+			var best [3]struct{ dist, signed, ortho float64 }
+			for c := range best {
+				best[c].dist = math.Inf(1)
+			}
+			for _, s := range segs {
+				dist, signed, ortho := s.distance(p)
+				nearest = math.Min(nearest, dist)
+				if !multi {
+					continue
+				}
+				for c := range best {
+					if s.colour&(1<<uint(c)) == 0 {
+						continue
+					}
+					if b := &best[c]; dist < b.dist-1e-9 || (math.Abs(dist-b.dist) <= 1e-9 && ortho > b.ortho) {
+						b.dist, b.signed, b.ortho = dist, signed*orient, ortho
+					}
+				}
+			}
+			if len(segs) == 0 {
+				nearest = spread
+			}
+			if !inside {
+				nearest = -nearest
+			}
+			gray.Pix[gray.PixOffset(x, y)] = value(nearest)
+			if !multi {
+				continue
+			}
+			var ch [3]float64
+			for c := range ch {
+				ch[c] = best[c].signed
+				if math.IsInf(best[c].dist, 1) {
+					ch[c] = nearest
+				}
+			}
+			// Where the channels disagree with the outline, e.g. next to where two edges nearly touch, use the plain distance
+			if (median3(ch[0], ch[1], ch[2]) > 0) != inside {
+				ch = [3]float64{nearest, nearest, nearest}
+			}
+			rgba.SetRGBA(x, y, color.RGBA{value(ch[0]), value(ch[1]), value(ch[2]), 255})
+		}
+	}
+	g.Image = gray
+	if multi {
+		g.Image = rgba
+	}
+	return g
+}
+
+func median3(a, b, c float64) float64 {
+	return math.Max(math.Min(a, b), math.Min(math.Max(a, b), c))
+}
+
+// The shared part of SDFFragmentShader and MSDFFragmentShader
+const distanceFragmentShader = `
+precision mediump float;
+uniform sampler2D tex;
+uniform float smoothing;
+uniform float outlineWidth;
+uniform vec4 outlineColour;
+varying vec2 v_texcoord;
+varying vec4 v_colour;
+float median(float r, float g, float b) {
+	return max(min(r, g), min(max(r, g), b));
+}
+float distanceAt(vec2 at);
+void main() {
+	float d = distanceAt(v_texcoord);
+	float fill = smoothstep(0.5-smoothing, 0.5+smoothing, d);
+	float edge = smoothstep(0.5-outlineWidth-smoothing, 0.5-outlineWidth+smoothing, d);
+	vec4 c = mix(outlineColour, v_colour, fill);
+	gl_FragColor = vec4(c.rgb, c.a*edge);
+}
+`
+
+// GLSL ES 2.0 fragment shader for DrawGlyphSDF textures, uploaded as luminance (or with the distance in red).  It goes with TextVertexShader, and tints the glyphs with the vertex colour.
+//
+// Set the uniform smoothing to the width of the anti-aliased edge, in texture values: about 0.5/(Spread*scale), where scale is how many screen pixels each texture pixel covers.  For an outline, set outlineWidth to how far it reaches past the edge, also in texture values (at most 0.5), and outlineColour to its colour.  outlineWidth 0 draws no outline
+const SDFFragmentShader = distanceFragmentShader + `
+float distanceAt(vec2 at) {
+	return texture2D(tex, at).r;
+}`
+
+// GLSL ES 2.0 fragment shader for DrawGlyphMSDF textures.  Like SDFFragmentShader, but takes the median of the three channels
+const MSDFFragmentShader = distanceFragmentShader + `
+float distanceAt(vec2 at) {
+	vec3 t = texture2D(tex, at).rgb;
+	return median(t.r, t.g, t.b);
+}`
@@ -0,0 +1,145 @@
+package glim
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// The shape's value at pixel x, y of a distance field: the grey level, or for an MSDF the median of the channels
+func distanceAt(g *DistanceGlyph, x, y int) uint8 {
+	if gray, ok := g.Image.(*image.Gray); ok {
+		return gray.GrayAt(x, y).Y
+	}
+	c := g.Image.(*image.RGBA).RGBAAt(x, y)
+	return uint8(median3(float64(c.R), float64(c.G), float64(c.B)))
+}
+
+// Distances map to 128 on the edge, more inside and less outside, reaching 255 and 0 at spread pixels in and out
+func TestDistanceFieldSquare(t *testing.T) {
+	// A 10 pixel square, clockwise with y going down
+	corners := [][2]float64{{0, 0}, {10, 0}, {10, 10}, {0, 10}}
+	segs := []edgeSegment{}
+	for i, a := range corners {
+		segs = append(segs, edgeSegment{a: a, b: corners[(i+1)%4], colour: []uint8{edgeRed | edgeGreen, edgeGreen | edgeBlue}[i%2], first: true, last: true})
+	}
+	tests := []struct {
+		name string
+		x, y int // A pixel, relative to the square's top left, so its middle is at x+0.5, y+0.5
+		sdf  uint8
+		msdf uint8 // Past a corner, the MSDF carries on the edges' lines, which keeps the corner sharp
+	}{
+		{"middle", 5, 5, 255, 255},
+		{"2.5 inside", 2, 5, 207, 207},
+		{"0.5 inside", 5, 9, 143, 143},
+		{"0.5 outside", 10, 5, 112, 112},
+		{"2.5 outside", 5, -3, 48, 48},
+		{"past the spread", -4, 5, 16, 16},
+		{"past a corner", -4, -4, 0, 16},
+	}
+	for _, multi := range []bool{false, true} {
+		g := drawDistanceField(segs, 4, multi)
+		if g.Origin != image.Pt(4, 4) || g.Image.Bounds() != image.Rect(0, 0, 18, 18) {
+			t.Fatalf("origin %v and bounds %v, want 4,4 and 18x18", g.Origin, g.Image.Bounds())
+		}
+		for _, tt := range tests {
+			x, y := g.Origin.X+tt.x, g.Origin.Y+tt.y
+			want := tt.sdf
+			if multi {
+				want = tt.msdf
+			}
+			if got := distanceAt(g, x, y); got != want {
+				t.Errorf("multi %v, %v: got %v, want %v", multi, tt.name, got, want)
+			}
+		}
+	}
+}
+
+// Well inside a glyph's ink the field is over half way, and well outside it is under, including inside the holes of letters like o and B
+func TestDistanceGlyphSign(t *testing.T) {
+	for _, multi := range []bool{false, true} {
+		for _, r := range []rune("loB") {
+			var g *DistanceGlyph
+			var err error
+			if multi {
+				g, err = DrawGlyphMSDF(48, r, "goregular", 4)
+			} else {
+				g, err = DrawGlyphSDF(48, r, "goregular", 4)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			bm, err := RasterGlyph("goregular", 48, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// The rasterised glyph is hinted, so only pixels two or more away from its edges are checked
+			all := func(mx, my int, want uint8) bool {
+				for dy := -2; dy <= 2; dy++ {
+					for dx := -2; dx <= 2; dx++ {
+						if bm.Mask.AlphaAt(mx+dx, my+dy).A != want {
+							return false
+						}
+					}
+				}
+				return true
+			}
+			inside, outside := 0, 0
+			b := bm.Mask.Bounds()
+			for my := b.Min.Y - 2; my < b.Max.Y+2; my++ {
+				for mx := b.Min.X - 2; mx < b.Max.X+2; mx++ {
+					p := g.Origin.Add(bm.Bearing).Add(image.Pt(mx, my))
+					if !p.In(g.Image.Bounds()) {
+						continue
+					}
+					d := distanceAt(g, p.X, p.Y)
+					switch {
+					case all(mx, my, 255):
+						inside++
+						if d <= 128 {
+							t.Fatalf("multi %v, %q: %v inside the ink at %v", multi, r, d, p)
+						}
+					case all(mx, my, 0):
+						outside++
+						if d >= 128 {
+							t.Fatalf("multi %v, %q: %v outside the ink at %v", multi, r, d, p)
+						}
+					}
+				}
+			}
+			if inside == 0 || outside == 0 {
+				t.Errorf("multi %v, %q: %v pixels checked inside and %v outside", multi, r, inside, outside)
+			}
+		}
+	}
+}
+
+// A glyph with no outline is all outside
+func TestDistanceGlyphSpace(t *testing.T) {
+	for _, multi := range []bool{false, true} {
+		var g *DistanceGlyph
+		var err error
+		if multi {
+			g, err = DrawGlyphMSDF(24, ' ', "goregular", 3)
+		} else {
+			g, err = DrawGlyphSDF(24, ' ', "goregular", 3)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if g.Advance <= 0 {
+			t.Errorf("multi %v: advance %v", multi, g.Advance)
+		}
+		b := g.Image.Bounds()
+		if b.Empty() {
+			t.Fatalf("multi %v: empty image", multi)
+		}
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if r, gr, bl, _ := g.Image.At(x, y).RGBA(); r != 0 || gr != 0 || bl != 0 {
+					t.Fatalf("multi %v: pixel %v,%v is %v", multi, x, y, color.RGBAModel.Convert(g.Image.At(x, y)))
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,323 @@
+// Text shaping.  Turns text into positioned glyphs with OpenType rules, so ligatures, joining forms and combining marks come out right
+package glim
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/go-text/typesetting/di"
+	otfont "github.com/go-text/typesetting/font"
+	"github.com/go-text/typesetting/language"
+	"github.com/go-text/typesetting/shaping"
+	"github.com/rivo/uniseg"
+	"golang.org/x/image/math/fixed"
+)
+
+// One glyph picked by the shaper
+type ShapedGlyph struct {
+	FontName string // The font the glyph comes from, which may be a fallback of the requested font
+	GlyphID  uint32 // Glyph index in the font, not a character
+	XOffset  fixed.Int26_6
+	YOffset  fixed.Int26_6 // Offset from the pen position, y up
+	Advance  fixed.Int26_6 // How far to move the pen after drawing
+}
+
+// The smallest piece of shaped text that can't be split.  One or more characters, drawn with zero or more glyphs
+type GlyphCluster struct {
+	Start, End int // Byte range of the characters in the text
+	Glyphs     []ShapedGlyph
+	Advance    fixed.Int26_6
+}
+
+var (
+	// The shaper and the parsed faces keep scratch space, so they are only used with shapeLock held
+	shapeLock sync.Mutex
+	shaper    shaping.HarfbuzzShaper
+	otFaces   = map[string]*otfont.Face{}
+)
+
+// Get the OpenType face for a registered font.  Must be called with shapeLock held, so the font must already be loaded (registering a font purges this cache, which takes the lock)
+func otFace(name string) (*otfont.Face, error) {
+	if face, ok := otFaces[name]; ok {
+		return face, nil
+	}
+	data, err := Fonts.FontData(name)
+	if err != nil {
+		return nil, err
+	}
+	face, err := otfont.ParseTTF(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("could not parse font %v for shaping: %w", name, err)
+	}
+	otFaces[name] = face
+	return face, nil
+}
+
+// Forget the shaping face for a font that has been replaced
+func purgeShapingFace(name string) {
+	shapeLock.Lock()
+	delete(otFaces, name)
+	shapeLock.Unlock()
+}
+
+// The pixel size the shaper works in.  It only handles whole pixels
+func shapePixels(size float64) fixed.Int26_6 {
+	return fixed.I(int(math.Ceil(size * TextDPI() / 72)))
+}
+
+// A piece of text that is shaped in one go
+type shapeRun struct {
+	fontName   string
+	script     language.Script
+	start, end int // Rune range
+}
+
+// Split text into runs that share a font (following fontName's fallbacks) and a script.  Whole grapheme clusters always go in the same run, so marks stay with their base character
+func shapeRuns(fontName string, runes []rune) ([]shapeRun, error) {
+	runs := []shapeRun{}
+	state := -1
+	rest := string(runes)
+	pos := 0
+	for len(rest) > 0 {
+		var cluster string
+		cluster, rest, _, state = uniseg.FirstGraphemeClusterInString(rest, state)
+		first, _ := utf8.DecodeRuneInString(cluster)
+		runName, _, err := Fonts.FontForRune(fontName, first)
+		if err != nil {
+			return nil, err
+		}
+		script := language.Common
+		for _, r := range cluster {
+			if s := language.LookupScript(r); s != language.Common && s != language.Inherited {
+				script = s
+				break
+			}
+		}
+		end := pos + utf8.RuneCountInString(cluster)
+		if len(runs) > 0 {
+			last := &runs[len(runs)-1]
+			if last.script == language.Common {
+				last.script = script
+			}
+			if last.fontName == runName && (script == language.Common || script == last.script) {
+				last.end = end
+				pos = end
+				continue
+			}
+		}
+		runs = append(runs, shapeRun{runName, script, pos, end})
+		pos = end
+	}
+	for i := range runs {
+		if runs[i].script == language.Common {
+			runs[i].script = language.Latin
+		}
+	}
+	return runs, nil
+}
+
+// Shape txt with fontName (and its fallbacks) at size points, as a single direction run.
+//
+// The clusters come back in display order, left to right, so for right-to-left text the first cluster is the end of the text.  Bidirectional text should be split into runs first, see BidiLevels
+func ShapeText(fontName string, size float64, txt string, rtl bool) ([]GlyphCluster, error) {
+	runes := []rune(txt)
+	byteOffsets := make([]int, len(runes)+1)
+	i := 0
+	for offset := range txt {
+		byteOffsets[i] = offset
+		i++
+	}
+	byteOffsets[len(runes)] = len(txt)
+
+	runs, err := shapeRuns(fontName, runes)
+	if err != nil {
+		return nil, err
+	}
+	dir := di.DirectionLTR
+	if rtl {
+		dir = di.DirectionRTL
+		for i, j := 0, len(runs)-1; i < j; i, j = i+1, j-1 {
+			runs[i], runs[j] = runs[j], runs[i]
+		}
+	}
+
+	shapeLock.Lock()
+	defer shapeLock.Unlock()
+	out := []GlyphCluster{}
+	for _, run := range runs {
+		face, err := otFace(run.fontName)
+		if err != nil {
+			return nil, err
+		}
+		shaped := shaper.Shape(shaping.Input{
+			Text:      runes,
+			RunStart:  run.start,
+			RunEnd:    run.end,
+			Direction: dir,
+			Face:      face,
+			Size:      shapePixels(size),
+			Script:    run.script,
+		})
+		for _, g := range shaped.Glyphs {
+			glyph := ShapedGlyph{run.fontName, uint32(g.GlyphID), g.XOffset, g.YOffset, g.XAdvance}
+			if len(out) > 0 && out[len(out)-1].Start == byteOffsets[g.ClusterIndex] {
+				last := &out[len(out)-1]
+				last.Glyphs = append(last.Glyphs, glyph)
+				last.Advance += g.XAdvance
+				continue
+			}
+			end := g.ClusterIndex + g.RuneCount
+			if end > run.end {
+				end = run.end
+			}
+			out = append(out, GlyphCluster{byteOffsets[g.ClusterIndex], byteOffsets[end], []ShapedGlyph{glyph}, g.XAdvance})
+		}
+	}
+	return out, nil
+}
+
+// The shaped form of one letter (token) of a paragraph
+type shapedLetter struct {
+	glyphs  []ShapedGlyph // The glyphs to draw for this letter.  When a cluster covers several letters, they are all drawn with the leftmost one
+	advance fixed.Int26_6 // The letter's share of its cluster's advance
+}
+
+// Can a paragraph drawn with these fonts be shaped?  Bitmap fonts have no OpenType tables, so a paragraph that uses one, even as a fallback, is laid out without shaping
+func shapeable(fonts []letterFont) bool {
+	seen := map[string]bool{}
+	for _, lf := range fonts {
+		if seen[lf.name] {
+			continue
+		}
+		seen[lf.name] = true
+		for _, name := range append([]string{lf.name}, Fonts.Fallbacks(lf.name)...) {
+			if txtFont, err := Fonts.Load(name); err == nil {
+				if _, ok := txtFont.(*BitmapFont); ok {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// Shape a paragraph that has been split into letters, one run at a time, where a run has one bidi level and one font.  Letters inside a cluster (e.g. a ligature) share its advance, so the cursor can still stop between them
+func shapeLetters(letters []string, levels []int, fonts []letterFont) ([]shapedLetter, error) {
+	out := make([]shapedLetter, len(letters))
+	start := 0
+	for start < len(letters) {
+		end := start + 1
+		for end < len(letters) && levels[end] == levels[start] && fonts[end].name == fonts[start].name && fonts[end].size == fonts[start].size && !isNewLine(letters[end]) && !isNewLine(letters[start]) {
+			end++
+		}
+		if isNewLine(letters[start]) {
+			start = end
+			continue
+		}
+		txt := ""
+		letterAt := []int{} // Byte offset -> letter
+		for i := start; i < end; i++ {
+			for range []byte(letters[i]) {
+				letterAt = append(letterAt, i)
+			}
+			txt += letters[i]
+		}
+		rtl := levels[start]%2 == 1
+		clusters, err := ShapeText(fonts[start].name, fonts[start].size, txt, rtl)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range clusters {
+			if c.Start >= len(txt) {
+				continue
+			}
+			first := letterAt[c.Start]
+			last := first
+			if c.End > c.Start {
+				last = letterAt[c.End-1]
+			}
+			lead := first
+			if rtl {
+				lead = last
+			}
+			out[lead].glyphs = append(out[lead].glyphs, c.Glyphs...)
+			n := fixed.Int26_6(last - first + 1)
+			share := c.Advance / n
+			for i := first; i <= last; i++ {
+				out[i].advance += share
+			}
+			out[lead].advance += c.Advance - share*n
+		}
+		start = end
+	}
+	return out, nil
+}
+
+// A cached drawing of some shaped glyphs
+type shapedKey struct {
+	Size   float64
+	DPI    float64
+	Colour [4]uint8
+	Glyphs string
+}
+
+type shapedImage struct {
+	img     *image.RGBA
+	originX int
+}
+
+// The space left before the pen start in drawShapedRGBA's images, for glyphs that reach back past the pen
+func shapedMargin(txtSize float64) int {
+	return int(txtSize)
+}
+
+// Draw shaped glyphs onto a canvas laid out like DrawStringRGBA's, with the same baseline.  Returns the image and the x position of the pen start in it
+func drawShapedRGBA(txtSize float64, fontColour RGBA, glyphs []ShapedGlyph) (*image.RGBA, int) {
+	dpi := TextDPI()
+	key := shapedKey{txtSize, dpi, colourKey(fontColour), fmt.Sprint(glyphs)}
+	if v, ok := renderCache.Get(key); ok {
+		s := v.(shapedImage)
+		return s.img, s.originX
+	}
+	px := shapePixels(txtSize)
+	margin := shapedMargin(txtSize)
+	width := 2 * margin
+	for _, g := range glyphs {
+		width += g.Advance.Ceil()
+	}
+	height := textCanvasHeight(txtSize)
+	baseline := float32(textBaseline(txtSize))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	shapeLock.Lock()
+	drawGlyphsAt(img, glyphs, fixed.I(margin), baseline, px, fontColour)
+	shapeLock.Unlock()
+
+	renderCache.Add(key, shapedImage{img, margin}, int64(len(img.Pix)))
+	return img, margin
+}
+
+// Draw shaped glyphs into img, with the pen starting at pen on the baseline, and return where the pen ends up.  Glyphs from colour fonts are drawn in their own colours.  Call with shapeLock held
+func drawGlyphsAt(img *image.RGBA, glyphs []ShapedGlyph, pen fixed.Int26_6, baseline float32, px fixed.Int26_6, fontColour RGBA) fixed.Int26_6 {
+	colour := image.NewUniform(RGBAtoColor(fontColour))
+	for _, g := range glyphs {
+		face, err := otFace(g.FontName)
+		if err != nil {
+			panic(err)
+		}
+		ox := float32(pen+g.XOffset) / 64
+		oy := baseline - float32(g.YOffset)/64
+		txtFont, _ := Fonts.Lookup(g.FontName)
+		if cf, ok := txtFont.(*ColourFont); ok {
+			cf.drawGlyph(img, otfont.GID(g.GlyphID), float32(px)/64, ox, oy, fontColour)
+		} else if outline, ok := face.GlyphData(otfont.GID(g.GlyphID)).(otfont.GlyphOutline); ok {
+			fillOutline(img, outline, float32(px)/64/float32(face.Upem()), ox, oy, colour)
+		}
+		pen += g.Advance
+	}
+	return pen
+}
@@ -0,0 +1,126 @@
+// Text styles.  Per token fonts, sizes, bold and italic, and letter spacing, with fake bold and italic for fonts that have no face for them
+package glim
+
+import (
+	"fmt"
+	"image"
+	"math"
+
+	"golang.org/x/image/math/fixed"
+)
+
+// How far fake italics lean, as a fraction of the height above the baseline.  About 11 degrees, like most italic fonts
+const fakeSlant = 0.2
+
+// The font a letter is drawn with, worked out from its Style and the FormatParams
+type letterFont struct {
+	name                 string // The font, or its bold or italic face
+	size                 float64
+	fakeBold, fakeItalic bool // There was no face for the style, so it is faked
+	spacing              float64
+}
+
+func styleFont(f *FormatParams, s Style, fontName string) letterFont {
+	lf := letterFont{name: fontName, size: f.FontSize, spacing: s.LetterSpacing}
+	if s.FontName != "" {
+		lf.name = s.FontName
+	}
+	if s.FontSize > 0 {
+		lf.size = s.FontSize
+	}
+	lf.name, lf.fakeBold, lf.fakeItalic = Fonts.StyleFont(lf.name, s.Bold, s.Italic)
+	lf.name = drawableFont(lf.name)
+	return lf
+}
+
+// The space added after every letter, for letter spacing and fake bold
+func (lf letterFont) extra() fixed.Int26_6 {
+	extra := lf.spacing
+	if lf.fakeBold {
+		extra += float64(fakeBoldWidth(lf.size))
+	}
+	return fixed.Int26_6(extra * 64)
+}
+
+// How far fake bold smears each glyph to the right
+func fakeBoldWidth(size float64) int {
+	return MaxI(1, int(size/12+0.5))
+}
+
+// Smear and/or slant rendered text, to fake bold and italic.  The image grows to fit, so the new origin is returned too
+func fakeStyle(img *image.RGBA, originX int, size float64, bold, italic bool) (*image.RGBA, int) {
+	w, h := img.Bounds().Dx(), img.Bounds().Dy()
+	baseline := textBaseline(size)
+	smear := 0
+	if bold {
+		smear = fakeBoldWidth(size)
+	}
+	lean := 0
+	if italic {
+		lean = int(math.Ceil(fakeSlant * float64(MaxI(baseline, h-baseline))))
+	}
+	out := image.NewRGBA(image.Rect(0, 0, w+smear+2*lean, h))
+	for y := 0; y < h; y++ {
+		shift := lean
+		if italic {
+			shift += int(math.Round(fakeSlant * float64(baseline-y)))
+		}
+		for x := 0; x < w; x++ {
+			src := img.Pix[y*img.Stride+x*4 : y*img.Stride+x*4+4]
+			if src[3] == 0 {
+				continue
+			}
+			for s := 0; s <= smear; s++ {
+				offset := y*out.Stride + (x+shift+s)*4
+				if dst := out.Pix[offset : offset+4]; src[3] > dst[3] {
+					copy(dst, src)
+				}
+			}
+		}
+	}
+	return out, originX + lean
+}
+
+// A cached drawing of text with fake bold or italic
+type styledKey struct {
+	Font         string // "" for shaped text, which can use any font
+	Size         float64
+	DPI          float64
+	Colour       [4]uint8
+	Text         string
+	Bold, Italic bool
+}
+
+type styledImage struct {
+	img     *image.RGBA
+	originX int
+}
+
+// Draw a laid out character.  Returns the image, where its pen starts in the image, and the render cache key the image is kept under
+func (g LayoutGlyph) image(colour RGBA) (*image.RGBA, int, interface{}) {
+	var img *image.RGBA
+	var key interface{}
+	dpi := TextDPI()
+	if g.shaped != nil {
+		img, _ = drawShapedRGBA(g.size, colour, g.shaped)
+		key = shapedKey{g.size, dpi, colourKey(colour), fmt.Sprint(g.shaped)}
+	} else if g.text != "" {
+		img, _ = DrawStringRGBA(g.size, colour, g.text, g.fontName)
+		key = renderKey{g.fontName, g.size, dpi, colourKey(colour), g.text}
+	}
+	if img == nil || (!g.fakeBold && !g.fakeItalic) {
+		return img, g.originX, key
+	}
+	styled := styledKey{g.fontName, g.size, dpi, colourKey(colour), g.text, g.fakeBold, g.fakeItalic}
+	if g.shaped != nil {
+		styled.Font = ""
+		styled.Text = key.(shapedKey).Glyphs
+	}
+	if v, ok := renderCache.Get(styled); ok {
+		s := v.(styledImage)
+		return s.img, s.originX, styled
+	}
+	out, originX := fakeStyle(img, g.originX, g.size, g.fakeBold, g.fakeItalic)
+	renderCache.Add(styled, styledImage{out, originX}, int64(len(out.Pix)))
+	return out, originX, styled
+}
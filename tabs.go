@@ -0,0 +1,176 @@
+// Tab stops.  Fixed stops every so many spaces or pixels, elastic tabstops that line up columns, and visible tabs
+package glim
+
+import (
+	"image"
+
+	"golang.org/x/image/math/fixed"
+)
+
+// How many lines above and below a line elastic tabstops look at to line up a column.  Keeps huge tables quick, at the cost of columns that drift apart every few thousand lines
+const elasticTabReach = 1000
+
+// Is this token a tab?  The two character escape `\t` counts too, like `\n` does for newlines
+func isTab(v string) bool {
+	return v == "\t" || v == `\t`
+}
+
+// Works out how far each tab goes, for one layout
+type tabStops struct {
+	every   fixed.Int26_6 // The distance between fixed stops
+	columns *tabColumns   // For elastic tabstops, nil for fixed ones
+}
+
+func newTabStops(f *FormatParams, tokens tokenView, fontName string, lineHeight int, vert bool) *tabStops {
+	space := TextAdvance(f.FontSize, " ", fontName)
+	if vert {
+		// Vertical text has a character per line height
+		space = fixed.I(lineHeight)
+	}
+	width := f.TabWidth
+	if width <= 0 {
+		width = 4
+	}
+	t := &tabStops{every: fixed.Int26_6(float64(space) * width)}
+	if f.TabPixels > 0 {
+		t.every = fixed.I(f.TabPixels)
+	}
+	if t.every <= 0 {
+		t.every = fixed.I(1)
+	}
+	if f.ElasticTabs && !vert {
+		t.columns = &tabColumns{f: f, tokens: tokens, fontName: fontName, padding: 2 * space.Ceil(), cells: map[int][]tabCell{}, stops: map[int]map[int]int{}}
+	}
+	return t
+}
+
+// How far the tab at token index goes, when it starts pos pixels (plus frac) from the start of the line
+func (t *tabStops) advance(index, pos int, frac fixed.Int26_6) fixed.Int26_6 {
+	at := fixed.I(pos) + frac
+	if t.columns != nil {
+		if stop, ok := t.columns.stop(index); ok && fixed.I(stop) > at {
+			return fixed.I(stop) - at
+		}
+		// A cell that doesn't fit its column, e.g. because the line wrapped
+		return fixed.I(t.columns.padding)
+	}
+	return (at/t.every+1)*t.every - at
+}
+
+// Some text ended by a tab
+type tabCell struct {
+	tab   int // The token index of the tab
+	width int
+}
+
+// Elastic tabstops (see nickgravgaard.com/elastic-tabstops).  The text before each tab on a line is a cell, and cells in the same column on neighbouring lines are made as wide as the widest of them, so tab separated text lines up in a table
+type tabColumns struct {
+	f        *FormatParams
+	tokens   tokenView
+	fontName string
+	padding  int                 // Space left after the widest cell of a column
+	cells    map[int][]tabCell   // The cells of each line, by the line's first token
+	stops    map[int]map[int]int // Where each tab on a line ends, from the start of the line, by the line's first token then the tab's
+}
+
+// The cells of the hard line starting at start
+func (c *tabColumns) lineCells(start int) []tabCell {
+	if cells, ok := c.cells[start]; ok {
+		return cells
+	}
+	_, end := lineBounds(c.f.lineIndex(c.tokens), c.tokens, start)
+	cells := []tabCell{}
+	letters := []string{}
+	fonts := []letterFont{}
+	for i := start; i < end; i++ {
+		if isTab(c.tokens.At(i).Text) {
+			cells = append(cells, tabCell{i, pieceWidth(letters, fonts, 0, len(letters))})
+			letters, fonts = letters[:0], fonts[:0]
+			continue
+		}
+		letters = append(letters, c.tokens.At(i).Text)
+		fonts = append(fonts, styleFont(c.f, c.tokens.At(i).Style, c.fontName))
+	}
+	c.cells[start] = cells
+	return cells
+}
+
+// Where the tab at token index ends, counting from the start of its line.  False if it isn't a tab
+func (c *tabColumns) stop(index int) (int, bool) {
+	start, _ := lineBounds(c.f.lineIndex(c.tokens), c.tokens, index)
+	stops, ok := c.stops[start]
+	if !ok {
+		stops = c.lineStops(start)
+		c.stops[start] = stops
+	}
+	x, ok := stops[index]
+	return x, ok
+}
+
+// Work out where the tabs on the line starting at start end.  A column runs up and down through the neighbouring lines that have a cell in it
+func (c *tabColumns) lineStops(start int) map[int]int {
+	stops := map[int]int{}
+	x := 0
+	for col, cell := range c.lineCells(start) {
+		width := cell.width
+		for _, dir := range []int{-1, 1} {
+			line := start
+			for n := 0; n < elasticTabReach; n++ {
+				var ok bool
+				if line, ok = c.neighbour(line, dir); !ok {
+					break
+				}
+				cells := c.lineCells(line)
+				if len(cells) <= col {
+					break
+				}
+				width = MaxI(width, cells[col].width)
+			}
+		}
+		x += width + c.padding
+		stops[cell.tab] = x
+	}
+	return stops
+}
+
+// The start of the line before (dir -1) or after (dir 1) the line starting at start
+func (c *tabColumns) neighbour(start, dir int) (int, bool) {
+	if dir < 0 {
+		if start == 0 {
+			return 0, false
+		}
+		prev, _ := lineBounds(c.f.lineIndex(c.tokens), c.tokens, start-1)
+		return prev, true
+	}
+	_, end := lineBounds(c.f.lineIndex(c.tokens), c.tokens, start)
+	if end >= c.tokens.Len() {
+		return 0, false
+	}
+	return end + 1, true
+}
+
+// Draw a tab as an arrow across the space it takes up, for FormatParams.ShowTabs
+func (l *Layout) paintTab(g LayoutGlyph, pixWidth, pixHeight int, u8Pix []uint8, colour *RGBA) {
+	thickness, _ := decorationMetrics(g.size)
+	head := MaxI(2, textBaseline(g.size)/4)
+	// Along the line, from the start of the tab to the end, through the middle of the lower case letters
+	along0, along1 := g.Rect.Min.X+thickness, g.Rect.Max.X-thickness
+	across := g.Baseline - textBaseline(g.size)/4
+	if l.Vertical {
+		along0, along1 = g.Rect.Min.Y+thickness, g.Rect.Max.Y-thickness
+		across = (g.Rect.Min.X + g.Rect.Max.X) / 2
+	}
+	if along1-along0 < 2*head {
+		return
+	}
+	l.decorationLine(along0, along1, across, thickness, false, pixWidth, pixHeight, u8Pix, colour)
+	for d := 1; d <= head; d++ {
+		for _, side := range []int{-d, d} {
+			r := image.Rect(along1-d, across+side, along1-d+thickness, across+side+thickness)
+			if l.Vertical {
+				r = image.Rect(across+side, along1-d, across+side+thickness, along1-d+thickness)
+			}
+			fillClipped(r, l.Clip, pixWidth, pixHeight, u8Pix, colour)
+		}
+	}
+}
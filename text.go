@@ -2,6 +2,7 @@
 package glim
 
 import (
+	"image"
 	"math"
 	_ "net/http/pprof"
 
@@ -9,33 +10,67 @@ import (
 	_ "fmt"
 	_ "image/jpeg"
 	"log"
-	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 
 	_ "image/png"
+
+	"github.com/rivo/uniseg"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/text/unicode/bidi"
 )
 
 // Holds all the configuration details for drawing a string into a texture.  This structure gets written to during the draw
 type FormatParams struct {
 	Colour            *RGBA   // Text colour
 	Line              int     // The line number, i.e. the number of /n characters from the start
-	Cursor            int     // The cursor position, in characters from the start of the text
+	Cursor            int     // The cursor position, in characters (grapheme clusters, so an accented letter or an emoji sequence counts as one) from the start of the text
 	SelectStart       int     // Start of the selection box, counted from the start of document
 	SelectEnd         int     // End of the selection box, counted from the start of document
 	StartLinePos      int     // Updated during render, holds the closest start of line, including soft line breaks
 	FontSize          float64 // Fontsize, in points or something idfk
 	FirstDrawnCharPos int     // The first character to draw on the screen.  Anything before this is ignored
 	LastDrawnCharPos  int     // The last character that we were able to fit on the screen
-	TailBuffer        bool    // Nothing for now
-	Outline           bool    // Nothing for now
+	TailBuffer        bool    // Follow the end of the text, like tail -f.  Every layout scrolls so the last line is on screen
+	Outline           bool    // Deprecated: Does nothing, and NewFormatter leaves it off.  Set Effects to draw outlines
 	Vertical          bool    // Draw texture vertically for Chinese/Japanese rendering
 	SelectColour      *RGBA   // Selection text colour
 	CursorColour      *RGBA
 	HighlightColour   *RGBA
+	FontName          string       // The font to draw with, looked up with LoadFont
+	SubPixel          bool         // Keep the pen position in fractions of a pixel, so rounding errors don't add up along the line.  Otherwise every advance is rounded to whole pixels
+	Shaping           bool         // Shape horizontal text with the font's OpenType rules, for ligatures, Arabic joining, Indic scripts and combining marks.  Slower, so it is off by default.  Paragraphs using bitmap fonts aren't shaped
+	ScrollOffset      int          // Pixels scrolled past the top of the line starting at FirstDrawnCharPos (past the right edge of the column, for vertical text), for smooth scrolling.  See ScrollBy
+	LineIndex         *LineIndex   // Finds hard lines without searching the text.  Optional, and ignored unless IndexGeneration matches it.  TextBuffer sets and updates it
+	IndexGeneration   uint64       // The LineIndex.Generation that matches the tokens being drawn.  Set it whenever the tokens and the index change
+	BackgroundColour  *RGBA        // Fills the draw region before the text is drawn.  nil draws straight over what is already there
+	TabWidth          float64      // Tab stops are this many spaces apart (line heights apart, for vertical text).  0 for 4
+	TabPixels         int          // If set, tab stops are this many pixels apart instead
+	ElasticTabs       bool         // Line up tab separated columns with the lines above and below (elastic tabstops), instead of using fixed stops.  Horizontal text only
+	ShowTabs          bool         // Draw tabs as arrows
+	Align             Alignment    // Where lines go between minX and maxX (minY and maxY, for vertical text)
+	LineHeight        float64      // Multiplies the height of every line, e.g. 1.5 for extra space between lines.  0 for 1
+	Leading           int          // If set, lines are exactly this many pixels apart, whatever is on them, instead of using LineHeight
+	SpaceBefore       int          // Pixels of extra space before each paragraph, i.e. after every newline and at the start of the text
+	SpaceAfter        int          // Pixels of extra space after each paragraph
+	Effects           *TextEffects // Outline, shadow and glow drawn behind the text.  nil for none
 }
 
 // Create a new text formatter, with useful default parameters
 func NewFormatter() *FormatParams {
-	return &FormatParams{&RGBA{5, 5, 5, 255}, 0, 0, 0, 0, 0, 22.0, 0, 0, false, true, false, &RGBA{255, 128, 128, 255}, &RGBA{255, 0, 0, 255}, &RGBA{255, 255, 0, 255}}
+	return &FormatParams{
+		Colour:          &RGBA{5, 5, 5, 255},
+		FontSize:        22.0,
+		SelectColour:    &RGBA{255, 128, 128, 255},
+		CursorColour:    &RGBA{255, 0, 0, 255},
+		HighlightColour: &RGBA{255, 255, 0, 255},
+		FontName:        DefaultFontName,
+		TabWidth:        4,
+		Align:           AlignStart,
+		LineHeight:      1,
+	}
 }
 
 // Draw a cursor shape
@@ -179,20 +214,101 @@ func RenderPara(f *FormatParams, xpos, ypos, minX, minY, maxX, maxY, pixWidth, p
 	// re := regexp.MustCompile(`\t`)
 	// text = re.ReplaceAllLiteralString(text, "    ")
 	// strs := strings.SplitAfter(text, " ")
-	letterz := []rune(text)
+	letterz := Graphemes(text)
 	out := []Token{}
 	for _, v := range letterz {
-		out = append(out, Token{string(v), Style{ForegroundColour: f.Colour}})
+		out = append(out, Token{v, Style{ForegroundColour: f.Colour}})
 	}
 	return RenderTokenPara(f, xpos, ypos, minX, minY, maxX, maxY, pixWidth, pixHeight, cursorX, cursorY, u8Pix, out, transparent, doDraw, showCursor)
 }
 
+// Split text into grapheme clusters, the units that a reader sees as single characters.  RenderPara draws one token per cluster, so the cursor and selection never land inside one
+func Graphemes(text string) []string {
+	out := []string{}
+	state := -1
+	for len(text) > 0 {
+		var cluster string
+		cluster, text, _, state = uniseg.FirstGraphemeClusterInString(text, state)
+		out = append(out, cluster)
+	}
+	return out
+}
+
+// Convert a cursor position (in grapheme clusters) to a byte offset in text, e.g. to insert at the cursor
+func GraphemeByteOffset(text string, pos int) int {
+	offset := 0
+	state := -1
+	for i := 0; i < pos && offset < len(text); i++ {
+		var cluster string
+		cluster, _, _, state = uniseg.FirstGraphemeClusterInString(text[offset:], state)
+		offset += len(cluster)
+	}
+	return offset
+}
+
 func isNewLine(v string) bool {
-	return (v == "\n") || (v == `\n`)
+	return (v == "\n") || (v == `\n`) || (v == "\r\n")
+}
+
+// Find the places where a line may be soft wrapped, using the Unicode line breaking rules (UAX #14).
+//
+// The result has one entry per letter.  If a line may break before letters[i], then the entry holds the index just past the end of the unbreakable piece (usually a word and its trailing spaces) that starts there.  Otherwise it is 0.  Breaks inside a letter are ignored
+func softBreaks(letters []string) []int {
+	out := make([]int, len(letters))
+	starts := map[int]int{} // Byte offset of each letter -> letter index
+	var text strings.Builder
+	for i, v := range letters {
+		starts[text.Len()] = i
+		text.WriteString(v)
+	}
+	offset := 0
+	state := -1
+	prevStart := -1
+	rest := text.String()
+	for len(rest) > 0 {
+		var segment string
+		segment, rest, _, state = uniseg.FirstLineSegmentInString(rest, state)
+		if i, ok := starts[offset]; ok {
+			if prevStart >= 0 {
+				out[prevStart] = i
+			}
+			out[i] = len(letters)
+			prevStart = i
+		}
+		offset += len(segment)
+	}
+	return out
+}
+
+// The width of the piece of text from letters[start] to letters[end], not counting trailing spaces, which are allowed to hang past the margin.  Letters in the same font are measured together, so they are kerned
+func pieceWidth(letters []string, fonts []letterFont, start, end int) int {
+	width := fixed.I(0)
+	for k := start; k < end; {
+		run := k + 1
+		for run < end && fonts[run] == fonts[k] {
+			run++
+		}
+		piece := strings.Join(letters[k:run], "")
+		if run == end {
+			piece = strings.TrimRightFunc(piece, unicode.IsSpace)
+		}
+		width += TextAdvance(fonts[k].size, piece, fonts[k].name) + fonts[k].extra()*fixed.Int26_6(run-k)
+		k = run
+	}
+	return width.Ceil()
 }
 
 type Style struct {
-	ForegroundColour *RGBA // Text colour
+	ForegroundColour *RGBA     // Text colour
+	FontName         string    // The font, looked up with LoadFont.  Empty for FormatParams.FontName
+	FontSize         float64   // Empty for FormatParams.FontSize
+	Bold, Italic     bool      // Drawn with the font's styles (see SetFontStyles), or faked if it has none
+	LetterSpacing    float64   // Extra space after every character, in pixels
+	BackgroundColour *RGBA     // Filled in behind the text, nil for none
+	Underline        Underline // UnderlineNone, UnderlineStraight or UnderlineWavy
+	UnderlineColour  *RGBA     // nil to use the text colour
+	Strikethrough    bool
+	BoxColour        *RGBA // Draws a box around the text, nil for none.  Neighbouring tokens with the same box colour share a box
 }
 
 type Token struct {
@@ -200,37 +316,279 @@ type Token struct {
 	Style Style
 }
 
+// Tokens in two pieces, one after the other, like the text either side of a TextBuffer's gap, so the buffer can be laid out without closing the gap
+type tokenView struct {
+	head, tail []Token
+	generation uint64 // The LineIndex generation these tokens match, or 0 if they don't know
+}
+
+func flatTokens(tokens []Token) tokenView {
+	return tokenView{head: tokens}
+}
+
+func (v tokenView) Len() int {
+	return len(v.head) + len(v.tail)
+}
+
+func (v tokenView) At(i int) Token {
+	if i < len(v.head) {
+		return v.head[i]
+	}
+	return v.tail[i-len(v.head)]
+}
+
+// The tokens from start to end, not including end
+func (v tokenView) Slice(start, end int) tokenView {
+	if end <= len(v.head) {
+		return tokenView{head: v.head[start:end]}
+	}
+	if start >= len(v.head) {
+		return tokenView{head: v.tail[start-len(v.head) : end-len(v.head)]}
+	}
+	return tokenView{head: v.head[start:], tail: v.tail[:end-len(v.head)]}
+}
+
+// A character that has been placed on the current line, but not finished yet.  Lines are finished all at once, so that they can be put into display order for bidirectional text
+type lineGlyph struct {
+	index   int           // Position in the text, in logical order
+	text    string        // What to draw.  Empty if there is nothing to draw, e.g. for the second letter of a ligature
+	shaped  []ShapedGlyph // What to draw, for shaped text
+	colour  RGBA
+	font    letterFont
+	style   Style
+	originX int // Where the pen starts in the rendered text
+	x, y    int // Top left of the character.  Along the line, this is the logical position until the line is reordered
+	w, h    int // Advance width and line height
+	advance int // Distance along the line, i.e. w for horizontal text, and the line height for vertical text
+	ytweak  int
+	hold    bool // Only holds the cursor
+	level   int  // Bidi embedding level, odd for right-to-left
+	base    int  // Bidi level of the paragraph
+	space   bool
+	tab     bool
+}
+
+// The bidi embedding level of each letter, and of the paragraph it is in.  Paragraphs end at newlines
+func letterBidiLevels(letters []string) ([]int, []int) {
+	levels := make([]int, len(letters))
+	bases := make([]int, len(letters))
+	start := 0
+	for end := 0; end <= len(letters); end++ {
+		if end < len(letters) && !isNewLine(letters[end]) {
+			continue
+		}
+		runes := []rune{}
+		first := make([]int, end-start)
+		for i := start; i < end; i++ {
+			first[i-start] = len(runes)
+			runes = append(runes, []rune(letters[i])...)
+		}
+		runeLevels, base := BidiLevels(runes, -1)
+		for i := start; i < end; i++ {
+			levels[i] = base
+			if first[i-start] < len(runes) {
+				levels[i] = runeLevels[first[i-start]]
+			}
+			bases[i] = base
+		}
+		if end < len(letters) {
+			levels[end] = base
+			bases[end] = base
+		}
+		start = end + 1
+	}
+	return levels, bases
+}
+
+// Reverse a right-to-left token for drawing, keeping each grapheme cluster in order and mirroring brackets
+func reverseRTL(v string) string {
+	clusters := Graphemes(v)
+	out := ""
+	for k := len(clusters) - 1; k >= 0; k-- {
+		if utf8.RuneCountInString(clusters[k]) == 1 {
+			out += bidi.ReverseString(clusters[k])
+		} else {
+			out += clusters[k]
+		}
+	}
+	return out
+}
+
+// Put a line into display order (UAX #9 rules L1 and L2), by moving the characters along the line.  Right-to-left paragraphs are lined up against the end of the line
+func reorderLine(line []lineGlyph, vert bool, start, end int) {
+	if len(line) == 0 {
+		return
+	}
+	levels := make([]int, len(line))
+	trailing := true
+	total := 0
+	mixed := line[0].base%2 == 1
+	for k := len(line) - 1; k >= 0; k-- {
+		levels[k] = line[k].level
+		if trailing && (line[k].space || line[k].hold) {
+			levels[k] = line[k].base
+		} else {
+			trailing = false
+		}
+		total += line[k].advance
+		if levels[k]%2 == 1 {
+			mixed = true
+		}
+	}
+	if !mixed {
+		return
+	}
+	pos := line[0].x
+	if vert {
+		pos = line[0].y
+	}
+	if line[0].base%2 == 1 && !vert {
+		pos = end - total
+	}
+	placed := make([]lineGlyph, len(line))
+	copy(placed, line)
+	for _, k := range BidiVisualOrder(levels) {
+		g := placed[k]
+		if vert {
+			g.y = pos
+		} else {
+			g.x = pos
+		}
+		pos += g.advance
+		line[k] = g
+	}
+}
+
+// Where to draw the cursor for the character, i.e. the edge it is on when the text is read in order
+func caretPos(g lineGlyph, vert bool) (int, int) {
+	if g.level%2 == 1 {
+		if vert {
+			return g.x, g.y + g.advance
+		}
+		return g.x + g.advance, g.y
+	}
+	return g.x, g.y
+}
+
+// Draw tokens into u8Pix, and find the cursor position under (cursorX, cursorY).  This is LayoutTokenPara, followed by Layout.HitTest and Layout.Paint
 func RenderTokenPara(f *FormatParams, xpos, ypos, minX, minY, maxX, maxY, pixWidth, pixHeight, cursorX, cursorY int, u8Pix []uint8, tokens []Token, transparent bool, doDraw bool, showCursor bool) (int, int, int) {
-	cursorDist := 9999999
-	seekCursorPos := 0
-	vert := f.Vertical
-	hitFound := false
-	selStart := f.SelectStart
-	selEnd := f.SelectEnd
-	hasSelection := selStart >= 0 && selEnd >= 0 && selStart != selEnd
-	if hasSelection && selStart > selEnd {
-		selStart, selEnd = selEnd, selStart
+	return renderTokens(f, xpos, ypos, minX, minY, maxX, maxY, pixWidth, pixHeight, cursorX, cursorY, u8Pix, flatTokens(tokens), transparent, doDraw, showCursor)
+}
+
+// RenderTokenPara on a tokenView
+func renderTokens(f *FormatParams, xpos, ypos, minX, minY, maxX, maxY, pixWidth, pixHeight, cursorX, cursorY int, u8Pix []uint8, tokens tokenView, transparent bool, doDraw bool, showCursor bool) (int, int, int) {
+	layout := layoutTokens(f, xpos, ypos, minX, minY, maxX, maxY, tokens)
+	if f.Cursor > tokens.Len() {
+		f.Cursor = tokens.Len()
+	}
+	seekCursorPos := layout.HitTest(cursorX, cursorY)
+	if doDraw {
+		layout.Paint(f, pixWidth, pixHeight, u8Pix, showCursor)
+	}
+	return seekCursorPos, layout.EndX, layout.EndY
+}
+
+// The letters of one hard line, with what has to be worked out for the whole line before any of it can be laid out: where it may wrap, bidi levels, and shaping
+type paraText struct {
+	start   int // The token index of the first letter
+	letters []string
+	markup  []Style
+	fonts   []letterFont
+	breaks  []int // See softBreaks, but holding token indexes
+	levels  []int
+	bases   []int
+	shaped  []shapedLetter
+}
+
+// Prepare the hard line starting at tokens[start], up to and including its newline.  The last line gets an extra space, which holds the cursor at the end of the text
+func newParaText(f *FormatParams, tokens tokenView, start int, fontName string) *paraText {
+	p := &paraText{start: start}
+	end := start
+	for end < tokens.Len() {
+		end++
+		if isNewLine(tokens.At(end - 1).Text) {
+			break
+		}
+	}
+	for i := start; i < end; i++ {
+		v := tokens.At(i)
+		text := v.Text
+		if isTab(text) {
+			text = "\t"
+		}
+		p.letters = append(p.letters, text)
+		p.markup = append(p.markup, v.Style)
+	}
+	if end == tokens.Len() && (end == start || !isNewLine(tokens.At(end-1).Text)) {
+		p.letters = append(p.letters, " ")
+		p.markup = append(p.markup, Style{})
+	}
+	for _, style := range p.markup {
+		p.fonts = append(p.fonts, styleFont(f, style, fontName))
+	}
+	p.breaks = softBreaks(p.letters)
+	for k := range p.breaks {
+		if p.breaks[k] > 0 {
+			p.breaks[k] += start
+		}
+	}
+	p.levels, p.bases = letterBidiLevels(p.letters)
+	if f.Shaping && !f.Vertical && shapeable(p.fonts) {
+		var err error
+		p.shaped, err = shapeLetters(p.letters, p.levels, p.fonts)
+		if err != nil {
+			panic(err)
+		}
+	}
+	return p
+}
+
+// The width of the piece from token start to end, see pieceWidth
+func (p *paraText) width(start, end int) int {
+	start -= p.start
+	end -= p.start
+	if p.shaped == nil {
+		return pieceWidth(p.letters, p.fonts, start, end)
 	}
+	// The shaper did the kerning and mirroring, and measures every piece in shaped advances
+	width := fixed.I(0)
+	for end > start && strings.TrimSpace(p.letters[end-1]) == "" {
+		end--
+	}
+	for k := start; k < end; k++ {
+		width += p.shaped[k].advance + p.fonts[k].extra()
+	}
+	return width.Ceil()
+}
+
+// Work out where every token goes, without drawing anything.  Like RenderTokenPara, this updates f.Line, f.StartLinePos and f.LastDrawnCharPos
+func LayoutTokenPara(f *FormatParams, xpos, ypos, minX, minY, maxX, maxY int, tokens []Token) *Layout {
+	return layoutTokens(f, xpos, ypos, minX, minY, maxX, maxY, flatTokens(tokens))
+}
+
+// LayoutTokenPara on a tokenView
+func layoutTokens(f *FormatParams, xpos, ypos, minX, minY, maxX, maxY int, tokens tokenView) *Layout {
+	vert := f.Vertical
 	// selectColour := color.RGBA{255, 1, 1, 255}
 	// highlightColour := color.RGBA{1, 255, 1, 255}
 	// colSwitch := false
 	if f.TailBuffer {
-		// f.Cursor = len(text)
-		// scrollToCursor(f, text)  //Use pageup function, once it is fast enough
+		scrollToIndex(f, tokens.Len(), minX, minY, maxX, maxY, tokens)
 	}
 	// log.Printf("Cursor: %v\n", f.Cursor)
-	var letters []string
-	var markup []Style
-	for _, v := range tokens {
-		re := regexp.MustCompile(`\\t`)
-		t := re.ReplaceAllLiteralString(v.Text, "    ")
-		letters = append(letters, t)
-		markup = append(markup, v.Style)
+	first := f.FirstDrawnCharPos
+	if first < 0 {
+		first = 0
+	}
+	if first > tokens.Len() {
+		first = tokens.Len()
 	}
-
-	letters = append(letters, " ")
-	markup = append(markup, Style{})
 	orig_fontSize := f.FontSize
+	fontName := f.FontName
+	if fontName == "" {
+		fontName = DefaultFontName
+	}
+	fontName = drawableFont(fontName)
 	defer func() {
 		f.FontSize = orig_fontSize
 		// SanityCheck(f, text)
@@ -240,23 +598,192 @@ func RenderTokenPara(f *FormatParams, xpos, ypos, minX, minY, maxX, maxY, pixWid
 	if vert {
 		xpos = maxX
 	}
-	gx, gy := GetGlyphSize(f.FontSize, letters[0])
+	// Only the hard lines that get laid out are prepared, starting with the one holding the first token, so big texts cost no more than small ones
+	index := f.lineIndex(tokens)
+	paraStart, _ := lineBounds(index, tokens, first)
+	p := newParaText(f, tokens, paraStart, fontName)
+	gx, gy := glyphSize(f.FontSize, p.letters[0], fontName)
+	baseHeight := Fixed2int(cachedFace(fontName, mustLoadFont(fontName), f.FontSize, TextDPI()).Metrics().Height)
+	tabs := newTabStops(f, tokens, fontName, baseHeight, vert)
 	// fmt.Printf("Chose position %v, maxX: %v\n", pos, maxX)
 	pos := MoveInBounds(Vec2{xpos, ypos}, Vec2{minX, minY}, Vec2{maxX, maxY}, Vec2{gx, gy}, Vec2{0, 1}, Vec2{-1, 0}, 10)
 	xpos = pos.X
 	ypos = pos.Y
-	maxHeight := 0
-	letterWidth := 100
+	// Scrolled text is laid out past the bottom of the box (to the left, for vertical text) by the scroll offset, plus a line for the partly shown last line, then moved back and clipped
+	clip := image.Rect(minX, minY, maxX, maxY)
+	scroll := f.ScrollOffset
+	if scroll != 0 {
+		if vert {
+			minX -= scroll + gy
+		} else {
+			maxY += scroll + gy
+		}
+	}
+	// Every line is at least as tall as the font, so a line is the same height however much of the text before it was laid out.  Letters of different sizes share the line's baseline, which is as far down as the tallest letter needs
+	baseAscent := textBaseline(f.FontSize)
+	maxHeight := baseHeight
+	lineAscent, lineDescent := baseAscent, baseHeight-baseAscent
+	newLine := func() {
+		maxHeight = baseHeight
+		lineAscent, lineDescent = baseAscent, baseHeight-baseAscent
+	}
+	// The distance from one line to the next, without paragraph spacing
+	linePitch := func() int {
+		if f.Leading > 0 {
+			return f.Leading
+		}
+		if f.LineHeight > 0 {
+			return int(math.Round(float64(maxHeight) * f.LineHeight))
+		}
+		return maxHeight
+	}
+	paraFirstLine := first == paraStart // The next line to be finished starts a paragraph
+	lastPitch := 0                      // The pitch of the last line finished, including paragraph spacing
 	wobblyMode := false
-	if f.Cursor > len(letters) {
-		f.Cursor = len(letters)
+	penFrac := fixed.I(0)    // The part of the pen position that didn't fit in xpos, when f.SubPixel is set
+	prevRune := rune(-1)     // The last character drawn on this line, for kerning
+	prevFont := letterFont{} // and its font
+
+	layout := &Layout{
+		First:    first,
+		Count:    tokens.Len(),
+		Vertical: vert,
+		tokens:   tokens,
+		index:    index,
+	}
+	finish := func() *Layout {
+		layout.EndX = xpos
+		layout.EndY = ypos
+		if vert {
+			layout.shift(scroll, 0)
+		} else {
+			layout.shift(0, -scroll)
+		}
+		layout.Clip = clip
+		layout.Last = f.LastDrawnCharPos
+		return layout
 	}
-	// sanityCheck(f,txt)
-	for i, v := range letters {
 
-		style := markup[i]
+	// Characters are placed in logical order, and held until the line is finished.  Then the line is put in display order and added to the layout
+	line := []lineGlyph{}
+	flushLine := func(paraEnd bool) {
+		// Extra line height is shared above and below the line, and paragraph spacing goes on the first and last lines of a paragraph, so each line's pitch covers all the space it takes up
+		pitch := linePitch()
+		offset := (pitch - maxHeight) / 2
+		if paraFirstLine {
+			offset += f.SpaceBefore
+			pitch += f.SpaceBefore
+		}
+		if paraEnd {
+			pitch += f.SpaceAfter
+		}
+		lastPitch = pitch
+		paraFirstLine = paraEnd
+		if len(line) == 0 {
+			return
+		}
+		for k := range line {
+			if vert {
+				line[k].x -= offset
+			} else {
+				line[k].y += offset
+			}
+		}
+		reorderLine(line, vert, minX, maxX)
+		if vert {
+			alignLine(line, f.Align, vert, minY, maxY, paraEnd)
+		} else {
+			alignLine(line, f.Align, vert, minX, maxX, paraEnd)
+		}
+		order := make([]int, len(line))
+		for k := range order {
+			order[k] = k
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			if vert {
+				return line[order[a]].y < line[order[b]].y
+			}
+			return line[order[a]].x < line[order[b]].x
+		})
+		caretHeight := maxHeight
+		if caretHeight <= 0 {
+			caretHeight = gy
+		}
+		lineNo := len(layout.Lines)
+		out := LayoutLine{Start: line[0].index, End: line[len(line)-1].index + 1, Baseline: line[0].y + lineAscent, Pitch: pitch}
+		baselineSet := false
+		for _, k := range order {
+			g := line[k]
+			cx, cy := caretPos(g, vert)
+			caret := image.Rect(cx, cy, cx+6, cy+caretHeight)
+			layout.setCaret(g.index, caret)
+			out.Rect = out.Rect.Union(caret)
+			if g.hold {
+				continue
+			}
+			w := g.w
+			h := g.h
+			if w <= 0 {
+				w = gx
+			}
+			if h <= 0 {
+				h = gy
+			}
+			// Vertical text has no shared baseline, each letter sits at the top of its own box
+			ascent := textBaseline(g.font.size)
+			baseline := g.y + ascent
+			if !vert {
+				baseline = g.y + lineAscent
+			}
+			rect := image.Rect(g.x, baseline-ascent, g.x+w, baseline-ascent+h)
+			out.Rect = out.Rect.Union(rect)
+			if !baselineSet {
+				out.Baseline = baseline
+				baselineSet = true
+			}
+			layout.setTokenGlyph(g.index, len(layout.Glyphs))
+			layout.Glyphs = append(layout.Glyphs, LayoutGlyph{
+				Index:      g.index,
+				Rect:       rect,
+				Baseline:   baseline + g.ytweak,
+				Line:       lineNo,
+				Level:      g.level,
+				text:       g.text,
+				shaped:     g.shaped,
+				fontName:   g.font.name,
+				size:       g.font.size,
+				colour:     g.colour,
+				originX:    g.originX,
+				fakeBold:   g.font.fakeBold,
+				fakeItalic: g.font.fakeItalic,
+				style:      g.style,
+				tab:        g.tab,
+			})
+		}
+		if vert {
+			out.Baseline = out.Rect.Min.X
+		}
+		layout.Lines = append(layout.Lines, out)
+		line = line[:0]
+	}
+	// A zero width character, that only holds the cursor position at the end of a line or the text
+	holdCursor := func(i int) {
+		line = append(line, lineGlyph{index: i, x: xpos, y: ypos, h: maxHeight, hold: true, level: p.levels[i-p.start], base: p.bases[i-p.start], space: true})
+	}
+
+	// sanityCheck(f,txt)
+	for i := first; i <= tokens.Len(); i++ {
+		if i >= p.start+len(p.letters) {
+			p = newParaText(f, tokens, i, fontName)
+		}
+		k := i - p.start
+		v := p.letters[k]
+		style := p.markup[k]
 
 		foreGround := style.ForegroundColour
+		if foreGround == nil {
+			foreGround = f.Colour
+		}
 		if foreGround == nil {
 			foreGround = &RGBA{255, 255, 255, 255}
 		}
@@ -265,16 +792,8 @@ func RenderTokenPara(f *FormatParams, xpos, ypos, minX, minY, maxX, maxY, pixWid
 		if isNewLine(v) {
 			v = "\n"
 		}
-		if v == `\t` {
-			v = "    "
-		}
-		if i < f.FirstDrawnCharPos {
-			continue
-		}
-		if (showCursor && f.Cursor == i) && doDraw {
-			DrawCursor(xpos, ypos, maxHeight, pixWidth, u8Pix, f.CursorColour)
-		}
-		if i >= len(letters)-1 {
+		if i == tokens.Len() {
+			holdCursor(i)
 			continue
 		}
 		// foreGround = orig_colour
@@ -284,144 +803,189 @@ func RenderTokenPara(f *FormatParams, xpos, ypos, minX, minY, maxX, maxY, pixWid
 			// log.Printf("Oversize end for %v at %v\n", v, i)
 		}
 		if isNewLine(v) {
+			holdCursor(i)
+			flushLine(true)
+			penFrac = 0
+			prevRune = -1
 			if vert {
-				xpos = xpos - maxHeight
+				xpos = xpos - lastPitch
 				ypos = minY
 			} else {
-				ypos = ypos + maxHeight
+				ypos = ypos + lastPitch
 				xpos = minX
-				if i > 0 && !isNewLine(letters[i-1]) {
-					maxHeight = 12 // FIXME
-				}
 			}
+			newLine()
 			// fmt.Printf("Newline char forces line++\n")
 			f.Line = f.Line + 1
 			f.StartLinePos = i
-			if f.Cursor == i && showCursor {
-				DrawCursor(xpos, ypos, maxHeight, pixWidth, u8Pix, f.CursorColour)
-			}
 		} else {
 			if i >= f.FirstDrawnCharPos {
 				ytweak := 0
 				if wobblyMode {
 					ytweak = int(math.Sin(float64(xpos)) * 5.0)
 				}
-				selected := hasSelection && i >= selStart && i <= selEnd
-				if selected && f.SelectColour != nil {
-					foreGround = f.SelectColour
+				var glyphs []ShapedGlyph
+				var originX, letterHeight int
+				var advance fixed.Int26_6
+				lf := p.fonts[k]
+				YmaX := textCanvasHeight(lf.size)
+				tab := isTab(v)
+				if tab {
+					// Tabs run to the next tab stop, measured from the start of the line
+					letterHeight = Fixed2int(cachedFace(lf.name, mustLoadFont(lf.name), lf.size, TextDPI()).Metrics().Height)
+					if vert {
+						advance = tabs.advance(i, ypos-minY, 0)
+					} else {
+						advance = tabs.advance(i, xpos-minX, penFrac)
+					}
+					v = ""
+				} else if p.shaped != nil {
+					letterHeight = Fixed2int(cachedFace(lf.name, mustLoadFont(lf.name), lf.size, TextDPI()).Metrics().Height)
+					advance = p.shaped[k].advance
+					glyphs = p.shaped[k].glyphs
+					originX = shapedMargin(lf.size)
+					v = ""
+				} else {
+					rtl := p.levels[k]%2 == 1
+					if rtl {
+						// Right-to-left characters are drawn reversed, with brackets mirrored
+						v = reverseRTL(v)
+					}
+					// Characters missing from the font come from its fallbacks, drawn on the same baseline.  DrawStringRGBA measures with the face of the first character, so do the same here
+					firstRune, _ := utf8.DecodeRuneInString(v)
+					runName, runFont, err := Fonts.FontForRune(lf.name, firstRune)
+					if err != nil {
+						panic(err)
+					}
+					fa := cachedFace(runName, runFont, lf.size, TextDPI())
+					// glyph, _ := utf8.DecodeRuneInString(v)
+					// fuckedRect, _, _ := fa.GlyphBounds(glyph)
+					// letterHeight := fixed2int(fuckedRect.Max.Y)
+					letterHeight = Fixed2int(fa.Metrics().Height)
+					if !vert && !rtl && prevRune >= 0 && prevFont == lf {
+						kern := penFrac + TextKern(lf.size, prevRune, firstRune, lf.name)
+						if !f.SubPixel {
+							kern = fixed.I(kern.Round())
+						}
+						xpos += kern.Floor()
+						penFrac = kern - fixed.I(kern.Floor())
+					}
+					advance = TextAdvance(lf.size, v, lf.name)
+					originX = textOriginX(fa, v)
+				}
+				if !tab {
+					advance += lf.extra()
 				}
-				img, face := DrawStringRGBA(f.FontSize, *foreGround, v, "f1.ttf")
-				XmaX, YmaX := img.Bounds().Max.X, img.Bounds().Max.Y
-				imgBytes := img.Pix
-				// imgBytes := Rotate270(XmaX, YmaX, img.Pix)
-				// XmaX, YmaX = YmaX, XmaX
-				fa := *face
-				// glyph, _ := utf8.DecodeRuneInString(v)
-				// letterWidth_F, _ := fa.GlyphAdvance(glyph)
-				// letterWidth = Fixed2int(letterWidth_F)
-				// fuckedRect, _, _ := fa.GlyphBounds(glyph)
-				// letterHeight := fixed2int(fuckedRect.Max.Y)
-				letterHeight := Fixed2int(fa.Metrics().Height)
-				letterWidth := XmaX / 2
+				if !f.SubPixel {
+					advance = fixed.I(advance.Round())
+				}
+				letterWidth := advance.Ceil()
 				// letterHeight = letterHeight
 
-				if vert && (xpos < 0) {
+				if vert && (xpos < minX) {
 					if vert {
+						flushLine(false)
 						f.LastDrawnCharPos = i - 1
-						return seekCursorPos, xpos, ypos
+						return finish()
 					} else {
 						pos := MoveInBounds(Vec2{xpos, ypos}, Vec2{minX, minY}, Vec2{maxX, maxY}, Vec2{gx, gy}, Vec2{0, 1}, Vec2{-1, 0}, 10)
 						xpos = pos.X
 						ypos = pos.Y
 					}
 				}
-				/*if xpos+XmaX > maxX {
-					if !vert {
-						ypos = ypos + maxHeight
-						maxHeight = 0
+				if !vert && xpos > minX {
+					// Soft wrap before a word that won't fit, or inside a word that is wider than the whole line
+					wrap := false
+					if p.breaks[k] > 0 {
+						wrap = xpos+p.width(i, p.breaks[k]) > maxX
+					}
+					if strings.TrimSpace(v) != "" && xpos+letterWidth > maxX {
+						wrap = true
+					}
+					if wrap {
+						flushLine(false)
+						ypos = ypos + lastPitch
+						newLine()
 						// fmt.Printf("OOB X forces line++\n")
 						xpos = minX
+						penFrac = 0
+						prevRune = -1
 						f.Line++
 						f.StartLinePos = i
 					}
-				}*/
+				}
 
 				if (ypos+YmaX+ytweak+1 > maxY) || (ypos+ytweak < 0) {
 					if vert {
-						xpos = xpos - maxHeight
-						maxHeight = 0
+						flushLine(false)
+						xpos = xpos - lastPitch
+						newLine()
 						ypos = minY
 						// fmt.Printf("OOB Y forces line++\n")
 						f.Line++
 						f.StartLinePos = i
 					} else {
+						flushLine(false)
 						f.LastDrawnCharPos = i - 1
-						return seekCursorPos, xpos, ypos
+						return finish()
 					}
 				}
-				pos := MoveInBounds(Vec2{xpos, ypos}, Vec2{minX, minY}, Vec2{maxX, maxY}, Vec2{XmaX, YmaX}, Vec2{0, 1}, Vec2{-1, 0}, 10)
+				pos := MoveInBounds(Vec2{xpos, ypos}, Vec2{minX, minY}, Vec2{maxX, maxY}, Vec2{letterWidth, YmaX}, Vec2{0, 1}, Vec2{-1, 0}, 10)
 				xpos = pos.X
 				ypos = pos.Y
 
-				if !hitFound {
-					hitW := letterWidth
-					hitH := letterHeight
-					if hitW <= 0 {
-						hitW = gx
-					}
-					if hitH <= 0 {
-						hitH = gy
-					}
-					if cursorX >= xpos && cursorX < xpos+hitW && cursorY >= ypos && cursorY < ypos+hitH {
-						seekCursorPos = i
-						hitFound = true
-					}
-				}
-
-				if selected {
-					if doDraw {
-						fillW := letterWidth
-						fillH := letterHeight
-						if fillW <= 0 {
-							fillW = gx
-						}
-						if fillH <= 0 {
-							fillH = gy
-						}
-						FillRect(xpos, ypos, fillW, fillH, pixWidth, pixHeight, u8Pix, f.HighlightColour)
-					}
-				}
-				if doDraw {
-					// PasteImg(img, xpos, ypos + ytweak, u8Pix, transparent)
-					// PasteBytes(XmaX, YmaX, imgBytes, xpos, ypos+ytweak, int(pixWidth), int(pixHeight), u8Pix, transparent)
-					PasteBytes(XmaX, YmaX, imgBytes, xpos, ypos+ytweak, int(pixWidth), int(pixHeight), u8Pix, true, false, false)
+				f.LastDrawnCharPos = i
+				if vert {
+					maxHeight = MaxI(maxHeight, letterHeight)
+				} else {
+					lineAscent = MaxI(lineAscent, textBaseline(lf.size))
+					lineDescent = MaxI(lineDescent, letterHeight-textBaseline(lf.size))
+					maxHeight = lineAscent + lineDescent
 				}
 
-				if f.Cursor == i && showCursor {
-					DrawCursor(xpos, ypos, maxHeight, pixWidth, u8Pix, f.CursorColour)
+				g := lineGlyph{
+					index:   i,
+					text:    v,
+					shaped:  glyphs,
+					font:    lf,
+					style:   style,
+					colour:  *foreGround,
+					originX: originX,
+					x:       xpos,
+					y:       ypos,
+					w:       letterWidth,
+					h:       letterHeight,
+					advance: letterWidth,
+					ytweak:  ytweak,
+					level:   p.levels[k],
+					base:    p.bases[k],
+					space:   strings.TrimSpace(v) == "",
+					tab:     tab,
 				}
-
-				f.LastDrawnCharPos = i
-				maxHeight = MaxI(maxHeight, letterHeight)
-
 				if vert {
-					ypos += maxHeight
+					g.advance = maxHeight + int(math.Round(lf.spacing))
+					if tab {
+						g.w, g.h = letterHeight, letterWidth
+						g.advance = letterWidth
+					}
+					ypos += g.advance
 				} else {
-					xpos += letterWidth
+					pen := penFrac + advance
+					xpos += pen.Floor()
+					penFrac = pen - fixed.I(pen.Floor())
+					prevRune, _ = utf8.DecodeLastRuneInString(v)
+					prevFont = lf
+					if tab {
+						prevRune = -1
+					}
 				}
+				line = append(line, g)
 			}
 		}
-		if !hitFound {
-			d := (cursorX-xpos+letterWidth)*(cursorX-xpos+letterWidth) + (cursorY-ypos-maxHeight/2)*(cursorY-ypos-maxHeight/2)
-			if d < cursorDist {
-				cursorDist = d
-				seekCursorPos = i
-			}
-		}
-
 	}
+	flushLine(true)
 	// SanityCheck(f, text)
-	return seekCursorPos, xpos, ypos
+	return finish()
 }
 
 // Return the larger of two integers
@@ -431,3 +995,11 @@ func MaxI(a, b int) int {
 	}
 	return b
 }
+
+// Return the smaller of two integers
+func MinI(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
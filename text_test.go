@@ -0,0 +1,79 @@
+package glim
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSoftBreaks(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want []int
+	}{
+		{"one word", "word", []int{4, 0, 0, 0}},
+		{"words keep their spaces", "ab  cd", []int{4, 0, 0, 0, 6, 0}},
+		{"after a hyphen", "a-b", []int{2, 0, 3}},
+		{"not before punctuation", "ab, cd", []int{4, 0, 0, 0, 6, 0}},
+		{"no break inside a number", "1.5 x", []int{4, 0, 0, 0, 5}},
+		{"between ideographs", "日本語", []int{1, 2, 3}},
+		{"grapheme clusters are one letter", "é f", []int{2, 0, 3}},
+		{"empty", "", []int{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := softBreaks(Graphemes(tt.text)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// The text on each laid out line
+func lineTexts(l *Layout, tokens []Token) []string {
+	out := []string{}
+	for _, line := range l.Lines {
+		text := ""
+		for _, tok := range tokens[line.Start:MinI(line.End, len(tokens))] {
+			text += tok.Text
+		}
+		out = append(out, text)
+	}
+	return out
+}
+
+// Lines wrap between words, and a word wider than the whole line is broken wherever it reaches the edge
+func TestSoftWrap(t *testing.T) {
+	long := strings.Repeat("x", 30)
+	tests := []struct {
+		name string
+		text string
+		want []string
+	}{
+		{"fits", "one two", []string{"one two"}},
+		{"wraps between words", "one two three four five", []string{"one two ", "three four ", "five"}},
+		{"spaces hang past the edge", "one two three      four", []string{"one two ", "three      ", "four"}},
+		{"long word starts a new line, then breaks", "ab " + long, []string{"ab ", long[:12], long[12:24], long[24:]}},
+		{"long word at the start", long + " ab", []string{long[:12], long[12:24], long[24:] + " ab"}},
+		{"hard lines", "one\ntwo three four five", []string{"one\n", "two three ", "four five"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFormatter()
+			f.FontName = "gomono"
+			f.FontSize = 12
+			width := 12 * Fixed2int(TextAdvance(12, "x", "gomono")) // Room for 12 letters
+			tokens := lineTokens(tt.text)
+			l := LayoutTokenPara(f, 0, 0, 0, 0, width, 500, tokens)
+			if got := lineTexts(l, tokens); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			for _, g := range l.Glyphs {
+				if strings.TrimSpace(tokens[g.Index].Text) != "" && g.Rect.Max.X > width {
+					t.Errorf("%q at %v is past the edge at %v", tokens[g.Index].Text, g.Rect, width)
+				}
+			}
+		})
+	}
+}
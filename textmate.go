@@ -0,0 +1,342 @@
+// TextMate and VS Code themes.  Converts .tmTheme (plist XML) and VS Code colour theme (JSON) files into Themes
+package glim
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// One rule of a TextMate theme: the scope selectors it applies to, and its settings (foreground, background, fontStyle and so on)
+type tmRule struct {
+	scopes   []string
+	settings map[string]string
+}
+
+// Load a TextMate (.tmTheme) or VS Code colour theme file.  See ImportTextMateTheme
+func LoadTextMateTheme(path string) (*Theme, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read theme: %w", err)
+	}
+	t, err := ImportTextMateTheme(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not import theme %v: %w", path, err)
+	}
+	return t, nil
+}
+
+// Convert a TextMate (.tmTheme, a plist) or VS Code colour theme (JSON, comments allowed) into a Theme.
+//
+// Only plain scope selectors are used, like "comment" or "string.quoted, constant".  Selectors that depend on the surrounding scopes, like "source.go string", are skipped, since highlighters here only give each piece of text one scope.  Colours with transparency are mixed with the background, because they are drawn without blending
+//
+// A scope's style has every setting of its parents that it doesn't set itself, so each style in the theme is complete
+func ImportTextMateTheme(data []byte) (*Theme, error) {
+	var (
+		name    string
+		globals map[string]string
+		rules   []tmRule
+		err     error
+	)
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '<' {
+		name, globals, rules, err = readTmTheme(trimmed)
+	} else {
+		name, globals, rules, err = readVSCodeTheme(trimmed)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &Theme{Name: name, Styles: map[string]Style{}}
+	colour := func(s string) *RGBA {
+		c, err := parseColour(strings.TrimSpace(s))
+		if err != nil {
+			return nil
+		}
+		return mixOver(c, t.BackgroundColour)
+	}
+	t.BackgroundColour = colour(globals["background"])
+	t.Default.ForegroundColour = colour(globals["foreground"])
+	t.CursorColour = colour(globals["caret"])
+	t.HighlightColour = colour(globals["selection"])
+	t.SelectColour = colour(globals["selectionForeground"])
+
+	// Later rules override earlier ones, a setting at a time
+	merged := map[string]map[string]string{}
+	for _, rule := range rules {
+		for _, scope := range rule.scopes {
+			scope = strings.TrimSpace(scope)
+			if scope == "" || strings.ContainsAny(scope, " |&()") {
+				continue
+			}
+			if merged[scope] == nil {
+				merged[scope] = map[string]string{}
+			}
+			for k, v := range rule.settings {
+				merged[scope][k] = v
+			}
+		}
+	}
+	for scope := range merged {
+		// Parents first, so the scope's own settings win.  As in TextMate, with keyword red and keyword.control bold, keyword.control is bold and red
+		settings := map[string]string{}
+		parts := strings.Split(scope, ".")
+		for i := range parts {
+			for k, v := range merged[strings.Join(parts[:i+1], ".")] {
+				settings[k] = v
+			}
+		}
+		s := Style{
+			ForegroundColour: colour(settings["foreground"]),
+			BackgroundColour: colour(settings["background"]),
+		}
+		for _, word := range strings.Fields(settings["fontStyle"]) {
+			switch word {
+			case "bold":
+				s.Bold = true
+			case "italic":
+				s.Italic = true
+			case "underline":
+				s.Underline = UnderlineStraight
+			case "strikethrough":
+				s.Strikethrough = true
+			}
+		}
+		t.Styles[scope] = s
+	}
+	return t, nil
+}
+
+// Mix a colour with some transparency over an opaque background, so it can be drawn without blending
+func mixOver(c, bg *RGBA) *RGBA {
+	if c == nil || bg == nil || colourKey(*c)[3] == 255 {
+		return c
+	}
+	fg, back := colourKey(*c), colourKey(*bg)
+	a := int(fg[3])
+	out := RGBA{0, 0, 0, 255}
+	for i := 0; i < 3; i++ {
+		out[i] = uint8((int(fg[i])*a + int(back[i])*(255-a) + 127) / 255)
+	}
+	return &out
+}
+
+// Read a VS Code colour theme.  Its "colors" are turned into the global settings of a TextMate theme, and its "tokenColors" are TextMate rules
+func readVSCodeTheme(data []byte) (string, map[string]string, []tmRule, error) {
+	var file struct {
+		Name        string            `json:"name"`
+		Colors      map[string]string `json:"colors"`
+		TokenColors json.RawMessage   `json:"tokenColors"`
+	}
+	if err := json.Unmarshal(stripJSONComments(data), &file); err != nil {
+		return "", nil, nil, err
+	}
+	globals := map[string]string{}
+	for from, to := range map[string]string{
+		"editor.foreground":          "foreground",
+		"editor.background":          "background",
+		"editorCursor.foreground":    "caret",
+		"editor.selectionBackground": "selection",
+		"editor.selectionForeground": "selectionForeground",
+	} {
+		if c, ok := file.Colors[from]; ok {
+			globals[to] = c
+		}
+	}
+	var entries []struct {
+		Scope    json.RawMessage   `json:"scope"`
+		Settings map[string]string `json:"settings"`
+	}
+	if len(file.TokenColors) > 0 {
+		if err := json.Unmarshal(file.TokenColors, &entries); err != nil {
+			return "", nil, nil, fmt.Errorf("tokenColors must be a list of rules (a path to a separate file isn't supported): %w", err)
+		}
+	}
+	rules := []tmRule{}
+	for _, e := range entries {
+		var scopes []string
+		var one string
+		if len(e.Scope) == 0 {
+			// A rule with no scope holds global settings, as in a tmTheme
+			for k, v := range e.Settings {
+				if _, ok := globals[k]; !ok {
+					globals[k] = v
+				}
+			}
+			continue
+		}
+		if err := json.Unmarshal(e.Scope, &one); err == nil {
+			scopes = strings.Split(one, ",")
+		} else if err := json.Unmarshal(e.Scope, &scopes); err != nil {
+			return "", nil, nil, fmt.Errorf("bad scope %s", e.Scope)
+		}
+		rules = append(rules, tmRule{scopes, e.Settings})
+	}
+	return file.Name, globals, rules, nil
+}
+
+// Remove // and /* */ comments, and commas before a closing bracket, which VS Code allows in its JSON files
+func stripJSONComments(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inString:
+			out = append(out, c)
+			if c == '\\' && i+1 < len(data) {
+				i++
+				out = append(out, data[i])
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+			out = append(out, c)
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			i--
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := bytes.Index(data[i+2:], []byte("*/"))
+			if end < 0 {
+				return out
+			}
+			i += end + 3
+		case c == '}' || c == ']':
+			// Drop a trailing comma
+			k := len(out) - 1
+			for k >= 0 && (out[k] == ' ' || out[k] == '\t' || out[k] == '\n' || out[k] == '\r') {
+				k--
+			}
+			if k >= 0 && out[k] == ',' {
+				out = append(out[:k], out[k+1:]...)
+			}
+			out = append(out, c)
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// Read a .tmTheme file.  The first rule with no scope holds the global settings
+func readTmTheme(data []byte) (string, map[string]string, []tmRule, error) {
+	root, err := readPlist(data)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	dict, ok := root.(map[string]interface{})
+	if !ok {
+		return "", nil, nil, fmt.Errorf("theme plist doesn't hold a dictionary")
+	}
+	name, _ := dict["name"].(string)
+	list, _ := dict["settings"].([]interface{})
+	globals := map[string]string{}
+	rules := []tmRule{}
+	for _, item := range list {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		settings := map[string]string{}
+		if s, ok := entry["settings"].(map[string]interface{}); ok {
+			for k, v := range s {
+				if str, ok := v.(string); ok {
+					settings[k] = str
+				}
+			}
+		}
+		scope, _ := entry["scope"].(string)
+		if scope == "" {
+			for k, v := range settings {
+				if _, ok := globals[k]; !ok {
+					globals[k] = v
+				}
+			}
+			continue
+		}
+		rules = append(rules, tmRule{strings.Split(scope, ","), settings})
+	}
+	return name, globals, rules, nil
+}
+
+// Read an XML property list into maps (for dict), slices (array), strings (string, and also numbers and dates) and bools
+func readPlist(data []byte) (interface{}, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	d.Strict = false
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, fmt.Errorf("bad plist: %w", err)
+		}
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Local != "plist" {
+			return readPlistValue(d, start)
+		}
+	}
+}
+
+// Read the value that start opens, up to its end tag
+func readPlistValue(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	switch start.Name.Local {
+	case "dict":
+		out := map[string]interface{}{}
+		key := ""
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				if t.Name.Local == "key" {
+					var k string
+					if err := d.DecodeElement(&k, &t); err != nil {
+						return nil, err
+					}
+					key = k
+					continue
+				}
+				v, err := readPlistValue(d, t)
+				if err != nil {
+					return nil, err
+				}
+				out[key] = v
+			case xml.EndElement:
+				return out, nil
+			}
+		}
+	case "array":
+		out := []interface{}{}
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				v, err := readPlistValue(d, t)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, v)
+			case xml.EndElement:
+				return out, nil
+			}
+		}
+	case "true", "false":
+		if err := d.Skip(); err != nil {
+			return nil, err
+		}
+		return start.Name.Local == "true", nil
+	default:
+		var s string
+		if err := d.DecodeElement(&s, &start); err != nil {
+			return nil, err
+		}
+		return s, nil
+	}
+}
@@ -0,0 +1,286 @@
+// Colour themes.  Styles for highlighted text, looked up by scope name, and the colours for the rest of a text view
+package glim
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Styles for highlighted text, by scope, and colours for the cursor, selection and background.  Scopes are dotted names, like TextMate's, e.g. "keyword.control" or "string.quoted.double"
+//
+// Themes are saved and loaded as JSON, see LoadTheme
+type Theme struct {
+	Name    string
+	Styles  map[string]Style // A scope with no style of its own uses its parent's, so "keyword" covers "keyword.control"
+	Default Style            // For text with no scope, or no style for its scope.  Its ForegroundColour is also the formatter's text colour
+
+	// The FormatParams colours of the same names.  nil leaves a formatter's colour as it is, except for SelectColour, where nil draws selected text in its own colour
+	BackgroundColour *RGBA
+	CursorColour     *RGBA
+	SelectColour     *RGBA
+	HighlightColour  *RGBA
+}
+
+// The style for text in scope
+func (t *Theme) StyleFor(scope string) Style {
+	for scope != "" {
+		if s, ok := t.Styles[scope]; ok {
+			if s.ForegroundColour == nil {
+				s.ForegroundColour = t.Default.ForegroundColour
+			}
+			return s
+		}
+		dot := strings.LastIndexByte(scope, '.')
+		if dot < 0 {
+			break
+		}
+		scope = scope[:dot]
+	}
+	return t.Default
+}
+
+// Set f's text, background, cursor and selection colours from the theme.  Tokens with no colour of their own are drawn in the text colour, so switching themes at runtime only needs this and a redraw (and TextBuffer.SetTheme, for highlighted text)
+func (t *Theme) Apply(f *FormatParams) {
+	if t.Default.ForegroundColour != nil {
+		f.Colour = t.Default.ForegroundColour
+	}
+	if t.BackgroundColour != nil {
+		f.BackgroundColour = t.BackgroundColour
+	}
+	if t.CursorColour != nil {
+		f.CursorColour = t.CursorColour
+	}
+	if t.HighlightColour != nil {
+		f.HighlightColour = t.HighlightColour
+	}
+	f.SelectColour = t.SelectColour
+}
+
+// A dark theme, used when a Highlighter has no theme of its own
+var DefaultTheme = &Theme{
+	Name:             "Dark",
+	Default:          Style{ForegroundColour: &RGBA{212, 212, 212, 255}},
+	BackgroundColour: &RGBA{30, 30, 30, 255},
+	CursorColour:     &RGBA{174, 175, 173, 255},
+	HighlightColour:  &RGBA{38, 79, 120, 255},
+	Styles: map[string]Style{
+		"comment":                   {ForegroundColour: &RGBA{106, 153, 85, 255}},
+		"string":                    {ForegroundColour: &RGBA{206, 145, 120, 255}},
+		"constant.character.escape": {ForegroundColour: &RGBA{215, 186, 125, 255}},
+		"constant.numeric":          {ForegroundColour: &RGBA{181, 206, 168, 255}},
+		"constant.language":         {ForegroundColour: &RGBA{86, 156, 214, 255}},
+		"keyword":                   {ForegroundColour: &RGBA{197, 134, 192, 255}},
+		"keyword.operator":          {ForegroundColour: &RGBA{212, 212, 212, 255}},
+		"storage":                   {ForegroundColour: &RGBA{86, 156, 214, 255}},
+		"support.type":              {ForegroundColour: &RGBA{78, 201, 176, 255}},
+		"support.function":          {ForegroundColour: &RGBA{220, 220, 170, 255}},
+		"entity.name.function":      {ForegroundColour: &RGBA{220, 220, 170, 255}},
+		"variable":                  {ForegroundColour: &RGBA{156, 220, 254, 255}},
+		"punctuation":               {ForegroundColour: &RGBA{212, 212, 212, 255}},
+		"markup.heading":            {ForegroundColour: &RGBA{86, 156, 214, 255}, Bold: true},
+		"markup.bold":               {Bold: true},
+		"markup.italic":             {Italic: true},
+		"markup.raw":                {ForegroundColour: &RGBA{206, 145, 120, 255}},
+		"markup.quote":              {ForegroundColour: &RGBA{106, 153, 85, 255}, Italic: true},
+		"markup.list":               {ForegroundColour: &RGBA{103, 150, 230, 255}},
+		"markup.underline.link":     {ForegroundColour: &RGBA{78, 201, 176, 255}, Underline: UnderlineStraight},
+		"meta.separator":            {ForegroundColour: &RGBA{128, 128, 128, 255}},
+		"invalid":                   {ForegroundColour: &RGBA{244, 71, 71, 255}, Underline: UnderlineWavy},
+	},
+}
+
+// A light theme, to go with DefaultTheme
+var LightTheme = &Theme{
+	Name:             "Light",
+	Default:          Style{ForegroundColour: &RGBA{0, 0, 0, 255}},
+	BackgroundColour: &RGBA{255, 255, 255, 255},
+	CursorColour:     &RGBA{0, 0, 0, 255},
+	HighlightColour:  &RGBA{173, 214, 255, 255},
+	Styles: map[string]Style{
+		"comment":                   {ForegroundColour: &RGBA{0, 128, 0, 255}},
+		"string":                    {ForegroundColour: &RGBA{163, 21, 21, 255}},
+		"constant.character.escape": {ForegroundColour: &RGBA{238, 0, 0, 255}},
+		"constant.numeric":          {ForegroundColour: &RGBA{9, 134, 88, 255}},
+		"constant.language":         {ForegroundColour: &RGBA{0, 0, 255, 255}},
+		"keyword":                   {ForegroundColour: &RGBA{175, 0, 219, 255}},
+		"keyword.operator":          {ForegroundColour: &RGBA{0, 0, 0, 255}},
+		"storage":                   {ForegroundColour: &RGBA{0, 0, 255, 255}},
+		"support.type":              {ForegroundColour: &RGBA{38, 127, 153, 255}},
+		"support.function":          {ForegroundColour: &RGBA{121, 94, 38, 255}},
+		"entity.name.function":      {ForegroundColour: &RGBA{121, 94, 38, 255}},
+		"variable":                  {ForegroundColour: &RGBA{0, 16, 128, 255}},
+		"punctuation":               {ForegroundColour: &RGBA{0, 0, 0, 255}},
+		"markup.heading":            {ForegroundColour: &RGBA{128, 0, 0, 255}, Bold: true},
+		"markup.bold":               {Bold: true},
+		"markup.italic":             {Italic: true},
+		"markup.raw":                {ForegroundColour: &RGBA{128, 0, 0, 255}},
+		"markup.quote":              {ForegroundColour: &RGBA{4, 81, 165, 255}, Italic: true},
+		"markup.list":               {ForegroundColour: &RGBA{4, 81, 165, 255}},
+		"markup.underline.link":     {ForegroundColour: &RGBA{0, 0, 238, 255}, Underline: UnderlineStraight},
+		"meta.separator":            {ForegroundColour: &RGBA{128, 128, 128, 255}},
+		"invalid":                   {ForegroundColour: &RGBA{205, 49, 49, 255}, Underline: UnderlineWavy},
+	},
+}
+
+// The JSON form of a Style.  Colours are "#rrggbb" or "#rrggbbaa"
+type styleJSON struct {
+	ForegroundColour string  `json:"foregroundColour,omitempty"`
+	FontName         string  `json:"fontName,omitempty"`
+	FontSize         float64 `json:"fontSize,omitempty"`
+	Bold             bool    `json:"bold,omitempty"`
+	Italic           bool    `json:"italic,omitempty"`
+	LetterSpacing    float64 `json:"letterSpacing,omitempty"`
+	BackgroundColour string  `json:"backgroundColour,omitempty"`
+	Underline        string  `json:"underline,omitempty"` // "straight" or "wavy"
+	UnderlineColour  string  `json:"underlineColour,omitempty"`
+	Strikethrough    bool    `json:"strikethrough,omitempty"`
+	BoxColour        string  `json:"boxColour,omitempty"`
+}
+
+// The JSON form of a Theme
+type themeJSON struct {
+	Name             string               `json:"name"`
+	Default          styleJSON            `json:"default"`
+	BackgroundColour string               `json:"backgroundColour,omitempty"`
+	CursorColour     string               `json:"cursorColour,omitempty"`
+	SelectColour     string               `json:"selectColour,omitempty"`
+	HighlightColour  string               `json:"highlightColour,omitempty"`
+	Styles           map[string]styleJSON `json:"styles"`
+}
+
+var underlineNames = map[Underline]string{UnderlineStraight: "straight", UnderlineWavy: "wavy"}
+
+// Write a colour as "#rrggbb", or "#rrggbbaa" if it isn't opaque.  nil is ""
+func colourString(c *RGBA) string {
+	if c == nil {
+		return ""
+	}
+	k := colourKey(*c)
+	if k[3] == 255 {
+		return fmt.Sprintf("#%02x%02x%02x", k[0], k[1], k[2])
+	}
+	return fmt.Sprintf("#%02x%02x%02x%02x", k[0], k[1], k[2], k[3])
+}
+
+// Read a colour written as "#rgb", "#rgba", "#rrggbb" or "#rrggbbaa".  "" is nil
+func parseColour(s string) (*RGBA, error) {
+	if s == "" {
+		return nil, nil
+	}
+	hex := strings.TrimPrefix(s, "#")
+	if len(hex) == 3 || len(hex) == 4 {
+		long := ""
+		for _, c := range hex {
+			long += string(c) + string(c)
+		}
+		hex = long
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+	n, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 8 || err != nil {
+		return nil, fmt.Errorf("bad colour %q", s)
+	}
+	return &RGBA{uint8(n >> 24), uint8(n >> 16), uint8(n >> 8), uint8(n)}, nil
+}
+
+func (s Style) toJSON() styleJSON {
+	return styleJSON{
+		ForegroundColour: colourString(s.ForegroundColour),
+		FontName:         s.FontName,
+		FontSize:         s.FontSize,
+		Bold:             s.Bold,
+		Italic:           s.Italic,
+		LetterSpacing:    s.LetterSpacing,
+		BackgroundColour: colourString(s.BackgroundColour),
+		Underline:        underlineNames[s.Underline],
+		UnderlineColour:  colourString(s.UnderlineColour),
+		Strikethrough:    s.Strikethrough,
+		BoxColour:        colourString(s.BoxColour),
+	}
+}
+
+func (j styleJSON) style() (Style, error) {
+	s := Style{FontName: j.FontName, FontSize: j.FontSize, Bold: j.Bold, Italic: j.Italic, LetterSpacing: j.LetterSpacing, Strikethrough: j.Strikethrough}
+	var err error
+	for _, c := range []struct {
+		to   **RGBA
+		from string
+	}{{&s.ForegroundColour, j.ForegroundColour}, {&s.BackgroundColour, j.BackgroundColour}, {&s.UnderlineColour, j.UnderlineColour}, {&s.BoxColour, j.BoxColour}} {
+		if *c.to, err = parseColour(c.from); err != nil {
+			return s, err
+		}
+	}
+	switch j.Underline {
+	case "", "none":
+	case "straight":
+		s.Underline = UnderlineStraight
+	case "wavy":
+		s.Underline = UnderlineWavy
+	default:
+		return s, fmt.Errorf("unknown underline %q", j.Underline)
+	}
+	return s, nil
+}
+
+// Save the theme as JSON
+func (t *Theme) MarshalJSON() ([]byte, error) {
+	j := themeJSON{
+		Name:             t.Name,
+		Default:          t.Default.toJSON(),
+		BackgroundColour: colourString(t.BackgroundColour),
+		CursorColour:     colourString(t.CursorColour),
+		SelectColour:     colourString(t.SelectColour),
+		HighlightColour:  colourString(t.HighlightColour),
+		Styles:           map[string]styleJSON{},
+	}
+	for scope, s := range t.Styles {
+		j.Styles[scope] = s.toJSON()
+	}
+	return json.Marshal(j)
+}
+
+// Load a theme saved with MarshalJSON
+func (t *Theme) UnmarshalJSON(data []byte) error {
+	var j themeJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	out := Theme{Name: j.Name, Styles: map[string]Style{}}
+	var err error
+	if out.Default, err = j.Default.style(); err != nil {
+		return fmt.Errorf("theme %v: %w", j.Name, err)
+	}
+	for _, c := range []struct {
+		to   **RGBA
+		from string
+	}{{&out.BackgroundColour, j.BackgroundColour}, {&out.CursorColour, j.CursorColour}, {&out.SelectColour, j.SelectColour}, {&out.HighlightColour, j.HighlightColour}} {
+		if *c.to, err = parseColour(c.from); err != nil {
+			return fmt.Errorf("theme %v: %w", j.Name, err)
+		}
+	}
+	for scope, sj := range j.Styles {
+		if out.Styles[scope], err = sj.style(); err != nil {
+			return fmt.Errorf("theme %v, scope %v: %w", j.Name, scope, err)
+		}
+	}
+	*t = out
+	return nil
+}
+
+// Load a theme from a JSON file, as written by json.Marshal.  For TextMate and VS Code themes, see LoadTextMateTheme
+func LoadTheme(path string) (*Theme, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read theme: %w", err)
+	}
+	t := &Theme{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, fmt.Errorf("could not load theme %v: %w", path, err)
+	}
+	return t, nil
+}
@@ -0,0 +1,186 @@
+package glim
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestParseColour(t *testing.T) {
+	tests := []struct {
+		in   string
+		want *RGBA // nil for no colour
+		ok   bool
+	}{
+		{"", nil, true},
+		{"#123", &RGBA{0x11, 0x22, 0x33, 255}, true},
+		{"#1234", &RGBA{0x11, 0x22, 0x33, 0x44}, true},
+		{"#a0b1c2", &RGBA{0xa0, 0xb1, 0xc2, 255}, true},
+		{"#A0B1C2D3", &RGBA{0xa0, 0xb1, 0xc2, 0xd3}, true},
+		{"a0b1c2", &RGBA{0xa0, 0xb1, 0xc2, 255}, true},
+		{"#12", nil, false},
+		{"#12345", nil, false},
+		{"#123456789", nil, false},
+		{"#gg0000", nil, false},
+		{"red", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseColour(tt.in)
+			if (err == nil) != tt.ok {
+				t.Fatalf("error %v, want ok %v", err, tt.ok)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThemeJSON(t *testing.T) {
+	blue := RGBA{0, 0, 255, 128}
+	tests := []struct {
+		name  string
+		theme *Theme
+	}{
+		{"dark", DefaultTheme},
+		{"light", LightTheme},
+		{"every field", &Theme{
+			Name: "every field",
+			Styles: map[string]Style{"x": {
+				ForegroundColour: &RGBA{1, 2, 3, 255},
+				FontName:         "goregular",
+				FontSize:         12,
+				Bold:             true,
+				Italic:           true,
+				LetterSpacing:    0.5,
+				BackgroundColour: &blue,
+				Underline:        UnderlineWavy,
+				UnderlineColour:  &RGBA{4, 5, 6, 7},
+				Strikethrough:    true,
+				BoxColour:        &RGBA{8, 9, 10, 255},
+			}},
+			CursorColour: &blue,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.theme)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := &Theme{}
+			if err := json.Unmarshal(data, got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.theme) {
+				t.Errorf("got %+v, want %+v", got, tt.theme)
+			}
+		})
+	}
+	for _, bad := range []string{
+		`{"name": "x", "styles": {"a": {"foregroundColour": "#12"}}}`,
+		`{"name": "x", "default": {"underline": "dotted"}}`,
+		`{"name": "x", "cursorColour": "blue"}`,
+		`{"name": 1}`,
+	} {
+		if err := json.Unmarshal([]byte(bad), &Theme{}); err == nil {
+			t.Errorf("%s: no error", bad)
+		}
+	}
+}
+
+func TestStripJSONComments(t *testing.T) {
+	tests := []struct {
+		name, in, want string
+	}{
+		{"line comment", "{\"a\": 1 // one\n}", "{\"a\": 1 \n}"},
+		{"block comment", `{/* x */"a": 1}`, `{"a": 1}`},
+		{"comments in strings stay", `{"a": "// /* */"}`, `{"a": "// /* */"}`},
+		{"escaped quote", `{"a": "\" // x"}`, `{"a": "\" // x"}`},
+		{"trailing commas", "[1, 2,\n]", "[1, 2\n]"},
+		{"trailing comma before a brace", `{"a": 1, }`, `{"a": 1 }`},
+		{"comma in a string stays", `["a,]"]`, `["a,]"]`},
+		{"unfinished block comment", `{"a": 1 /* x`, `{"a": 1 `},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := string(stripJSONComments([]byte(tt.in))); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadPlist(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want interface{} // nil for an error
+	}{
+		{"string", `<plist><string>a &amp; b</string></plist>`, "a & b"},
+		{"numbers are strings", `<plist version="1.0"><integer>3</integer></plist>`, "3"},
+		{"bools", `<plist><array><true/><false/></array></plist>`, []interface{}{true, false}},
+		{"dict", `<?xml version="1.0"?><!DOCTYPE plist><plist><dict><key>a</key><string>x</string><key>b</key><array><dict/></array></dict></plist>`,
+			map[string]interface{}{"a": "x", "b": []interface{}{map[string]interface{}{}}}},
+		{"cut short", `<plist><dict><key>a</key><string>x</string>`, nil},
+		{"empty", ``, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readPlist([]byte(tt.in))
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("no error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Settings are inherited from parent scopes one at a time, as in TextMate
+func TestImportTextMateThemeInherits(t *testing.T) {
+	red, green := &RGBA{255, 0, 0, 255}, &RGBA{0, 255, 0, 255}
+	tests := []struct {
+		name  string
+		theme string
+	}{
+		{"tmTheme", `<plist><dict><key>settings</key><array>
+			<dict><key>settings</key><dict><key>foreground</key><string>#00ff00</string></dict></dict>
+			<dict><key>scope</key><string>keyword.control</string><key>settings</key><dict><key>fontStyle</key><string>bold</string></dict></dict>
+			<dict><key>scope</key><string>keyword</string><key>settings</key><dict><key>foreground</key><string>#ff0000</string><key>fontStyle</key><string>italic</string></dict></dict>
+			<dict><key>scope</key><string>keyword.control.go</string><key>settings</key><dict><key>fontStyle</key><string></string></dict></dict>
+		</array></dict></plist>`},
+		{"VS Code", `{"colors": {"editor.foreground": "#00ff00"}, "tokenColors": [
+			{"scope": "keyword.control", "settings": {"fontStyle": "bold"}},
+			{"scope": ["keyword"], "settings": {"foreground": "#ff0000", "fontStyle": "italic"}},
+			{"scope": "keyword.control.go", "settings": {"fontStyle": ""}},
+		]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			theme, err := ImportTextMateTheme([]byte(tt.theme))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for scope, want := range map[string]Style{
+				"keyword":              {ForegroundColour: red, Italic: true},
+				"keyword.control":      {ForegroundColour: red, Bold: true},
+				"keyword.control.loop": {ForegroundColour: red, Bold: true},
+				"keyword.control.go":   {ForegroundColour: red},
+				"string":               {ForegroundColour: green},
+			} {
+				if got := theme.StyleFor(scope); !reflect.DeepEqual(got, want) {
+					t.Errorf("%v: got %+v, want %+v", scope, got, want)
+				}
+			}
+		})
+	}
+}